@@ -23,6 +23,8 @@ import (
 	// Optional. You can remove the "_" there, but please do not touch
 	// anything else within the import bracket.
 	_ "strconv"
+
+	// When a share was made.
 )
 
 // This serves two purposes:
@@ -73,11 +75,15 @@ func re(e string) error {
 // *********** Symmetric **************
 // symmetric enc with padding to 16k
 func symEnc(key []byte, content []byte) []byte {
+	return symEncIV(key, userlib.RandomBytes(16), content)
+}
+// same, with a given iv
+func symEncIV(key []byte, iv []byte, content []byte) []byte {
 	pad := 16 - len(content) % 16
 	for i := 0; i < pad; i++ {
 		content = append(content, byte(pad))
 	}
-	return userlib.SymEnc(key, userlib.RandomBytes(16), content)
+	return userlib.SymEnc(key, iv, content)
 }
 // symmetric dec with padding to 16k
 func symDec(key []byte, content []byte) ([]byte, error) {
@@ -97,9 +103,104 @@ func symDec(key []byte, content []byte) ([]byte, error) {
 	return rawText[:len(rawText) - pad], nil
 }
 
+// *********** Backend **************
+// Backend is where a client's Datastore and Keystore live. Its errors say
+// the store could not be reached or answered nonsense, never that a record
+// or key is missing; the op that meets one returns it and drops its writes.
+type Backend interface {
+	// DatastoreGetBatch fetches the values of ids, leaving the missing
+	// ones out.
+	DatastoreGetBatch(ids []userlib.UUID) (map[userlib.UUID][]byte, error)
+	// DatastoreWriteBatch stores sets and removes deletes, which never
+	// share an id.
+	DatastoreWriteBatch(sets map[userlib.UUID][]byte, deletes []userlib.UUID) error
+	KeystoreGet(name string) (userlib.PublicKeyType, bool, error)
+	// KeystoreSet returns an error for a name that is already set.
+	KeystoreSet(name string, key userlib.PublicKeyType) error
+}
+
+// UserlibBackend is userlib's own Datastore and Keystore, one userlib call
+// per record. It never fails but for a Keystore name that is taken.
+type UserlibBackend struct{}
+
+func (UserlibBackend) DatastoreGetBatch(ids []userlib.UUID) (map[userlib.UUID][]byte, error) {
+	values := make(map[userlib.UUID][]byte)
+	for _, id := range ids {
+		value, ok := userlib.DatastoreGet(id)
+		if ok {
+			values[id] = value
+		}
+	}
+	return values, nil
+}
+func (UserlibBackend) DatastoreWriteBatch(sets map[userlib.UUID][]byte, deletes []userlib.UUID) error {
+	for id, value := range sets {
+		userlib.DatastoreSet(id, value)
+	}
+	for _, id := range deletes {
+		userlib.DatastoreDelete(id)
+	}
+	return nil
+}
+func (UserlibBackend) KeystoreGet(name string) (userlib.PublicKeyType, bool, error) {
+	key, ok := userlib.KeystoreGet(name)
+	return key, ok, nil
+}
+func (UserlibBackend) KeystoreSet(name string, key userlib.PublicKeyType) error {
+	return userlib.KeystoreSet(name, key)
+}
+
+// the backend the user's records live in
+func (userdata *User) store() Backend {
+	if userdata == nil || userdata.backend == nil {
+		return UserlibBackend{}
+	}
+	return userdata.backend
+}
+// keep the first backend error until the op reports it; the record it
+// was after looks missing meanwhile
+func (userdata *User) failed(err error) {
+	if userdata != nil && userdata.backendErr == nil {
+		userdata.backendErr = err
+	}
+}
+// hand over the error the backend returned since the last report, in
+// place of whatever the op made of the record it did not get. Ops that do
+// not run in a transaction defer it.
+func (userdata *User) reportBackend(errp *error) {
+	if userdata == nil || userdata.backendErr == nil {
+		return
+	}
+	*errp = userdata.backendErr
+	userdata.backendErr = nil
+}
+func (userdata *User) datastoreGet(id userlib.UUID) ([]byte, bool) {
+	values, err := userdata.store().DatastoreGetBatch([]userlib.UUID{id})
+	if err != nil {
+		userdata.failed(err)
+		return nil, false
+	}
+	value, ok := values[id]
+	return value, ok
+}
+func (userdata *User) datastoreWrite(sets map[userlib.UUID][]byte, deletes []userlib.UUID) {
+	err := userdata.store().DatastoreWriteBatch(sets, deletes)
+	if err != nil {
+		userdata.failed(err)
+	}
+}
+func (userdata *User) keystoreGet(name string) (userlib.PublicKeyType, bool) {
+	key, ok, err := userdata.store().KeystoreGet(name)
+	if err != nil {
+		userdata.failed(err)
+		return key, false
+	}
+	return key, ok
+}
+
 // *********** HMAC **************
 // hmac enc data store Set
-func hmacDatastoreSet(id userlib.UUID, content []byte) {
+func (userdata *User) hmacDatastoreSet(id userlib.UUID, content []byte) {
 	key := make([]byte, 16)
 	for i := range id {
 		key[i] = id[i]
@@ -108,18 +209,38 @@ func hmacDatastoreSet(id userlib.UUID, content []byte) {
 	if err != nil {
 		return
 	}
-	userlib.DatastoreSet(id, append(content, tag...))
+	userdata.journalSet(id, append(content, tag...))
 }
 // hmac dec data store Get
-func hmacDatastoreGet(id userlib.UUID) ([]byte, bool) {
+func (userdata *User) hmacDatastoreGet(id userlib.UUID) ([]byte, bool) {
+	content, exist := userdata.journalGet(id)
+	if !exist {
+		return nil, false
+	}
+	return hmacOpen(id, content)
+}
+// hmac dec data store Get of many records in one round trip, the missing
+// and damaged ones left out
+func (userdata *User) hmacDatastoreGetBatch(ids []userlib.UUID) (map[userlib.UUID][]byte, error) {
+	fetched, err := userdata.journalGetBatch(ids)
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[userlib.UUID][]byte)
+	for id, content := range fetched {
+		encData, ok := hmacOpen(id, content)
+		if ok {
+			records[id] = encData
+		}
+	}
+	return records, nil
+}
+// check the tag of a record already fetched, and strip it
+func hmacOpen(id userlib.UUID, content []byte) ([]byte, bool) {
 	key := make([]byte, 16)
 	for i := range id {
 		key[i] = id[i]
 	}
-	content, exist := userlib.DatastoreGet(id)
-	if !exist {
-		return nil, false
-	}
 	if len(content) < 64 {
 		return nil, false
 	}
@@ -134,24 +255,310 @@ func hmacDatastoreGet(id userlib.UUID) ([]byte, bool) {
 	return encData, true
 }
 // new a UUID without collision
-func newID() userlib.UUID {
+func (userdata *User) newID() userlib.UUID {
 	k := userlib.UUIDNew()
-	_, ok := hmacDatastoreGet(k)
+	_, ok := userdata.hmacDatastoreGet(k)
 	for ok {
 		k = userlib.UUIDNew()
-		_, ok = hmacDatastoreGet(k)
+		_, ok = userdata.hmacDatastoreGet(k)
+	}
+	// Keep it in the ledger so garbage collection knows it is ours
+	tx := userdata.running()
+	if tx != nil {
+		tx.allocated[k] = tx.scope
 	}
 	return k
 }
 
+// *********** Journal **************
+// journalOp is one buffered write, or a delete
+type journalOp struct {
+	ID userlib.UUID
+	Content []byte
+	Delete bool
+}
+// journal buffers the writes of the user's running transaction. Each User
+// has its own, so two users working at once never share one.
+type journal struct {
+	user *User
+	depth int
+	ops []journalOp
+	latest map[userlib.UUID]int // id to its last op
+	allocated map[userlib.UUID]userlib.UUID // new id to the file it is for
+	scope userlib.UUID // content list of the file being worked on
+	key []byte // the journal key when it started, the log is sealed under it
+}
+
+// data store Set, buffered while in a transaction
+func (userdata *User) journalSet(id userlib.UUID, content []byte) {
+	tx := userdata.running()
+	if tx == nil {
+		userdata.datastoreWrite(map[userlib.UUID][]byte{id: content}, nil)
+		return
+	}
+	tx.latest[id] = len(tx.ops)
+	tx.ops = append(tx.ops, journalOp{id, append([]byte(nil), content...), false})
+}
+// data store Delete, buffered while in a transaction
+func (userdata *User) datastoreDelete(id userlib.UUID) {
+	tx := userdata.running()
+	if tx == nil {
+		userdata.datastoreWrite(nil, []userlib.UUID{id})
+		return
+	}
+	tx.latest[id] = len(tx.ops)
+	tx.ops = append(tx.ops, journalOp{id, nil, true})
+}
+// data store Get, seeing our own buffered writes first
+func (userdata *User) journalGet(id userlib.UUID) ([]byte, bool) {
+	tx := userdata.running()
+	if tx != nil {
+		i, ok := tx.latest[id]
+		if ok {
+			op := tx.ops[i]
+			return append([]byte(nil), op.Content...), !op.Delete
+		}
+	}
+	return userdata.datastoreGet(id)
+}
+// journalGet of many ids, fetching the ones not buffered in one batch
+func (userdata *User) journalGetBatch(ids []userlib.UUID) (map[userlib.UUID][]byte, error) {
+	records := make(map[userlib.UUID][]byte)
+	var fetch []userlib.UUID
+	tx := userdata.running()
+	for _, id := range ids {
+		if tx != nil {
+			i, ok := tx.latest[id]
+			if ok {
+				op := tx.ops[i]
+				if !op.Delete {
+					records[id] = append([]byte(nil), op.Content...)
+				}
+				continue
+			}
+		}
+		fetch = append(fetch, id)
+	}
+	if len(fetch) > 0 {
+		fetched, err := userdata.store().DatastoreGetBatch(fetch)
+		if err != nil {
+			return nil, err
+		}
+		for id, content := range fetched {
+			records[id] = content
+		}
+	}
+	return records, nil
+}
+// write the ops out for real; only the last op on an id counts. The user
+// record and what it keys go after the rest, so a login that finds them
+// new finds everything else in place too.
+func (userdata *User) applyJournal(ops []journalOp) error {
+	lastIDs := make(map[userlib.UUID]bool)
+	userPtr, err := userlib.UUIDFromBytes(userlib.Hash([]byte(userdata.Username))[:16])
+	if err == nil {
+		lastIDs[userPtr] = true
+	}
+	recoveryPtr, err := recoveryUserPtr(userdata.Username)
+	if err == nil {
+		lastIDs[recoveryPtr] = true
+	}
+	keysPtr, err := userKeysPtr(userdata.Username)
+	if err == nil {
+		lastIDs[keysPtr] = true
+	}
+	var rest, last []journalOp
+	for _, op := range ops {
+		if lastIDs[op.ID] {
+			last = append(last, op)
+		} else {
+			rest = append(rest, op)
+		}
+	}
+	err = userdata.writeJournalOps(rest)
+	if err != nil || len(last) == 0 {
+		return err
+	}
+	return userdata.writeJournalOps(last)
+}
+// write ops out in one batch
+func (userdata *User) writeJournalOps(ops []journalOp) error {
+	sets := make(map[userlib.UUID][]byte)
+	deleted := make(map[userlib.UUID]bool)
+	for _, op := range ops {
+		if op.Delete {
+			delete(sets, op.ID)
+			deleted[op.ID] = true
+		} else {
+			sets[op.ID] = op.Content
+			delete(deleted, op.ID)
+		}
+	}
+	var deletes []userlib.UUID
+	for id := range deleted {
+		deletes = append(deletes, id)
+	}
+	return userdata.store().DatastoreWriteBatch(sets, deletes)
+}
+
+// the user's running transaction, nil outside of one
+func (userdata *User) running() *journal {
+	if userdata == nil {
+		return nil
+	}
+	return userdata.tx
+}
+
+// transaction starts a transaction, or joins the running one. Defer the
+// returned func with the op's error: on success the outermost one commits,
+// on error the writes since this start are dropped.
+func (userdata *User) transaction() func(*error) {
+	if userdata == nil {
+		return func(*error) {}
+	}
+	if userdata.tx == nil {
+		userdata.tx = &journal{user: userdata, latest: make(map[userlib.UUID]int),
+			allocated: make(map[userlib.UUID]userlib.UUID), key: userdata.JournalKey}
+	}
+	tx := userdata.tx
+	tx.depth++
+	savepoint := len(tx.ops)
+	return func(errp *error) {
+		r := recover()
+		tx.depth--
+		if r != nil {
+			userdata.tx = nil
+			panic(r)
+		}
+		if tx.depth == 0 {
+			if *errp == nil {
+				*errp = tx.user.recordAllocations(tx.allocated)
+			}
+			userdata.reportBackend(errp)
+		}
+		if *errp != nil {
+			tx.rollback(savepoint)
+		}
+		if tx.depth > 0 {
+			return
+		}
+		userdata.tx = nil
+		if *errp == nil {
+			*errp = tx.commit()
+		}
+	}
+}
+// drop the ops after the savepoint
+func (tx *journal) rollback(savepoint int) {
+	tx.ops = tx.ops[:savepoint]
+	tx.latest = make(map[userlib.UUID]int)
+	for i := range tx.ops {
+		tx.latest[tx.ops[i].ID] = i
+	}
+	// ids never written are not worth keeping
+	for id := range tx.allocated {
+		_, ok := tx.latest[id]
+		if !ok {
+			delete(tx.allocated, id)
+		}
+	}
+}
+// log the ops under the user, apply them, then drop the log
+func (tx *journal) commit() error {
+	if len(tx.ops) == 0 {
+		return nil
+	}
+	marshalOps, err := userlib.Marshal(tx.ops)
+	if err != nil {
+		return re("Cannot marshal journal.")
+	}
+	dsEncOps, err := dsEnc(tx.user.DKey, symEnc(tx.key, marshalOps))
+	if err != nil {
+		return err
+	}
+	tx.user.hmacDatastoreSet(tx.user.JournalPtr, dsEncOps)
+	tx.user.reportBackend(&err)
+	if err != nil {
+		return err
+	}
+	// Cut off from here on, the next login finishes it
+	err = tx.user.applyJournal(tx.ops)
+	if err != nil {
+		return err
+	}
+	tx.user.datastoreDelete(tx.user.JournalPtr)
+	tx.user.reportBackend(&err)
+	return err
+}
+// finish a commit that was cut off, or drop a log that is not ours
+func (userdata *User) replayJournal(userVDKey []userlib.DSVerifyKey) error {
+	_, exist := userdata.datastoreGet(userdata.JournalPtr)
+	if !exist {
+		return nil
+	}
+	encOps, err := userdata.dsDec(userVDKey, userdata.JournalPtr)
+	if err == nil {
+		marshalOps, err := symDec(userdata.JournalKey, encOps)
+		var ops []journalOp
+		if err == nil && userlib.Unmarshal(marshalOps, &ops) == nil {
+			err = userdata.applyJournal(ops)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// Not one we failed to fetch
+	if userdata.backendErr != nil {
+		return nil
+	}
+	userdata.datastoreDelete(userdata.JournalPtr)
+	return nil
+}
+
 // *********** DS **************
-// get the store DS key
-func getDSVerify(username string) (userlib.DSVerifyKey, error) {
-	key, ok := userlib.KeystoreGet(string(userlib.Hash([]byte("D" + username))[:16]))
-	if !ok {
-		return key, re(username + " has no DS verify key.")
+// get every DS key the user signs with: the latest first, then the ones
+// from before each rotation and those of their active devices
+func (userdata *User) getDSVerify(username string) ([]userlib.DSVerifyKey, error) {
+	dsKeys, _, err := userdata.getKeyChain(username)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := userdata.getDevices(username, dsKeys)
+	if err != nil {
+		return nil, err
+	}
+	keys := []userlib.DSVerifyKey{dsKeys[len(dsKeys) - 1]}
+	for i := len(dsKeys) - 2; i >= 0; i-- {
+		keys = append(keys, dsKeys[i])
 	}
-	return key, nil
+	for _, device := range devices {
+		keys = append(keys, device.DKey)
+	}
+	return keys, nil
+}
+// the keys of several users, to accept a record signed by any of them
+func joinKeys(sets ...[]userlib.DSVerifyKey) []userlib.DSVerifyKey {
+	var keys []userlib.DSVerifyKey
+	for _, set := range sets {
+		keys = append(keys, set...)
+	}
+	return keys
+}
+// deleted accounts leave a tombstone signed by one of their master keys
+func (userdata *User) accountDeleted(username string) bool {
+	id, err := tombstonePtr(username)
+	if err != nil {
+		return false
+	}
+	dsKeys, _, err := userdata.getKeyChain(username)
+	if err != nil {
+		return false
+	}
+	content, err := userdata.dsDec(dsKeys, id)
+	return err == nil && string(content) == "DELETED" + username
+}
+func tombstonePtr(username string) (userlib.UUID, error) {
+	return userlib.UUIDFromBytes(userlib.Hash([]byte("TOMBSTONE" + username))[:16])
 }
 // DS enc
 func dsEnc(dsKey userlib.DSSignKey, content []byte) ([]byte, error) {
@@ -162,38 +569,67 @@ func dsEnc(dsKey userlib.DSSignKey, content []byte) ([]byte, error) {
 	return append(content, signature...), nil
 
 }
-// DS dec
-func dsDec(dsKey userlib.DSVerifyKey, id userlib.UUID) ([]byte, error) {
-	content, ok := hmacDatastoreGet(id)
+// DS dec, signed by any of the keys
+func (userdata *User) dsDec(dsKeys []userlib.DSVerifyKey, id userlib.UUID) ([]byte, error) {
+	content, ok := userdata.hmacDatastoreGet(id)
 	if !ok {
 		return nil, re("DNE record in data store.")
 	}
+	return dsOpen(dsKeys, content)
+}
+// DS dec of a record already fetched
+func dsOpen(dsKeys []userlib.DSVerifyKey, content []byte) ([]byte, error) {
 	if len(content) < 256 {
 		return nil, re("No signature of DS.")
 	}
 	encData, signature := content[:len(content) - 256], content[len(content) - 256:]
-	err := userlib.DSVerify(dsKey, encData, signature)
+	err := dsVerify(dsKeys, encData, signature)
 	return encData, err
 }
-// facing several ds verification
-func verifyDSIntegrity(keys []userlib.DSVerifyKey, id userlib.UUID) ([]byte, error) {
-	var encData []byte
-	for i := range keys {
-		encData, err := dsDec(keys[i], id)
-		if err == nil {
-			return encData, nil
+// DS verify by any of the keys
+func dsVerify(dsKeys []userlib.DSVerifyKey, content []byte, signature []byte) error {
+	for i := range dsKeys {
+		if userlib.DSVerify(dsKeys[i], content, signature) == nil {
+			return nil
 		}
 	}
-	return encData, re("None pass.")
+	return re("None pass.")
 }
-
-// get the store PKE key
-func getPKEPublic(username string) (userlib.PKEEncKey, error) {
-	key, ok := userlib.KeystoreGet(string(userlib.Hash([]byte("P" + username))[:16]))
+// signed by any key the user ever had, or one of their devices
+func (userdata *User) verifyUserSig(username string, content []byte, signature []byte) error {
+	dsKeys, err := userdata.getDSVerify(username)
+	if err != nil {
+		return err
+	}
+	return verifyChainSig(username, dsKeys, content, signature)
+}
+// verifyUserSig with the user's keys already at hand
+func verifyChainSig(username string, dsKeys []userlib.DSVerifyKey, content []byte, signature []byte) error {
+	if dsVerify(dsKeys, content, signature) != nil {
+		return re("Not signed by " + username + ".")
+	}
+	return nil
+}
+// facing several ds verification, the record fetched once for all keys
+func (userdata *User) verifyDSIntegrity(keys []userlib.DSVerifyKey, id userlib.UUID) ([]byte, error) {
+	content, ok := userdata.hmacDatastoreGet(id)
 	if !ok {
+		return nil, re("None pass.")
+	}
+	return dsOpen(keys, content)
+}
+
+// get the store PKE key, the latest one if the user rotated
+func (userdata *User) getPKEPublic(username string) (userlib.PKEEncKey, error) {
+	var key userlib.PKEEncKey
+	_, pkeKeys, err := userdata.getKeyChain(username)
+	if err != nil {
+		return key, err
+	}
+	if len(pkeKeys) == 0 {
 		return key, re(username + " has no public PKE key.")
 	}
-	return key, nil
+	return pkeKeys[len(pkeKeys) - 1], nil
 }
 
 // Deterministic 16 long string
@@ -207,8 +643,27 @@ func byte16(s string) []byte {
 type User struct {
 	Username string
 	PKey userlib.PKEDecKey
+	OldPKeys []userlib.PKEDecKey // From before each rotation, oldest first
 	DKey userlib.DSSignKey
+	Device string // Empty when logged in by password
+	RecoveryKey []byte // Seals the recovery copy of this struct, nil without codes or trustees
+	RecoveryCodePtrs []userlib.UUID // Unused codes
+	RecoveryCodeKeys map[userlib.UUID][]byte // What each of them wraps the recovery key with
+	RecoveryTrustees []string // Hold the current shares
 	EncFileNameToFileInfoPtr userlib.UUID
+	FileNameKey []byte // Seals the names in the file map
+	EncGroupNameToGroupInfoPtr userlib.UUID
+	GroupMapKey []byte
+	JournalPtr userlib.UUID
+	JournalKey []byte
+	LedgerPtr userlib.UUID
+	LedgerKey []byte
+	ContactsPtr userlib.UUID
+	ContactsKey []byte
+	tx *journal // the running transaction, never stored
+	loginKey []byte // what the session logged in with, never stored
+	backend Backend // nil for userlib's, never stored
+	backendErr error // the first the backend returned since the op started
 }
 
 // FileInfo
@@ -218,28 +673,171 @@ type FileInfo struct {
 	FileKeyPtr userlib.UUID
 	TreeNodePtr userlib.UUID
 	TreeNodeKey []byte
+	HeaderPtr userlib.UUID
+	InvitedBy string // Who shared it with us, empty for the owner
+	EncName []byte // Sym enc by the user's FileNameKey
+	AuditSeen int // Owner only, audit entries read so far
+	AuditSeenHash []byte // Owner only, hash of the last of them
 }
 
 // Tree Node
 type TreeNode struct {
 	UsernameToTreeNodePtr map[string]userlib.UUID
 	UsernameToTreeNodeKey map[string][]byte
+	UsernameToPermission map[string]Permission // What this node's user granted each child
+	UsernameToInvitedAt map[string]int // seq of the invite in the audit log
 	FileKeyPtr         userlib.UUID // Delete the revoked ones file key directly
+	InvitationPtr userlib.UUID // Until accepted
+	InviFileInfoPtr userlib.UUID // Until accepted
+	OfferPtr userlib.UUID // Root only, ownership offer until accepted
+	OfferInfoPtr userlib.UUID // Root only
+}
+
+// Permission is the access level a recipient holds on a file.
+type Permission int
+
+const (
+	PermissionRead Permission = iota + 1 // load only
+	PermissionAppend // load and append
+	PermissionWrite // load, append and overwrite
+)
+
+// File Header, signed by the owner only
+// Content lists must carry a signature from one of these verify keys.
+type FileHeader struct {
+	WriteVerifyKey userlib.DSVerifyKey
+	AppendVerifyKey userlib.DSVerifyKey
+	EncWriteSignKey []byte // sym enc by the write secret
+	EncAppendSignKey []byte // sym enc by the append secret
+	Owners []OwnerCert // every hand over since the file was made
+	Revoked map[string]Revocation // chunks they sign later are rejected
+	RevokesSeen int // audit seq up to which the owner acted on revokes by others
+}
+
+// Revocation is when a user lost access to a file, and to whom. Revokes by
+// other users reach the header once the owner acts on them. Version and Len
+// are the content list as it stood, which only current writers can sign, so
+// chunks of the user past that point are rejected whatever they claim.
+type Revocation struct {
+	Seq int // of the revoke entry in the audit log
+	By string
+	Version int
+	Len int
+}
+
+// OwnerCert hands a file over to the next owner, signed by the one giving it
+type OwnerCert struct {
+	From string
+	To string
+	Index int // position in the header's chain
+	Sig []byte
+}
+
+// Content List
+// Root is the Merkle root over all the chunks, in order. BaseSig is by the
+// write key over the root of Chunks[:BaseLen] and Version, so append-only
+// users cannot touch anything a writer signed. Version counts the stores,
+// each of which puts in a whole new list of chunks. Sig is over Root and AuditHash, the hash
+// of the audit entry logged with the last write, which readers check is
+// still there. AuditHead is the last entry of the log, which every logged
+// event moves along, so the next entry goes right after it. Only the entry
+// it names vouches for it.
+// The list is encrypted under the key of Epoch. A chunk whose Epoch is
+// below the list's was written before a revoke and is still under that
+// epoch's key, which members derive from their seed, until a writer
+// re-encrypts it.
+type ContentList struct {
+	Chunks []ChunkRef
+	BaseLen int
+	BaseSig []byte
+	Sig []byte
+	Epoch int
+	Options FileOptions // appends follow them too
+	Version int
+	Root []byte
+	AuditSeq int
+	AuditHash []byte
+	AuditHead int
+	AuditHeadHash []byte
+}
+
+// Chunk Ref
+type ChunkRef struct {
+	ID userlib.UUID
+	Hash []byte // hash of the encrypted chunk
+	Epoch int // key epoch the chunk is encrypted under
+	Key []byte // convergent chunks only, derived from their content
+	Compressed bool
+	Len int // plain content length, for range reads
+	Author string
+	Seq int // of the write in the audit log
+	ContentHash []byte // of the plain content, as the author signed it
+	AuthorSig []byte // by the author over a chunkClaim
+}
+
+// RevokeMode picks when content moves to the new file key on revoke.
+type RevokeMode int
+
+const (
+	RevokeEager RevokeMode = iota // re-encrypt every chunk at once
+	RevokeLazy // start a new epoch now, re-encrypt old chunks on the next write
+)
+
+// the secrets a key blob unlocks, trimmed to the holder's permission
+// File keys come from a key regression chain: the seed of an epoch hashes
+// down to the seeds of all older epochs, never up to newer ones. Only the
+// owner keeps ChainSeed, the seed of the last epoch, to move the file on.
+type fileKeys struct {
+	Epoch int
+	Seed []byte // seed of Epoch
+	AppendSecret []byte // unlock the append sign key
+	WriteSecret []byte // unlock the write sign key
+	ChainSeed []byte // owner only
+	FileKey []byte // key of Epoch, derived from Seed
+}
+
+// how many epochs one key regression chain has
+const maxEpochs = 1024
+
+// Client logs users in on one Backend, and the users it returns keep to
+// it. InitUser, GetUser and the other package functions log in on
+// userlib's Datastore and Keystore.
+type Client struct {
+	backend Backend
+}
+
+// NewClient makes a Client on backend.
+func NewClient(backend Backend) *Client {
+	return &Client{backend}
 }
 
+var userlibClient = NewClient(UserlibBackend{})
+
 func InitUser(username string, password string) (userdataptr *User, err error) {
+	return userlibClient.InitUser(username, password)
+}
+// InitUser is the package's InitUser, on the client's backend.
+func (c *Client) InitUser(username string, password string) (userdataptr *User, err error) {
+	userdata := User{backend: c.backend}
+	defer userdata.reportBackend(&err)
 	// Generate a ptr first & check if exist
 	userPtr, err := userlib.UUIDFromBytes(userlib.Hash([]byte(username))[:16])
 	if err != nil {
 		return nil, err
 	}
-	_, ok := userlib.DatastoreGet(userPtr)
+	_, ok := userdata.datastoreGet(userPtr)
 	if ok {
 		return nil, re("Username is already taken.")
 	}
+	if userdata.accountDeleted(username) {
+		return nil, re("Username belonged to a deleted account.")
+	}
+	// Nothing is published unless the name is known to be free
+	if userdata.backendErr != nil {
+		return nil, userdata.backendErr
+	}
 
 	// Init username, password
-	var userdata User
 	userdata.Username = username // Assign
 
 	// InitPkey, Dkey, Generate&Store PKE&DS keys
@@ -248,22 +846,22 @@ func InitUser(username string, password string) (userdataptr *User, err error) {
 	if err != nil {
 		return nil, re("Fail generate PKE key.")
 	}
-	err = userlib.KeystoreSet(string(userlib.Hash([]byte("P" + username))[:16]), userPKey)
+	err = userdata.store().KeystoreSet(string(userlib.Hash([]byte("P" + username))[:16]), userPKey)
 	if err != nil {
-		return nil, re("Fail store PKE key.")
+		return nil, err
 	}
 	var userDKey userlib.DSVerifyKey
 	userdata.DKey, userDKey, err = userlib.DSKeyGen() // Assign
 	if err != nil {
 		return nil, re("Fail generate DS key.")
 	}
-	err = userlib.KeystoreSet(string(userlib.Hash([]byte("D" + username))[:16]), userDKey)
+	err = userdata.store().KeystoreSet(string(userlib.Hash([]byte("D" + username))[:16]), userDKey)
 	if err != nil {
-		return nil, re("Fail store DS key.")
+		return nil, err
 	}
 
 	// DEBUG
-	_, err = getDSVerify(username)
+	_, err = userdata.getDSVerify(username)
 	if err != nil {
 		return nil,  re("WTFFFFFF")
 	}
@@ -279,66 +877,124 @@ func InitUser(username string, password string) (userdataptr *User, err error) {
 	if err != nil {
 		return nil, err
 	}
-	userdata.EncFileNameToFileInfoPtr = newID() // Assign
-	hmacDatastoreSet(userdata.EncFileNameToFileInfoPtr, dsEncFileInfoMap)
+	userdata.EncFileNameToFileInfoPtr = userdata.newID() // Assign
+	userdata.hmacDatastoreSet(userdata.EncFileNameToFileInfoPtr, dsEncFileInfoMap)
+	userdata.FileNameKey = userlib.RandomBytes(16) // Assign
+
+	// Init EncGroupNameToGroupInfoPtr
+	userdata.GroupMapKey = userlib.RandomBytes(16) // Assign
+	userdata.EncGroupNameToGroupInfoPtr = userdata.newID() // Assign
+	err = userdata.storeGroupMap(make(map[string]GroupInfo))
+	if err != nil {
+		return nil, err
+	}
+
+	// Init the journal, only written while committing
+	userdata.JournalPtr = userdata.newID() // Assign
+	userdata.JournalKey = userlib.RandomBytes(16) // Assign
+
+	// Init the ledger of records we made
+	userdata.LedgerKey = userlib.RandomBytes(16) // Assign
+	userdata.LedgerPtr = userdata.newID() // Assign
+	err = userdata.storeLedgerRecord(userdata.LedgerPtr, ledgerHead{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Init the contact book
+	userdata.ContactsKey = userlib.RandomBytes(16) // Assign
+	userdata.ContactsPtr = userdata.newID() // Assign
+	err = userdata.storeContacts(make(map[string]Contact))
+	if err != nil {
+		return nil, err
+	}
 
 	// Store user Struct
-	// Marshal
-	marshalUser, err := userlib.Marshal(userdata)
+	err = userdata.storeUser(userPtr, password)
 	if err != nil {
-		userlib.DatastoreDelete(userdata.EncFileNameToFileInfoPtr) // Since already failed
+		userdata.datastoreDelete(userdata.EncFileNameToFileInfoPtr) // Since already failed
 		return nil, re("Cannot marshal user struct when init.")
 	}
-	// Sym Enc
-	encUser := symEnc(byte16(username + "USER" + password), marshalUser)
-	// DS Enc
-	dsEncUser, err:= dsEnc(userdata.DKey, encUser)
-	hmacDatastoreSet(userPtr, dsEncUser)
 
 	return &userdata, nil
 }
 
 func GetUser(username string, password string) (userdataptr *User, err error) {
+	return userlibClient.GetUser(username, password)
+}
+// GetUser is the package's GetUser, on the client's backend.
+func (c *Client) GetUser(username string, password string) (userdataptr *User, err error) {
+	return c.GetUserWithKey(username, LoginKey(username, password))
+}
+
+// LoginKey is the key GetUser derives from the password to open the user
+// record. It logs in like the password, but does not give the password
+// away, so a session can keep it instead.
+func LoginKey(username string, password string) []byte {
+	return byte16(username + "USER" + password)
+}
+
+// GetUserWithKey is GetUser with the key LoginKey derives.
+func GetUserWithKey(username string, loginKey []byte) (userdataptr *User, err error) {
+	return userlibClient.GetUserWithKey(username, loginKey)
+}
+// GetUserWithKey is the package's GetUserWithKey, on the client's backend.
+func (c *Client) GetUserWithKey(username string, loginKey []byte) (userdataptr *User, err error) {
+	userdata := User{backend: c.backend}
+	defer userdata.reportBackend(&err)
 	// Generate a ptr first & check if exist
 	userPtr, err := userlib.UUIDFromBytes(userlib.Hash([]byte(username))[:16])
 	if err != nil {
 		return nil, err
 	}
 
+	if userdata.accountDeleted(username) {
+		return nil, re(username + " deleted their account.")
+	}
+
 	// DS verify
-	userDSVerifyKey, err := getDSVerify(username)
+	userDSVerifyKey, err := userdata.getDSVerify(username)
 	if err != nil {
 		return nil, re(username + " has no DS key.")
 	}
-	encUser, err := dsDec(userDSVerifyKey, userPtr)
+	encUser, err := userdata.dsDec(userDSVerifyKey, userPtr)
 	if err != nil {
 		return nil, re("User been modified by unknown.")
 	}
 
 	// sym dec
-	marshalUser, err := symDec(byte16(username + "USER" + password), encUser)
+	if len(loginKey) != 16 {
+		return nil, re("Invalid login key.")
+	}
+	marshalUser, err := symDec(loginKey, encUser)
 	if err != nil {
 		return nil, err
 	}
 
 	// unmarshal
-	var userdata User
 	err = userlib.Unmarshal(marshalUser, &userdata)
 	if err != nil {
 		return nil, err
 	}
+	userdata.loginKey = loginKey
+
+	// Finish the last commit if it got cut off
+	err = userdata.replayJournal(userDSVerifyKey)
+	if err != nil {
+		return nil, err
+	}
 
 	return &userdata, nil
 }
 
-func getFileMap(id userlib.UUID, username string) (map[string]FileInfo, userlib.DSVerifyKey, error) {
+func (userdata *User) getFileMap(id userlib.UUID, username string) (map[string]FileInfo, []userlib.DSVerifyKey, error) {
 	// Get key
-	verifyDKey, err := getDSVerify(username)
+	verifyDKey, err := userdata.getDSVerify(username)
 	if err != nil {
 		return nil, verifyDKey, err
 	}
 	// ds dec
-	encFile, err := dsDec(verifyDKey, id)
+	encFile, err := userdata.dsDec(verifyDKey, id)
 	if err != nil {
 		return nil, verifyDKey, err
 	}
@@ -361,819 +1017,5229 @@ func getFileInfo(filename string, fileInfoMap map[string]FileInfo) (FileInfo, bo
 	fileInfo, ok := fileInfoMap[hashedFilename]
 	return fileInfo, ok
 }
-func getFileKey(dsKeys []userlib.DSVerifyKey, pkeKey userlib.PKEDecKey, id userlib.UUID) ([]byte, error) {
-	encFileKey, err := verifyDSIntegrity(dsKeys, id)
+func (userdata *User) getFileKey(dsKeys []userlib.DSVerifyKey, id userlib.UUID) (fileKeys, error) {
+	var keys fileKeys
+	encFileKey, err := userdata.verifyDSIntegrity(dsKeys, id)
 	if err != nil {
-		return nil, err
+		return keys, err
 	}
-	fileKey, err := userlib.PKEDec(pkeKey, encFileKey)
+	packedKeys, err := userdata.pkeDec(encFileKey)
 	if err != nil {
-		return nil, err
+		return keys, err
 	}
-	return fileKey, nil
+	return unpackFileKeys(packedKeys)
 }
-func getEncDS(keys []userlib.DSVerifyKey, id userlib.UUID) ([]byte, error) {
-	var encData []byte
-	for i := range keys {
-		encData, err := dsDec(keys[i], id)
-		if err == nil {
-			return encData, nil
-		}
-	}
-	return encData, re("None pass.")
+func (userdata *User) getEncDS(keys []userlib.DSVerifyKey, id userlib.UUID) ([]byte, error) {
+	return userdata.verifyDSIntegrity(keys, id)
 }
-func getEncContentList(fileKey []byte, id userlib.UUID, delete bool) ([][]byte, []userlib.UUID, error) {
-	contentEncList, ok := hmacDatastoreGet(id)
-	if !ok {
-		return nil, nil, re("No record for the content.")
-	}
-	marshalContentList, err := symDec(fileKey, contentEncList)
+// fetch every chunk of the list and check it against its hash
+func (userdata *User) getEncContentList(list ContentList) ([][]byte, error) {
+	var encContentList [][]byte
+	fetched, err := userdata.fetchChunks(list.Chunks)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	var idList []userlib.UUID
-	err = userlib.Unmarshal(marshalContentList, &idList)
-	var encContentList [][]byte
-	for i:= 0; i < len(idList); i++ {
-		encContent, ok := hmacDatastoreGet(idList[i])
+	for i := 0; i < len(list.Chunks); i++ {
+		encContent, ok := fetched[list.Chunks[i].ID]
 		if !ok {
-			return nil, nil, re("Content been modified.")
+			return nil, re("Content been modified.")
 		}
-		encContentList = append(encContentList, encContent)
-		if delete {
-			userlib.DatastoreDelete(idList[i])
+		if !userlib.HMACEqual(userlib.Hash(encContent), list.Chunks[i].Hash) {
+			return nil, re("Content been replaced.")
 		}
+		encContentList = append(encContentList, encContent)
 	}
-	return encContentList, idList, nil
+	return encContentList, nil
 }
-func addFileInfo(filename string, fileInfoMap map[string]FileInfo, fileInfo FileInfo) (map[string]FileInfo, error) {
-	hashedFilename := hex.EncodeToString(userlib.Hash([]byte(filename)))
-	_, ok := fileInfoMap[hashedFilename]
-	if ok {
-		return nil, re("Exist such file.")
+
+// *********** File Keys **************
+// pack the keys a holder of perm is allowed to see
+func (keys fileKeys) pack(perm Permission) []byte {
+	packedKeys := []byte{byte(keys.Epoch >> 24), byte(keys.Epoch >> 16), byte(keys.Epoch >> 8), byte(keys.Epoch)}
+	packedKeys = append(packedKeys, keys.Seed...)
+	if perm >= PermissionAppend {
+		packedKeys = append(packedKeys, keys.AppendSecret...)
 	}
-	fileInfoMap[hashedFilename] = fileInfo
-	return fileInfoMap, nil
+	if perm >= PermissionWrite {
+		packedKeys = append(packedKeys, keys.WriteSecret...)
+	}
+	return packedKeys
 }
-
-func (userdata *User) StoreFile(filename string, content []byte) (err error) {
-	// Get the fileInfoMap First
-	fileInfoMap, userVDKey, err := getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
-	if err != nil {
-		return err
+// the owner also keeps the top of the chain
+func (keys fileKeys) packOwner() []byte {
+	return append(keys.pack(PermissionWrite), keys.ChainSeed...)
+}
+// the permission is told by how many secrets we hold
+func (keys fileKeys) permission() Permission {
+	if keys.WriteSecret != nil {
+		return PermissionWrite
 	}
-
-	// Check if user have the file
-	fileInfo, exist := getFileInfo(filename, fileInfoMap)
-
-	if exist {
-		// This file can be accessed by me and the owner
-		ownerVDKey, err := getDSVerify(fileInfo.Owner)
-		if err != nil {
-			return err
-		}
-		dsKeys := []userlib.DSVerifyKey{ownerVDKey, userVDKey}
-
-		// Get the filekey for later encryption
-		fileKey, err := getFileKey(dsKeys, userdata.PKey, fileInfo.FileKeyPtr)
-		if err != nil {
-			return err
-		}
-
-		// verify old data see if anyone damage it
-		_, err = getEncDS(dsKeys, fileInfo.TreeNodePtr) // treenode
-		if err != nil {
-			return err
-		}
-		_, _, err = getEncContentList(fileKey, fileInfo.ContentUUIDListPtr, true) // prev content
-		if err != nil {
+	if keys.AppendSecret != nil {
+		return PermissionAppend
+	}
+	return PermissionRead
+}
+func unpackFileKeys(packedKeys []byte) (fileKeys, error) {
+	var keys fileKeys
+	if len(packedKeys) != 20 && len(packedKeys) != 36 && len(packedKeys) != 52 && len(packedKeys) != 68 {
+		return keys, re("Invalid file key length.")
+	}
+	keys.Epoch = int(packedKeys[0]) << 24 | int(packedKeys[1]) << 16 | int(packedKeys[2]) << 8 | int(packedKeys[3])
+	if keys.Epoch >= maxEpochs {
+		return keys, re("Invalid file key epoch.")
+	}
+	keys.Seed = packedKeys[4:20]
+	if len(packedKeys) >= 36 {
+		keys.AppendSecret = packedKeys[20:36]
+	}
+	if len(packedKeys) >= 52 {
+		keys.WriteSecret = packedKeys[36:52]
+	}
+	if len(packedKeys) == 68 {
+		keys.ChainSeed = packedKeys[52:68]
+	}
+	keys.FileKey = epochKey(keys.Seed)
+	return keys, nil
+}
+// a new chain, at its first epoch
+func newFileKeys() fileKeys {
+	var keys fileKeys
+	keys.ChainSeed = userlib.RandomBytes(16)
+	keys.Seed = seedAt(keys.ChainSeed, maxEpochs - 1, 0)
+	keys.AppendSecret = userlib.RandomBytes(16)
+	keys.WriteSecret = userlib.RandomBytes(16)
+	keys.FileKey = epochKey(keys.Seed)
+	return keys
+}
+// Owner only: the next epoch of the chain with new sign secrets. Once the
+// chain runs out a new one is started, which cannot derive the old keys.
+func nextEpochKeys(keys fileKeys) (fileKeys, error) {
+	if keys.ChainSeed == nil {
+		return keys, re("Only the owner can start a new epoch.")
+	}
+	if keys.Epoch + 1 >= maxEpochs {
+		return newFileKeys(), nil
+	}
+	newKeys := keys
+	newKeys.Epoch = keys.Epoch + 1
+	newKeys.Seed = seedAt(keys.ChainSeed, maxEpochs - 1, newKeys.Epoch)
+	newKeys.AppendSecret = userlib.RandomBytes(16)
+	newKeys.WriteSecret = userlib.RandomBytes(16)
+	newKeys.FileKey = epochKey(newKeys.Seed)
+	return newKeys, nil
+}
+// hash a seed down the chain to an older epoch
+func seedAt(seed []byte, epoch int, target int) []byte {
+	for ; epoch > target; epoch-- {
+		seed = userlib.Hash(append([]byte("EPOCH"), seed...))[:16]
+	}
+	return seed
+}
+func epochKey(seed []byte) []byte {
+	return userlib.Hash(append([]byte("FILEKEY"), seed...))[:16]
+}
+// the file key of this or an older epoch
+func (keys fileKeys) key(epoch int) ([]byte, error) {
+	if epoch < 0 || epoch > keys.Epoch {
+		return nil, re("No file key for this epoch.")
+	}
+	return epochKey(seedAt(keys.Seed, keys.Epoch, epoch)), nil
+}
+// PKE enc the packed keys to the recipient and sign
+func (userdata *User) sealFileKeys(recipientUsername string, packedKeys []byte, dsKey userlib.DSSignKey) ([]byte, error) {
+	encKeys, err := userdata.pkeEncToUser(recipientUsername, packedKeys)
+	if err != nil {
+		return nil, err
+	}
+	return dsEnc(dsKey, encKeys)
+}
+func minPermission(a Permission, b Permission) Permission {
+	if a < b {
+		return a
+	}
+	return b
+}
+// what the node's user granted the child, nodes from before permissions grant write
+func grantedPermission(treeNode TreeNode, childName string) Permission {
+	perm, ok := treeNode.UsernameToPermission[childName]
+	if !ok {
+		return PermissionWrite
+	}
+	return perm
+}
+
+// *********** File Header **************
+// New sign keys for writers and appenders, each sealed by its secret
+func newFileHeader(keys fileKeys) (FileHeader, userlib.DSSignKey, error) {
+	var header FileHeader
+	writeSignKey, writeVerifyKey, err := userlib.DSKeyGen()
+	if err != nil {
+		return header, writeSignKey, re("Fail generate write DS key.")
+	}
+	appendSignKey, appendVerifyKey, err := userlib.DSKeyGen()
+	if err != nil {
+		return header, writeSignKey, re("Fail generate append DS key.")
+	}
+	marshalWriteSignKey, err := userlib.Marshal(writeSignKey)
+	if err != nil {
+		return header, writeSignKey, err
+	}
+	marshalAppendSignKey, err := userlib.Marshal(appendSignKey)
+	if err != nil {
+		return header, writeSignKey, err
+	}
+	header.WriteVerifyKey = writeVerifyKey
+	header.AppendVerifyKey = appendVerifyKey
+	header.EncWriteSignKey = symEnc(keys.WriteSecret, marshalWriteSignKey)
+	header.EncAppendSignKey = symEnc(keys.AppendSecret, marshalAppendSignKey)
+	return header, writeSignKey, nil
+}
+func (userdata *User) storeFileHeader(id userlib.UUID, header FileHeader, dsKey userlib.DSSignKey) error {
+	marshalHeader, err := userlib.Marshal(header)
+	if err != nil {
+		return err
+	}
+	dsHeader, err := dsEnc(dsKey, marshalHeader)
+	if err != nil {
+		return err
+	}
+	userdata.hmacDatastoreSet(id, dsHeader)
+	return nil
+}
+func (userdata *User) getFileHeader(ownerVDKey []userlib.DSVerifyKey, id userlib.UUID) (FileHeader, error) {
+	var header FileHeader
+	marshalHeader, err := userdata.dsDec(ownerVDKey, id)
+	if err != nil {
+		return header, re("File header been modified.")
+	}
+	err = userlib.Unmarshal(marshalHeader, &header)
+	return header, err
+}
+// what the giving owner signs, bound to the file
+func ownerCertContent(id userlib.UUID, cert OwnerCert) ([]byte, error) {
+	cert.Sig = nil
+	marshalCert, err := userlib.Marshal(cert)
+	if err != nil {
+		return nil, err
+	}
+	return append(marshalCert, id[:]...), nil
+}
+func signOwnerCert(dsKey userlib.DSSignKey, id userlib.UUID, cert *OwnerCert) error {
+	content, err := ownerCertContent(id, *cert)
+	if err != nil {
+		return err
+	}
+	cert.Sig, err = userlib.DSSign(dsKey, content)
+	if err != nil {
+		return re("Fail to sign ownership certificate.")
+	}
+	return nil
+}
+func verifyOwnerCert(fromVDKey []userlib.DSVerifyKey, id userlib.UUID, cert OwnerCert) error {
+	content, err := ownerCertContent(id, cert)
+	if err != nil {
+		return err
+	}
+	err = dsVerify(fromVDKey, content, cert.Sig)
+	if err != nil {
+		return re("Ownership certificate been modified.")
+	}
+	return nil
+}
+// follow the header's chain from the owner we knew of to the current one,
+// then check the header is signed by them
+func (userdata *User) resolveFileOwner(knownOwner string, id userlib.UUID) (string, []userlib.DSVerifyKey, FileHeader, error) {
+	var ownerVDKey []userlib.DSVerifyKey
+	var claimed FileHeader
+	content, ok := userdata.hmacDatastoreGet(id)
+	if !ok || len(content) < 256 {
+		return "", ownerVDKey, claimed, re("File header been modified.")
+	}
+	err := userlib.Unmarshal(content[:len(content) - 256], &claimed)
+	if err != nil {
+		return "", ownerVDKey, claimed, re("File header been modified.")
+	}
+
+	// Start after the known owner last got the file, if it was ever handed to them
+	start := 0
+	for i, cert := range claimed.Owners {
+		if cert.To == knownOwner {
+			start = i + 1
+		}
+	}
+	owner := knownOwner
+	for _, cert := range claimed.Owners[start:] {
+		if cert.From != owner {
+			return "", ownerVDKey, claimed, re("Broken ownership chain.")
+		}
+		fromVDKey, err := userdata.getDSVerify(owner)
+		if err != nil {
+			return "", ownerVDKey, claimed, err
+		}
+		err = verifyOwnerCert(fromVDKey, id, cert)
+		if err != nil {
+			return "", ownerVDKey, claimed, err
+		}
+		owner = cert.To
+	}
+
+	ownerVDKey, err = userdata.getDSVerify(owner)
+	if err != nil {
+		return "", ownerVDKey, claimed, err
+	}
+	header, err := userdata.getFileHeader(ownerVDKey, id)
+	return owner, ownerVDKey, header, err
+}
+// unlock the strongest sign key the file keys allow
+func getSignKey(header FileHeader, keys fileKeys) (userlib.DSSignKey, bool, error) {
+	var signKey userlib.DSSignKey
+	write := keys.permission() == PermissionWrite
+	var marshalSignKey []byte
+	var err error
+	if write {
+		marshalSignKey, err = symDec(keys.WriteSecret, header.EncWriteSignKey)
+	} else if keys.permission() == PermissionAppend {
+		marshalSignKey, err = symDec(keys.AppendSecret, header.EncAppendSignKey)
+	} else {
+		return signKey, false, re("Read only, no sign key.")
+	}
+	if err != nil {
+		return signKey, false, err
+	}
+	err = userlib.Unmarshal(marshalSignKey, &signKey)
+	return signKey, write, err
+}
+
+// *********** Content List **************
+func listBaseContent(baseRoot []byte, version int) []byte {
+	return append(append([]byte{}, baseRoot...), []byte(fmt.Sprintf("VERSION%d", version))...)
+}
+// writers sign the whole list as the new base, appenders only the tail
+func signContentList(list *ContentList, signKey userlib.DSSignKey, write bool) error {
+	root, err := merkleRoot(list.Chunks)
+	if err != nil {
+		return err
+	}
+	if write {
+		list.BaseLen = len(list.Chunks)
+		list.BaseSig, err = userlib.DSSign(signKey, listBaseContent(root, list.Version))
+		if err != nil {
+			return re("Fail to sign content list.")
+		}
+	}
+	list.Root = root
+	list.Sig, err = userlib.DSSign(signKey, append(append([]byte{}, root...), list.AuditHash...))
+	if err != nil {
+		return re("Fail to sign content list.")
+	}
+	return nil
+}
+func verifyContentList(list ContentList, header FileHeader) error {
+	if list.BaseLen < 0 || list.BaseLen > len(list.Chunks) {
+		return re("Invalid content list base.")
+	}
+	baseRoot, err := merkleRoot(list.Chunks[:list.BaseLen])
+	if err != nil {
+		return err
+	}
+	err = userlib.DSVerify(header.WriteVerifyKey, listBaseContent(baseRoot, list.Version), list.BaseSig)
+	if err != nil {
+		return re("Content list base not signed by a writer.")
+	}
+	root, err := merkleRoot(list.Chunks)
+	if err != nil {
+		return err
+	}
+	if !userlib.HMACEqual(root, list.Root) {
+		return re("Content list does not match its root.")
+	}
+	signedContent := append(append([]byte{}, list.Root...), list.AuditHash...)
+	if userlib.DSVerify(header.WriteVerifyKey, signedContent, list.Sig) == nil {
+		return nil
+	}
+	err = userlib.DSVerify(header.AppendVerifyKey, signedContent, list.Sig)
+	if err != nil {
+		return re("Content list not signed by a writer or appender.")
+	}
+	return nil
+}
+func (userdata *User) storeContentList(fileKey []byte, id userlib.UUID, list ContentList) error {
+	marshalList, err := userlib.Marshal(list)
+	if err != nil {
+		return err
+	}
+	userdata.hmacDatastoreSet(id, symEnc(fileKey, marshalList))
+	return nil
+}
+func (userdata *User) getContentList(fileKey []byte, id userlib.UUID, header FileHeader) (ContentList, error) {
+	var list ContentList
+	encList, ok := userdata.hmacDatastoreGet(id)
+	if !ok {
+		return list, re("No record for the content.")
+	}
+	marshalList, err := symDec(fileKey, encList)
+	if err != nil {
+		return list, err
+	}
+	err = userlib.Unmarshal(marshalList, &list)
+	if err != nil {
+		return list, err
+	}
+	return list, verifyContentList(list, header)
+}
+// the chunk records in one round trip, by id
+func (userdata *User) fetchChunks(chunks []ChunkRef) (map[userlib.UUID][]byte, error) {
+	ids := make([]userlib.UUID, len(chunks))
+	for i := range chunks {
+		ids[i] = chunks[i].ID
+	}
+	return userdata.hmacDatastoreGetBatch(ids)
+}
+// a chunk proven to sit in the file, left to decrypt
+type sealedChunk struct {
+	Key []byte
+	EncContent []byte
+	Compressed bool
+}
+
+// take chunk i from the fetched ones, prove it sits at i under the signed
+// root and that its author signed it, and find its key; the key chain of
+// the author must be in ctx
+func openChunk(ctx fileContext, levels [][][]byte, i int, fetched map[userlib.UUID][]byte) (sealedChunk, error) {
+	ref := ctx.List.Chunks[i]
+	encContent, ok := fetched[ref.ID]
+	if !ok {
+		return sealedChunk{}, re("Content been modified.")
+	}
+	ref.Hash = userlib.Hash(encContent)
+	leaf, err := merkleLeaf(ref)
+	if err != nil {
+		return sealedChunk{}, err
+	}
+	err = verifyMerkleProof(ctx.List.Root, len(ctx.List.Chunks), i, leaf, merkleProof(levels, i))
+	if err != nil {
+		return sealedChunk{}, err
+	}
+	err = verifyChunkAuthor(ctx.Header, ctx.Info.HeaderPtr, ctx.List, i, ctx.AuthorKeys[ref.Author])
+	if err != nil {
+		return sealedChunk{}, err
+	}
+
+	fileKey := ref.Key
+	if fileKey == nil {
+		fileKey, err = ctx.Keys.key(ref.Epoch)
+		if err != nil {
+			return sealedChunk{}, err
+		}
+	}
+	return sealedChunk{fileKey, encContent, ref.Compressed}, nil
+}
+// decrypt an opened chunk, nothing else, so workers can run it side by side
+func decryptChunk(chunk sealedChunk) ([]byte, error) {
+	rawContent, err := symDec(chunk.Key, chunk.EncContent)
+	if err != nil {
+		return nil, err
+	}
+	if chunk.Compressed {
+		return unpackCompressed(rawContent)
+	}
+	return rawContent, nil
+}
+// LoadConcurrency caps the goroutines that decrypt the chunks of a file as
+// it is loaded. At 1 the caller's goroutine does it all.
+var LoadConcurrency = 4
+
+// chunks fetched in one round trip while loading
+const loadGroupSize = 16
+
+// read the chunks at indices, in that order. userlib is not safe to call
+// from several goroutines, so this one fetches a group of chunks at a time,
+// checks their proofs and signatures and finds their keys, then hands them
+// to the workers to decrypt while it goes on to the next group. The content
+// is checked against what its author signed once the workers are done.
+func (userdata *User) readChunks(ctx fileContext, levels [][][]byte, indices []int) ([][]byte, error) {
+	// The authors' key chains, all before any chunk is opened
+	for _, i := range indices {
+		author := ctx.List.Chunks[i].Author
+		_, ok := ctx.AuthorKeys[author]
+		if ok {
+			continue
+		}
+		authorKeys, err := userdata.getDSVerify(author)
+		if err != nil {
+			return nil, re("Chunk not signed by its author.")
+		}
+		ctx.AuthorKeys[author] = authorKeys
+	}
+
+	// Each position has its own slots, so nothing is written twice
+	contents := make([][]byte, len(indices))
+	errs := make([]error, len(indices))
+	groups := (len(indices) + loadGroupSize - 1) / loadGroupSize
+	panics := make([]interface{}, groups)
+	// open a group, up to the first chunk that fails
+	openGroup := func(g int) ([]sealedChunk, bool) {
+		var refs []ChunkRef
+		for pos := g * loadGroupSize; pos < len(indices) && pos < (g + 1) * loadGroupSize; pos++ {
+			refs = append(refs, ctx.List.Chunks[indices[pos]])
+		}
+		fetched, err := userdata.fetchChunks(refs)
+		if err != nil {
+			errs[g * loadGroupSize] = err
+			return nil, false
+		}
+		var sealed []sealedChunk
+		for pos := g * loadGroupSize; pos < len(indices) && pos < (g + 1) * loadGroupSize; pos++ {
+			chunk, err := openChunk(ctx, levels, indices[pos], fetched)
+			if err != nil {
+				errs[pos] = err
+				return sealed, false
+			}
+			sealed = append(sealed, chunk)
+		}
+		return sealed, true
+	}
+	decryptGroup := func(g int, sealed []sealedChunk) {
+		defer func() {
+			panics[g] = recover()
+		}()
+		for k, chunk := range sealed {
+			pos := g * loadGroupSize + k
+			contents[pos], errs[pos] = decryptChunk(chunk)
+		}
+	}
+
+	if LoadConcurrency <= 1 || groups <= 1 {
+		for g := 0; g < groups; g++ {
+			sealed, ok := openGroup(g)
+			decryptGroup(g, sealed)
+			if panics[g] != nil {
+				panic(panics[g])
+			}
+			if !ok {
+				break
+			}
+		}
+	} else {
+		type job struct {
+			g int
+			sealed []sealedChunk
+		}
+		jobs := make(chan job)
+		done := make(chan int, groups) // never blocks a worker
+		workers := LoadConcurrency
+		if workers > groups {
+			workers = groups
+		}
+		for w := 0; w < workers; w++ {
+			go func() {
+				for j := range jobs {
+					decryptGroup(j.g, j.sealed)
+					done <- j.g
+				}
+			}()
+		}
+		sent := 0
+		func() {
+			defer close(jobs) // Let the workers go, even if opening panics
+			for g := 0; g < groups; g++ {
+				sealed, ok := openGroup(g)
+				jobs <- job{g, sealed}
+				sent++
+				if !ok {
+					return
+				}
+			}
+		}()
+		for k := 0; k < sent; k++ {
+			<-done
+		}
+		for g := 0; g < sent; g++ {
+			if panics[g] != nil {
+				panic(panics[g])
+			}
+		}
+	}
+
+	// The first failure in file order, as if read one by one
+	for pos, i := range indices {
+		if errs[pos] != nil {
+			return nil, errs[pos]
+		}
+		if !userlib.HMACEqual(userlib.Hash(contents[pos]), ctx.List.Chunks[i].ContentHash) {
+			return nil, re("Content been modified.")
+		}
+	}
+	return contents, nil
+}
+// enc a chunk and store it under a new id
+func (userdata *User) storeChunk(fileKey []byte, keyVersion int, content []byte) ChunkRef {
+	encContent := symEnc(fileKey, content)
+	ref := ChunkRef{ID: userdata.newID(), Hash: userlib.Hash(encContent), Epoch: keyVersion}
+	userdata.hmacDatastoreSet(ref.ID, encContent)
+	return ref
+}
+// re-encrypt the chunks from older epochs under newKeys, in place; all
+// moves every chunk, for when newKeys is a new chain
+func (userdata *User) reencryptStaleChunks(list *ContentList, encContentList [][]byte, keys fileKeys, newKeys fileKeys, all bool) error {
+	for i := 0; i < len(list.Chunks); i++ {
+		if (list.Chunks[i].Epoch == newKeys.Epoch && !all) || list.Chunks[i].Key != nil {
+			continue // Convergent chunks stay under their content key
+		}
+		oldFileKey, err := keys.key(list.Chunks[i].Epoch)
+		if err != nil {
+			return err
+		}
+		curContent, err := symDec(oldFileKey, encContentList[i])
+		if err != nil {
+			return err
+		}
+		encCurContent := symEnc(newKeys.FileKey, curContent)
+		list.Chunks[i].Hash = userlib.Hash(encCurContent)
+		list.Chunks[i].Epoch = newKeys.Epoch
+		userdata.hmacDatastoreSet(list.Chunks[i].ID, encCurContent)
+	}
+	return nil
+}
+
+// *********** Merkle **************
+// A leaf per chunk ref, hashed up in pairs. A node without a sibling moves
+// up a level as is. The root also binds the number of chunks.
+func merkleLeaf(ref ChunkRef) ([]byte, error) {
+	marshalRef, err := userlib.Marshal(ref)
+	if err != nil {
+		return nil, err
+	}
+	return userlib.Hash(append([]byte("MERKLELEAF"), marshalRef...)), nil
+}
+func merkleNode(left []byte, right []byte) []byte {
+	node := append([]byte("MERKLENODE"), left...)
+	return userlib.Hash(append(node, right...))
+}
+// every level of the tree, leaves first, root last
+func merkleLevels(chunks []ChunkRef) ([][][]byte, error) {
+	var level [][]byte
+	for i := range chunks {
+		leaf, err := merkleLeaf(chunks[i])
+		if err != nil {
+			return nil, err
+		}
+		level = append(level, leaf)
+	}
+	if len(level) == 0 {
+		level = append(level, userlib.Hash([]byte("MERKLEEMPTY")))
+	}
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i + 1 < len(level) {
+				next = append(next, merkleNode(level[i], level[i + 1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels, nil
+}
+func merkleTop(count int, top []byte) []byte {
+	root := []byte("MERKLEROOT")
+	root = append(root, byte(count >> 24), byte(count >> 16), byte(count >> 8), byte(count))
+	return userlib.Hash(append(root, top...))
+}
+func merkleRoot(chunks []ChunkRef) ([]byte, error) {
+	levels, err := merkleLevels(chunks)
+	if err != nil {
+		return nil, err
+	}
+	return merkleTop(len(chunks), levels[len(levels) - 1][0]), nil
+}
+// the siblings on the way from leaf index up to the root
+func merkleProof(levels [][][]byte, index int) [][]byte {
+	var proof [][]byte
+	for _, level := range levels[:len(levels) - 1] {
+		if index % 2 == 1 {
+			proof = append(proof, level[index - 1])
+		} else if index + 1 < len(level) {
+			proof = append(proof, level[index + 1])
+		}
+		index /= 2
+	}
+	return proof
+}
+func verifyMerkleProof(root []byte, count int, index int, leaf []byte, proof [][]byte) error {
+	if index < 0 || index >= count {
+		return re("Chunk out of the list.")
+	}
+	node := leaf
+	for width := count; width > 1; width = (width + 1) / 2 {
+		if index % 2 == 1 || index + 1 < width {
+			if len(proof) == 0 {
+				return re("Merkle proof too short.")
+			}
+			if index % 2 == 1 {
+				node = merkleNode(proof[0], node)
+			} else {
+				node = merkleNode(node, proof[0])
+			}
+			proof = proof[1:]
+		}
+		index /= 2
+	}
+	if len(proof) != 0 || !userlib.HMACEqual(merkleTop(count, node), root) {
+		return re("Chunk not in the file at that place.")
+	}
+	return nil
+}
+
+// *********** Tree Node **************
+func (userdata *User) getTreeNode(dsKeys []userlib.DSVerifyKey, id userlib.UUID, key []byte) (TreeNode, error) {
+	var treeNode TreeNode
+	content, ok := userdata.hmacDatastoreGet(id)
+	if !ok {
+		return treeNode, re("None pass.")
+	}
+	return openTreeNode(dsKeys, content, key)
+}
+// check and decrypt a tree node record already fetched
+func openTreeNode(dsKeys []userlib.DSVerifyKey, content []byte, key []byte) (TreeNode, error) {
+	var treeNode TreeNode
+	encTreeNode, err := dsOpen(dsKeys, content)
+	if err != nil {
+		return treeNode, err
+	}
+	marshalTreeNode, err := symDec(key, encTreeNode)
+	if err != nil {
+		return treeNode, err
+	}
+	err = userlib.Unmarshal(marshalTreeNode, &treeNode)
+	if err != nil {
+		return treeNode, err
+	}
+	if treeNode.UsernameToTreeNodePtr == nil || treeNode.UsernameToTreeNodeKey == nil {
+		return treeNode, re("Inheritance messed up (nil).")
+	}
+	if len(treeNode.UsernameToTreeNodePtr) != len(treeNode.UsernameToTreeNodeKey) {
+		return treeNode, re("Inheritance messed up (length not same).")
+	}
+	for childName := range treeNode.UsernameToTreeNodePtr {
+		_, exist := treeNode.UsernameToTreeNodeKey[childName]
+		if !exist {
+			return treeNode, re("Inheritance messed up (non-match keys).")
+		}
+	}
+	return treeNode, nil
+}
+func (userdata *User) storeTreeNode(id userlib.UUID, key []byte, treeNode TreeNode, dsKey userlib.DSSignKey) error {
+	marshalTreeNode, err := userlib.Marshal(treeNode)
+	if err != nil {
+		return err
+	}
+	dsEncTreeNode, err := dsEnc(dsKey, symEnc(key, marshalTreeNode))
+	if err != nil {
+		return err
+	}
+	userdata.hmacDatastoreSet(id, dsEncTreeNode)
+	return nil
+}
+func newTreeNode(fileKeyPtr userlib.UUID) TreeNode {
+	var treeNode TreeNode
+	treeNode.UsernameToTreeNodePtr = make(map[string]userlib.UUID)
+	treeNode.UsernameToTreeNodeKey = make(map[string][]byte)
+	treeNode.UsernameToPermission = make(map[string]Permission)
+	treeNode.UsernameToInvitedAt = make(map[string]int)
+	treeNode.FileKeyPtr = fileKeyPtr
+	return treeNode
+}
+
+// one node met when walking a share tree
+type treeEntry struct {
+	Username string
+	Parent string
+	Ptr userlib.UUID
+	Key []byte
+	Node TreeNode
+	Permission Permission // capped by every ancestor
+	InvitedAt int
+}
+
+// BFS over the tree rooted at the given node, the root comes first. The
+// nodes of a level are fetched in one round trip.
+func (userdata *User) walkTree(ownerVDKey []userlib.DSVerifyKey, username string, parent string, id userlib.UUID, key []byte, perm Permission) ([]treeEntry, error) {
+	level := []treeEntry{{Username: username, Parent: parent, Ptr: id, Key: key, Permission: perm}}
+	var entries []treeEntry
+	for len(level) > 0 {
+		ids := make([]userlib.UUID, len(level))
+		for i := range level {
+			ids[i] = level[i].Ptr
+		}
+		fetched, err := userdata.journalGetBatch(ids)
+		if err != nil {
+			return nil, err
+		}
+		var next []treeEntry
+		for _, cur := range level {
+			// Get ds keys for encrytion
+			curUserVDKey, err := userdata.getDSVerify(cur.Username)
+			if err != nil {
+				return nil, err
+			}
+			parentVDKey, err := userdata.getDSVerify(cur.Parent)
+			if err != nil {
+				return nil, err
+			}
+			dsKeys := joinKeys(ownerVDKey, curUserVDKey, parentVDKey)
+
+			content, ok := fetched[cur.Ptr]
+			if ok {
+				content, ok = hmacOpen(cur.Ptr, content)
+			}
+			if !ok {
+				return nil, re("None pass.")
+			}
+			cur.Node, err = openTreeNode(dsKeys, content, cur.Key)
+			if err != nil {
+				return nil, err
+			}
+			for childName, childNodePtr := range cur.Node.UsernameToTreeNodePtr {
+				next = append(next, treeEntry{
+					Username: childName,
+					Parent: cur.Username,
+					Ptr: childNodePtr,
+					Key: cur.Node.UsernameToTreeNodeKey[childName],
+					Permission: minPermission(cur.Permission, grantedPermission(cur.Node, childName)),
+					InvitedAt: cur.Node.UsernameToInvitedAt[childName],
+				})
+			}
+			entries = append(entries, cur)
+		}
+		level = next
+	}
+	return entries, nil
+}
+// give everyone in the tree the file keys their permission allows
+func (userdata *User) redistributeFileKeys(entries []treeEntry, keys fileKeys, owner string, dsKey userlib.DSSignKey) error {
+	for _, entry := range entries {
+		packedKeys := keys.pack(entry.Permission)
+		if entry.Username == owner && entry.Parent == owner {
+			packedKeys = keys.packOwner()
+		}
+		dsEncFileKey, err := userdata.sealFileKeys(entry.Username, packedKeys, dsKey)
+		if err != nil {
+			return err
+		}
+		userdata.hmacDatastoreSet(entry.Node.FileKeyPtr, dsEncFileKey)
+	}
+	return nil
+}
+
+// everything a file operation needs once the common checks pass
+type fileContext struct {
+	Info FileInfo
+	Owner string // after any hand overs
+	OwnerKeys []userlib.DSVerifyKey
+	DSKeys []userlib.DSVerifyKey // the owner's and ours
+	Keys fileKeys
+	Header FileHeader
+	List ContentList
+	EncTreeNode []byte
+	AuthorKeys map[string][]userlib.DSVerifyKey // keys of chunk authors met so far
+}
+
+// get the keys, tree node, header and content list of one of the user's files
+func (userdata *User) openFile(fileInfo FileInfo, userVDKey []userlib.DSVerifyKey) (fileContext, error) {
+	var ctx fileContext
+	ctx.Info = fileInfo
+	ctx.AuthorKeys = make(map[string][]userlib.DSVerifyKey)
+	tx := userdata.running()
+	if tx != nil {
+		tx.scope = fileInfo.ContentUUIDListPtr
+	}
+
+	// This file can be accessed by me and the owner
+	owner, ownerVDKey, header, err := userdata.resolveFileOwner(fileInfo.Owner, fileInfo.HeaderPtr)
+	if err != nil && userdata.accountDeleted(fileInfo.Owner) {
+		return ctx, re(fileInfo.Owner + " deleted their account, the file is gone.")
+	}
+	if err != nil {
+		return ctx, err
+	}
+	if userdata.accountDeleted(owner) {
+		return ctx, re(owner + " deleted their account, the file is gone.")
+	}
+	ctx.Owner = owner
+	ctx.Header = header
+	ctx.OwnerKeys = ownerVDKey
+	ctx.DSKeys = joinKeys(ownerVDKey, userVDKey)
+
+	// Get the file keys for later encryption
+	ctx.Keys, err = userdata.getFileKey(ctx.DSKeys, fileInfo.FileKeyPtr)
+	if err != nil {
+		return ctx, err
+	}
+
+	// verify old data see if anyone damage it
+	ctx.EncTreeNode, err = userdata.getEncDS(ctx.DSKeys, fileInfo.TreeNodePtr) // treenode
+	if err != nil {
+		return ctx, err
+	}
+	ctx.List, err = userdata.getContentList(ctx.Keys.FileKey, fileInfo.ContentUUIDListPtr, ctx.Header)
+	if err != nil {
+		return ctx, err
+	}
+
+	// The audit log holds at least what the list was written with
+	signed, ok, err := userdata.readAuditRecord(ctx.Keys, fileInfo.HeaderPtr, ctx.List.AuditSeq)
+	if err != nil {
+		return ctx, err
+	}
+	if !ok || !userlib.HMACEqual(userlib.Hash(signed.Entry), ctx.List.AuditHash) {
+		return ctx, re("Audit log been truncated.")
+	}
+
+	// The owner acts on revokes by others first, then reads the file again
+	if owner == userdata.Username {
+		rekeyed, err := userdata.applyRevokes(fileInfo, ctx)
+		if err != nil {
+			return ctx, err
+		}
+		if rekeyed {
+			return userdata.openFile(fileInfo, userVDKey)
+		}
+	}
+	return ctx, nil
+}
+func addFileInfo(filename string, fileInfoMap map[string]FileInfo, fileInfo FileInfo) (map[string]FileInfo, error) {
+	hashedFilename := hex.EncodeToString(userlib.Hash([]byte(filename)))
+	_, ok := fileInfoMap[hashedFilename]
+	if ok {
+		return nil, re("Exist such file.")
+	}
+	fileInfoMap[hashedFilename] = fileInfo
+	return fileInfoMap, nil
+}
+
+func (userdata *User) StoreFile(filename string, content []byte) (err error) {
+	return userdata.StoreFileWithOptions(filename, content, FileOptions{})
+}
+
+// StoreFileWithOptions is StoreFile with the options for this content. They
+// stay with the file for later appends, until the next store.
+func (userdata *User) StoreFileWithOptions(filename string, content []byte, options FileOptions) (err error) {
+	defer userdata.transaction()(&err)
+	// Get the fileInfoMap First
+	fileInfoMap, userVDKey, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return err
+	}
+
+	// Check if user have the file
+	fileInfo, exist := getFileInfo(filename, fileInfoMap)
+
+	if exist {
+		// Get the file keys, header and list, verifying along the way
+		ctx, err := userdata.openFile(fileInfo, userVDKey)
+		if err != nil {
+			return err
+		}
+		if ctx.Keys.permission() < PermissionWrite {
+			return re("No write permission on the file.")
+		}
+		signKey, _, err := getSignKey(ctx.Header, ctx.Keys)
+		if err != nil {
+			return err
+		}
+		_, err = userdata.getEncContentList(ctx.List) // prev content
+		if err != nil {
+			return err
+		}
+		err = userdata.releaseChunks(fileInfo.HeaderPtr, ctx.List.Chunks)
+		if err != nil {
+			return err
+		}
+
+		// Encrypt current content, nothing is left under an old key
+		var newList ContentList
+		newList.Epoch = ctx.Keys.Epoch
+		newList.Options = options
+		newList.Version = ctx.List.Version + 1
+		// The log goes on from where the old list left it
+		newList.AuditSeq, newList.AuditHash = ctx.List.AuditSeq, ctx.List.AuditHash
+		newList.AuditHead, newList.AuditHeadHash = ctx.List.AuditHead, ctx.List.AuditHeadHash
+		newList.AuditSeq, newList.AuditHash, err = userdata.logAudit(fileInfo.HeaderPtr, ctx.Keys, &newList, "store", "")
+		if err != nil {
+			return err
+		}
+		newList.Chunks, err = userdata.storeChunks(ctx.Keys, fileInfo.HeaderPtr, newList.AuditSeq, content, options)
+		if err != nil {
+			return err
+		}
+
+		// Update the content list
+		err = signContentList(&newList, signKey, true)
+		if err != nil {
+			return err
+		}
+		err = userdata.storeContentList(ctx.Keys.FileKey, fileInfo.ContentUUIDListPtr, newList)
+		if err != nil {
+			return err
+		}
+	} else {
+		// Create a new file info
+		var newFileInfo FileInfo
+
+		// New file keys and store by self pke ds key enc
+		keys := newFileKeys()
+		dsEncFileKey, err := userdata.sealFileKeys(userdata.Username, keys.packOwner(), userdata.DKey)
+		if err != nil {
+			return err
+		}
+		newFileInfo.FileKeyPtr = userdata.newID() // Assign
+		userdata.hmacDatastoreSet(newFileInfo.FileKeyPtr, dsEncFileKey)
+
+		// Header with the sign keys of this file
+		header, writeSignKey, err := newFileHeader(keys)
+		if err != nil {
+			return err
+		}
+		newFileInfo.HeaderPtr = userdata.newID() // Assign
+		err = userdata.storeFileHeader(newFileInfo.HeaderPtr, header, userdata.DKey)
+		if err != nil {
+			return err
+		}
+
+		// Sym Enc content by file key, content list enc and store
+		var list ContentList
+		list.Options = options
+		list.AuditSeq, list.AuditHash, err = userdata.logAudit(newFileInfo.HeaderPtr, keys, &list, "store", "")
+		if err != nil {
+			return err
+		}
+		list.Chunks, err = userdata.storeChunks(keys, newFileInfo.HeaderPtr, list.AuditSeq, content, options)
+		if err != nil {
+			return err
+		}
+		err = signContentList(&list, writeSignKey, true)
+		if err != nil {
+			return err
+		}
+		newFileInfo.ContentUUIDListPtr = userdata.newID() // Assign
+		err = userdata.storeContentList(keys.FileKey, newFileInfo.ContentUUIDListPtr, list)
+		if err != nil {
+			return err
+		}
+
+		// Owner is user
+		newFileInfo.Owner = userdata.Username // Assign
+
+		// TreeNode
+		newFileInfo.TreeNodeKey = userlib.RandomBytes(16) // Assign
+		newFileInfo.TreeNodePtr = userdata.newID() // Assign
+		err = userdata.storeTreeNode(newFileInfo.TreeNodePtr, newFileInfo.TreeNodeKey, newTreeNode(newFileInfo.FileKeyPtr), userdata.DKey)
+		if err != nil {
+			return err
+		}
+
+		// Add new file info to the map
+		newFileInfo.EncName = symEnc(userdata.FileNameKey, []byte(filename)) // Assign
+		newFileInfoMap, err := addFileInfo(filename, fileInfoMap, newFileInfo)
+		if err != nil {
+			return err
+		}
+		marshalNewFileInfoMap, err := userlib.Marshal(newFileInfoMap)
+		if err != nil {
+			return err
+		}
+		encNewFileInfoMap := symEnc(userlib.Hash([]byte(userdata.Username))[:16], marshalNewFileInfoMap)
+		dsEncNewFileInfoMap, err := dsEnc(userdata.DKey, encNewFileInfoMap)
+		if err != nil {
+			return err
+		}
+		userdata.hmacDatastoreSet(userdata.EncFileNameToFileInfoPtr, dsEncNewFileInfoMap)
+	}
+	return nil
+}
+
+func (userdata *User) AppendToFile(filename string, content []byte) (err error) {
+	defer userdata.transaction()(&err)
+	// Get the fileInfoMap First
+	fileInfoMap, userVDKey, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return err
+	}
+
+	// Check if user have the file
+	fileInfo, exist := getFileInfo(filename, fileInfoMap)
+	if !exist {
+		return re("DNE file so cannot append.")
+	}
+
+	// Get the file keys, header and list, verifying along the way
+	ctx, err := userdata.openFile(fileInfo, userVDKey)
+	if err != nil {
+		return err
+	}
+	if ctx.Keys.permission() < PermissionAppend {
+		return re("No append permission on the file.")
+	}
+	signKey, write, err := getSignKey(ctx.Header, ctx.Keys)
+	if err != nil {
+		return err
+	}
+	encContentList, err := userdata.getEncContentList(ctx.List) // prev content
+	if err != nil {
+		return err
+	}
+
+	// Writers move anything left behind by a lazy revoke to the current key
+	if write {
+		err = userdata.reencryptStaleChunks(&ctx.List, encContentList, ctx.Keys, ctx.Keys, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Encrypt the content and append it to the end of the list
+	ctx.List.AuditSeq, ctx.List.AuditHash, err = userdata.logAudit(fileInfo.HeaderPtr, ctx.Keys, &ctx.List, "append", "")
+	if err != nil {
+		return err
+	}
+	chunks, err := userdata.storeChunks(ctx.Keys, fileInfo.HeaderPtr, ctx.List.AuditSeq, content, ctx.List.Options)
+	if err != nil {
+		return err
+	}
+	ctx.List.Chunks = append(ctx.List.Chunks, chunks...)
+
+	// Store new list, appenders leave the writers' base as is
+	err = signContentList(&ctx.List, signKey, write)
+	if err != nil {
+		return err
+	}
+	return userdata.storeContentList(ctx.Keys.FileKey, fileInfo.ContentUUIDListPtr, ctx.List)
+}
+
+func (userdata *User) LoadFile(filename string) (content []byte, err error) {
+	defer userdata.reportBackend(&err)
+	// Get the fileInfoMap First
+	fileInfoMap, userVDKey, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if user have the file
+	fileInfo, exist := getFileInfo(filename, fileInfoMap)
+	if !exist {
+		return nil, re("DNE file.")
+	}
+
+	// Get the file keys, header and list, verifying along the way
+	ctx, err := userdata.openFile(fileInfo, userVDKey)
+	if err != nil {
+		return nil, err
+	}
+	levels, err := merkleLevels(ctx.List.Chunks)
+	if err != nil {
+		return nil, err
+	}
+
+	indices := make([]int, len(ctx.List.Chunks))
+	for i := range indices {
+		indices[i] = i
+	}
+	rawContents, err := userdata.readChunks(ctx, levels, indices)
+	if err != nil {
+		return nil, err
+	}
+	fContent := []byte{}
+	for _, rawContent := range rawContents {
+		fContent = append(fContent, rawContent...)
+	}
+	return fContent, nil
+}
+
+// LoadFileRange loads length bytes of the file from offset, fetching only
+// the chunks that hold them.
+func (userdata *User) LoadFileRange(filename string, offset int, length int) (content []byte, err error) {
+	defer userdata.reportBackend(&err)
+	if offset < 0 || length < 0 {
+		return nil, re("Invalid range.")
+	}
+	// Get the fileInfoMap First
+	fileInfoMap, userVDKey, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if user have the file
+	fileInfo, exist := getFileInfo(filename, fileInfoMap)
+	if !exist {
+		return nil, re("DNE file.")
+	}
+
+	// Get the file keys, header and list, verifying along the way
+	ctx, err := userdata.openFile(fileInfo, userVDKey)
+	if err != nil {
+		return nil, err
+	}
+	levels, err := merkleLevels(ctx.List.Chunks)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the chunks overlapping the range
+	var indices []int
+	var starts []int
+	start := 0
+	for i := 0; i < len(ctx.List.Chunks) && start < offset + length; i++ {
+		end := start + ctx.List.Chunks[i].Len
+		if end > offset {
+			indices = append(indices, i)
+			starts = append(starts, start)
+		}
+		start = end
+	}
+	rawContents, err := userdata.readChunks(ctx, levels, indices)
+	if err != nil {
+		return nil, err
+	}
+	fContent := []byte{}
+	for pos, rawContent := range rawContents {
+		if len(rawContent) != ctx.List.Chunks[indices[pos]].Len {
+			return nil, re("Content been modified.")
+		}
+		start, end := starts[pos], starts[pos] + len(rawContent)
+		from, to := 0, len(rawContent)
+		if offset > start {
+			from = offset - start
+		}
+		if offset + length < end {
+			to = offset + length - start
+		}
+		fContent = append(fContent, rawContent[from:to]...)
+	}
+	if len(fContent) != length {
+		return nil, re("Range past the end of the file.")
+	}
+	return fContent, nil
+}
+
+// ListFiles returns the names of the user's files, in no order.
+func (userdata *User) ListFiles() (filenames []string, err error) {
+	defer userdata.reportBackend(&err)
+	fileInfoMap, _, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return nil, err
+	}
+	for hashedFilename, fileInfo := range fileInfoMap {
+		filename, err := symDec(userdata.FileNameKey, fileInfo.EncName)
+		if err != nil || hex.EncodeToString(userlib.Hash(filename)) != hashedFilename {
+			return nil, re("File map been modified.")
+		}
+		filenames = append(filenames, string(filename))
+	}
+	return filenames, nil
+}
+
+// CreateInvitation shares the file with the same permission the sender holds.
+func (userdata *User) CreateInvitation(filename string, recipientUsername string) (
+	invitationPtr userlib.UUID, err error) {
+	return userdata.CreateInvitationWithPermission(filename, recipientUsername, 0)
+}
+
+// CreateInvitationWithPermission shares the file with at most the sender's
+// own permission. A zero perm means the sender's permission.
+func (userdata *User) CreateInvitationWithPermission(filename string, recipientUsername string, perm Permission) (
+	invitationPtr userlib.UUID, err error) {
+	defer userdata.transaction()(&err)
+	err = userdata.checkContact(recipientUsername)
+	if err != nil {
+		return invitationPtr, err
+	}
+	// Get the fileInfoMap First
+	fileInfoMap, userVDKey, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return invitationPtr, re("1")
+	}
+
+	// Check if user have the file
+	fileInfo, exist := getFileInfo(filename, fileInfoMap)
+	if !exist {
+		return invitationPtr, re("DNE file.2")
+	}
+
+	// Get the file keys and verify old data see if anyone damage it
+	ctx, err := userdata.openFile(fileInfo, userVDKey)
+	if err != nil {
+		return invitationPtr, err
+	}
+	// Only now, so the ledger files it under this file
+	invitationPtr = userdata.newID()
+	_, err = userdata.getEncContentList(ctx.List) // prev content
+	if err != nil {
+		return invitationPtr, re("6")
+	}
+
+	// Whoever the owner revoked only gets back in through the owner; the
+	// owner lets the others back once it sees the invite
+	revocation, revoked := ctx.Header.Revoked[recipientUsername]
+	if revoked && ctx.Owner != userdata.Username && revocation.By == ctx.Owner {
+		return invitationPtr, re(recipientUsername + " was revoked by the owner, only the owner can share with them again.")
+	}
+	if revoked && ctx.Owner == userdata.Username {
+		delete(ctx.Header.Revoked, recipientUsername)
+		err = userdata.storeFileHeader(fileInfo.HeaderPtr, ctx.Header, userdata.DKey)
+		if err != nil {
+			return invitationPtr, err
+		}
+	}
+
+	// Cannot grant more than we hold
+	if perm == 0 {
+		perm = ctx.Keys.permission()
+	}
+	if perm < PermissionRead || perm > ctx.Keys.permission() {
+		return invitationPtr, re("Cannot grant this permission.")
+	}
+
+	// Check if the recipient already accessible
+	marshalTreeNode, err := symDec(fileInfo.TreeNodeKey, ctx.EncTreeNode)
+	if err != nil {
+		return invitationPtr, re("7")
+	}
+	var treeNodeHost TreeNode
+	err = userlib.Unmarshal(marshalTreeNode, &treeNodeHost)
+	if len(treeNodeHost.UsernameToTreeNodePtr) != len(treeNodeHost.UsernameToTreeNodeKey) {
+		return invitationPtr, re("The inheritance relation is messed up.8")
+	}
+	_, exist = treeNodeHost.UsernameToTreeNodePtr[recipientUsername]
+	if exist {
+		return invitationPtr, re(recipientUsername + "Already accessible.9")
+	}
+	_, exist = treeNodeHost.UsernameToTreeNodeKey[recipientUsername]
+	if exist {
+		return invitationPtr, re("The inheritance relation is messed up since some keymap ptrmap have difference keys.10")
+	}
+
+	// New a fileInfo struct for the recipient
+	var newFileInfo FileInfo
+	newFileInfo.ContentUUIDListPtr = fileInfo.ContentUUIDListPtr // Assign
+	newFileInfo.HeaderPtr = fileInfo.HeaderPtr // Assign
+	newFileInfo.Owner = ctx.Owner // Assign
+	newFileInfo.FileKeyPtr = userdata.newID() // Assign
+	newFileInfo.TreeNodePtr = userdata.newID() // Assign
+	newFileInfo.TreeNodeKey = userlib.RandomBytes(16) // Assign
+
+	// Complete the file info abstract struct (including thing it points to)
+	// filekey
+	_, err = userdata.getPKEPublic(recipientUsername)
+	if err != nil {
+		return invitationPtr, re("11No public PKE key for " + recipientUsername)
+	}
+	dsEncNewFileKey, err := userdata.sealFileKeys(recipientUsername, ctx.Keys.pack(perm), userdata.DKey)
+	if err != nil {
+		return invitationPtr, re("12New file key Encryption failed.")
+	}
+	userdata.hmacDatastoreSet(newFileInfo.FileKeyPtr, dsEncNewFileKey)
+	// treenode, pointing at the invitation until accepted
+	uuidForNewFileInfo := userdata.newID()
+	newNode := newTreeNode(newFileInfo.FileKeyPtr)
+	newNode.InvitationPtr = invitationPtr
+	newNode.InviFileInfoPtr = uuidForNewFileInfo
+	err = userdata.storeTreeNode(newFileInfo.TreeNodePtr, newFileInfo.TreeNodeKey, newNode, userdata.DKey)
+	if err != nil {
+		return invitationPtr, re("15")
+	}
+
+	// Logged first, so the tree node can tell which entry invited them
+	invitedAt, err := userdata.logAuditEvent(fileInfo, ctx.Keys, ctx.Header, "invite", recipientUsername)
+	if err != nil {
+		return invitationPtr, err
+	}
+	treeNodeHost.UsernameToTreeNodeKey[recipientUsername] = newFileInfo.TreeNodeKey
+	treeNodeHost.UsernameToTreeNodePtr[recipientUsername] = newFileInfo.TreeNodePtr
+	if treeNodeHost.UsernameToPermission == nil {
+		treeNodeHost.UsernameToPermission = make(map[string]Permission)
+	}
+	treeNodeHost.UsernameToPermission[recipientUsername] = perm
+	if treeNodeHost.UsernameToInvitedAt == nil {
+		treeNodeHost.UsernameToInvitedAt = make(map[string]int)
+	}
+	treeNodeHost.UsernameToInvitedAt[recipientUsername] = invitedAt
+	err = userdata.storeTreeNode(fileInfo.TreeNodePtr, fileInfo.TreeNodeKey, treeNodeHost, userdata.DKey)
+	if err != nil {
+		return invitationPtr, re("17")
+	}
+
+	// Store new File info struct
+	keyForNewFileInfo := userlib.RandomBytes(16)
+	marshalNewFileInfo, err := userlib.Marshal(newFileInfo)
+	if err != nil {
+		return invitationPtr, re("18")
+	}
+	encNewFileInfo := symEnc(keyForNewFileInfo, marshalNewFileInfo)
+	dsEncNewFileInfo, err := dsEnc(userdata.DKey, encNewFileInfo)
+	userdata.hmacDatastoreSet(uuidForNewFileInfo, dsEncNewFileInfo)
+
+	// Generate the invitation ptr record
+	byteUUIdForNewFileInfo := make([]byte, 16)
+	for i := 0; i < 16; i++ {
+		byteUUIdForNewFileInfo[i] = uuidForNewFileInfo[i]
+	}
+	inviContent := append(byteUUIdForNewFileInfo, keyForNewFileInfo...)
+	pkeEncInviContent, err := userdata.pkeEncToUser(recipientUsername, inviContent)
+	if err != nil {
+		return invitationPtr, re("19")
+	}
+	dsPKEEncInviContent, err := dsEnc(userdata.DKey, pkeEncInviContent)
+	if err != nil {
+		return invitationPtr, re("20")
+	}
+
+	// Store the invitation info
+	userdata.hmacDatastoreSet(invitationPtr, dsPKEEncInviContent)
+	return invitationPtr, nil
+}
+
+func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr userlib.UUID, filename string) (err error) {
+	defer userdata.transaction()(&err)
+	// Sender VDKey
+	if userdata.accountDeleted(senderUsername) {
+		return re(senderUsername + " deleted their account.")
+	}
+	senderVDKey, err := userdata.getDSVerify(senderUsername)
+	if err != nil {
+		return re("1")
+	}
+
+	// If exist such invitation, if so ds dec
+	pkeEncInviConent, err := userdata.dsDec(senderVDKey, invitationPtr)
+	if err != nil {
+		return re("2The invitation DNE.")
+	}
+	err = userdata.checkContact(senderUsername)
+	if err != nil {
+		return err
+	}
+
+	// Delete the invitation ptr since we got its content
+	userdata.datastoreDelete(invitationPtr)
+
+	// PKE dec invitation
+	inviContent, err := userdata.pkeDec(pkeEncInviConent)
+	if err != nil {
+		return err
+	}
+	if len(inviContent) != 32 {
+		return re("3")
+	}
+
+	// Bytes uuid & symkey for fileinfo
+	var inviFileInfoPtr userlib.UUID
+	for i := 0; i < 16; i++ {
+		inviFileInfoPtr[i] = inviContent[i]
+	}
+	inviFileInfoKey := inviContent[16:32]
+
+	// Get the inviFileInfo
+	encInviFileInfo, err := userdata.dsDec(senderVDKey, inviFileInfoPtr)
+	if err != nil {
+		return re("4")
+	}
+	marshalInvifileInfo, err  := symDec(inviFileInfoKey, encInviFileInfo)
+	if err != nil {
+		return re("5")
+	}
+	var inviFileInfo FileInfo
+	err = userlib.Unmarshal(marshalInvifileInfo, &inviFileInfo)
+	if err != nil {
+		return re("6")
+	}
+
+	// Delete invitation File info record
+	userdata.datastoreDelete(inviFileInfoPtr)
+
+	// For later DS verify usage, the header tells the current owner
+	_, ownerVDKey, header, err := userdata.resolveFileOwner(inviFileInfo.Owner, inviFileInfo.HeaderPtr)
+	if err != nil {
+		return re("7")
+	}
+	dsKeys := joinKeys(ownerVDKey, senderVDKey)
+
+	// Check FileKey and DS resign
+	keys, err := userdata.getFileKey(dsKeys, inviFileInfo.FileKeyPtr)
+	if err != nil {
+		return re("8")
+	}
+	pkeEncFileKey, err := userdata.verifyDSIntegrity(dsKeys, inviFileInfo.FileKeyPtr)
+	if err != nil {
+		return re("9")
+	}
+	dsEncFileKey, err := dsEnc(userdata.DKey, pkeEncFileKey)
+	if err != nil {
+		return re("10")
+	}
+	userdata.hmacDatastoreSet(inviFileInfo.FileKeyPtr, dsEncFileKey)
+
+	// Check tree node and Ds resign
+	encInviTreeNode, err := userdata.getEncDS(dsKeys, inviFileInfo.TreeNodePtr)
+	if err != nil {
+		return re("11")
+	}
+	marInviTreeNode, err := symDec(inviFileInfo.TreeNodeKey, encInviTreeNode)
+	if err != nil {
+		return re("12")
+	}
+	var inviTreeNode TreeNode
+	err = userlib.Unmarshal(marInviTreeNode, &inviTreeNode)
+	if err != nil {
+		return re("13")
+	}
+	if inviTreeNode.UsernameToTreeNodePtr == nil || inviTreeNode.UsernameToTreeNodeKey == nil {
+		return re("14")
+	}
+	inviTreeNode.FileKeyPtr = inviFileInfo.FileKeyPtr
+	inviTreeNode.InvitationPtr = userlib.UUID{}
+	inviTreeNode.InviFileInfoPtr = userlib.UUID{}
+	marInviTreeNode, err = userlib.Marshal(inviTreeNode)
+	if err != nil {
+		return re("14")
+	}
+	encInviTreeNode = symEnc(inviFileInfo.TreeNodeKey, marInviTreeNode)
+	dsEncInviTreeNode, err := dsEnc(userdata.DKey, encInviTreeNode)
+	if err != nil {
+		return re("15")
+	}
+	userdata.hmacDatastoreSet(inviFileInfo.TreeNodePtr, dsEncInviTreeNode)
+
+	// Add the new fileInfo back to user fileMap
+	// Get the fileInfoMap First
+	fileInfoMap, _, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return re("16")
+	}
+
+	// Check if user have the file
+	_, exist := getFileInfo(filename, fileInfoMap)
+	if exist {
+		return re("17The user has the file, cannot accept the invitation again.")
+	}
+
+	// add this new file info to the user data
+	inviFileInfo.InvitedBy = senderUsername
+	inviFileInfo.EncName = symEnc(userdata.FileNameKey, []byte(filename))
+	newFileInfoMap, err := addFileInfo(filename, fileInfoMap, inviFileInfo)
+	if err != nil {
+		return re("18")
+	}
+	marshalNewFileInfoMap, err := userlib.Marshal(newFileInfoMap)
+	if err != nil {
+		return re("19")
+	}
+	encNewFileInfoMap := symEnc(userlib.Hash([]byte(userdata.Username))[:16], marshalNewFileInfoMap)
+	dsEncNewFileInfoMap, err := dsEnc(userdata.DKey, encNewFileInfoMap)
+	if err != nil {
+		return re("20")
+	}
+	userdata.hmacDatastoreSet(userdata.EncFileNameToFileInfoPtr, dsEncNewFileInfoMap)
+
+	_, err = userdata.logAuditEvent(inviFileInfo, keys, header, "accept", senderUsername)
+	return err
+}
+
+// RevokeAccess takes the file away from recipientUsername and everyone they
+// shared it with. The owner can revoke anyone they shared with directly and
+// the file moves to a new key epoch. Other users can only revoke their own
+// direct recipients; that removes the recipients' key blobs and tree nodes
+// and logs the revoke, and the owner starts the new epoch the next time it
+// opens the file, since only the owner can. The owner's revoke re-encrypts
+// every chunk under the new epoch at once.
+func (userdata *User) RevokeAccess(filename string, recipientUsername string) error {
+	return userdata.RevokeAccessWithMode(filename, recipientUsername, RevokeEager)
+}
+
+// RevokeAccessWithMode is RevokeAccess with a choice of when the content is
+// moved to the new epoch. RevokeEager, the default, re-encrypts it all at
+// once. RevokeLazy only starts the epoch and hands out its seed; chunks stay
+// under their old epoch until the next write by a writer, so until then the
+// revoked user can still read what they could before.
+func (userdata *User) RevokeAccessWithMode(filename string, recipientUsername string, mode RevokeMode) (err error) {
+	defer userdata.transaction()(&err)
+	//// Check self if is the owner of the file
+	// Get the fileInfoMap First
+	fileInfoMap, userVDKey, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return re("0")
+	}
+
+	// Check if user have the file
+	fileInfo, exist := getFileInfo(filename, fileInfoMap)
+	if !exist {
+		return re("1You don't have the file.")
+	}
+
+	// Not the owner, only drop our own subtree
+	owner, err := userdata.ownsFile(fileInfo)
+	if err != nil {
+		return err
+	}
+	if !owner {
+		ctx, err := userdata.openFile(fileInfo, userVDKey)
+		if err != nil {
+			return err
+		}
+		revoked, err := userdata.removeShareSubtree(fileInfo, ctx.OwnerKeys, ctx.DSKeys, recipientUsername)
+		if err != nil {
+			return err
+		}
+		// The owner starts the new epoch once it sees these
+		_, err = userdata.logRevokes(fileInfo, ctx.Keys, ctx.Header, revoked)
+		return err
+	}
+	ownerVDKey := userVDKey
+	dsKeys := ownerVDKey
+
+	//// Expand my Tree Node & delete the recipient's subtree
+	revoked, err := userdata.removeShareSubtree(fileInfo, ownerVDKey, dsKeys, recipientUsername)
+	if err != nil {
+		return err
+	}
+
+	//// New file keys for everyone else
+	keys, err := userdata.getFileKey(dsKeys, fileInfo.FileKeyPtr)
+	if err != nil {
+		return re("7.5")
+	}
+	header, err := userdata.getFileHeader(ownerVDKey, fileInfo.HeaderPtr)
+	if err != nil {
+		return err
+	}
+	revocations, err := userdata.logRevokes(fileInfo, keys, header, revoked)
+	if err != nil {
+		return err
+	}
+	newKeys, err := nextEpochKeys(keys)
+	if err != nil {
+		return re("7.6")
+	}
+	return userdata.rekeyFile(fileInfo, ownerVDKey, keys, newKeys, mode == RevokeLazy, revocations)
+}
+
+// log a revoke for each user taken out of the tree
+func (userdata *User) logRevokes(fileInfo FileInfo, keys fileKeys, header FileHeader, revoked []string) (map[string]Revocation, error) {
+	list, err := userdata.getContentList(keys.FileKey, fileInfo.ContentUUIDListPtr, header)
+	if err != nil {
+		return nil, err
+	}
+	revocations := make(map[string]Revocation)
+	for _, username := range revoked {
+		seq, _, err := userdata.logAudit(fileInfo.HeaderPtr, keys, &list, "revoke", username)
+		if err != nil {
+			return nil, err
+		}
+		revocations[username] = Revocation{seq, userdata.Username, list.Version, len(list.Chunks)}
+	}
+	return revocations, userdata.storeContentList(keys.FileKey, fileInfo.ContentUUIDListPtr, list)
+}
+
+// Owner only: act on the revokes others logged since the owner last looked.
+// Users still out of the tree are marked revoked and the file moves to a
+// new epoch, so their keys stop working; users let back in by another
+// invite are unmarked. Reports whether the file was rekeyed.
+func (userdata *User) applyRevokes(fileInfo FileInfo, ctx fileContext) (rekeyed bool, err error) {
+	defer userdata.transaction()(&err)
+	pending := make(map[string]Revocation)
+	seen := ctx.Header.RevokesSeen
+	for {
+		signed, ok, err := userdata.readAuditRecord(ctx.Keys, fileInfo.HeaderPtr, seen + 1)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			break
+		}
+		seen++
+		var entry AuditEntry
+		err = userlib.Unmarshal(signed.Entry, &entry)
+		if err != nil || entry.Actor == userdata.Username {
+			continue
+		}
+		if userdata.verifyUserSig(entry.Actor, signed.Entry, signed.Sig) != nil {
+			continue
+		}
+		if entry.Action == "revoke" {
+			pending[entry.Target] = Revocation{entry.Seq, entry.Actor, entry.ListVersion, entry.ListLen}
+		} else if entry.Action == "invite" {
+			delete(pending, entry.Target)
+			revocation, ok := ctx.Header.Revoked[entry.Target]
+			if ok && revocation.By != userdata.Username {
+				delete(ctx.Header.Revoked, entry.Target)
+			}
+		}
+	}
+	if seen == ctx.Header.RevokesSeen {
+		return false, nil
+	}
+	ctx.Header.RevokesSeen = seen
+	err = userdata.storeFileHeader(fileInfo.HeaderPtr, ctx.Header, userdata.DKey)
+	if err != nil || len(pending) == 0 {
+		return false, err
+	}
+	newKeys, err := nextEpochKeys(ctx.Keys)
+	if err != nil {
+		return false, err
+	}
+	return true, userdata.rekeyFile(fileInfo, ctx.OwnerKeys, ctx.Keys, newKeys, true, pending)
+}
+
+// ChangePermission sets what a user anywhere in the share tree may do with
+// the file. Only the owner can change it; the sign keys are rotated so a
+// downgraded user's old keys stop working, and the user's own subtree is
+// capped at the new permission.
+func (userdata *User) ChangePermission(filename string, recipientUsername string, perm Permission) (err error) {
+	defer userdata.transaction()(&err)
+	if perm < PermissionRead || perm > PermissionWrite {
+		return re("Invalid permission.")
+	}
+
+	// Get the fileInfoMap First
+	fileInfoMap, ownerVDKey, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return err
+	}
+	fileInfo, exist := getFileInfo(filename, fileInfoMap)
+	if !exist {
+		return re("You don't have the file.")
+	}
+	owner, err := userdata.ownsFile(fileInfo)
+	if err != nil {
+		return err
+	}
+	if !owner {
+		return re("Only file owner can change permissions.")
+	}
+
+	// Find who granted the recipient their access
+	entries, err := userdata.walkTree(ownerVDKey, userdata.Username, userdata.Username, fileInfo.TreeNodePtr, fileInfo.TreeNodeKey, PermissionWrite)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, entry := range entries {
+		_, ok := entry.Node.UsernameToTreeNodePtr[recipientUsername]
+		if !ok {
+			continue
+		}
+		if entry.Node.UsernameToPermission == nil {
+			entry.Node.UsernameToPermission = make(map[string]Permission)
+		}
+		entry.Node.UsernameToPermission[recipientUsername] = perm
+		err = userdata.storeTreeNode(entry.Ptr, entry.Key, entry.Node, userdata.DKey)
+		if err != nil {
+			return err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return re(recipientUsername + " has no access to the file.")
+	}
+
+	// Same file key, new sign keys
+	keys, err := userdata.getFileKey(ownerVDKey, fileInfo.FileKeyPtr)
+	if err != nil {
+		return err
+	}
+	newKeys := keys
+	newKeys.AppendSecret = userlib.RandomBytes(16)
+	newKeys.WriteSecret = userlib.RandomBytes(16)
+	return userdata.rekeyFile(fileInfo, ownerVDKey, keys, newKeys, false, nil)
+}
+
+// Owner only: move the whole file over to newKeys, then hand the keys out
+// again to everyone left in the tree. A lazy rekey keeps the chunks under
+// their old file keys and leaves them to the next writer. The header keeps
+// when each revoked user lost access, unless they are back in the tree.
+func (userdata *User) rekeyFile(fileInfo FileInfo, ownerVDKey []userlib.DSVerifyKey, keys fileKeys, newKeys fileKeys, lazy bool, revoked map[string]Revocation) error {
+	// Get header & content list
+	header, err := userdata.getFileHeader(ownerVDKey, fileInfo.HeaderPtr)
+	if err != nil {
+		return err
+	}
+	list, err := userdata.getContentList(keys.FileKey, fileInfo.ContentUUIDListPtr, header)
+	if err != nil {
+		return err
+	}
+	fileContentList, err := userdata.getEncContentList(list)
+	if err != nil {
+		return err
+	}
+
+	if newKeys.Epoch > keys.Epoch {
+		// A new epoch, the chunks keep the one they were written in
+		list.Epoch = newKeys.Epoch
+		if !lazy {
+			err = userdata.reencryptStaleChunks(&list, fileContentList, newKeys, newKeys, false)
+			if err != nil {
+				return err
+			}
+		}
+	} else if !userlib.HMACEqual(keys.FileKey, newKeys.FileKey) {
+		// Out of epochs, the new chain cannot derive the old keys
+		list.Epoch = newKeys.Epoch
+		err = userdata.reencryptStaleChunks(&list, fileContentList, keys, newKeys, true)
+		if err != nil {
+			return err
+		}
+		err = userdata.reencryptAuditLog(fileInfo.HeaderPtr, keys, newKeys)
+		if err != nil {
+			return err
+		}
+	}
+
+	// New sign keys, the owner signs everything as a writer
+	newHeader, writeSignKey, err := newFileHeader(newKeys)
+	if err != nil {
+		return err
+	}
+	newHeader.Owners = header.Owners
+	newHeader.RevokesSeen = header.RevokesSeen
+	newHeader.Revoked = header.Revoked
+	if newHeader.Revoked == nil {
+		newHeader.Revoked = make(map[string]Revocation)
+	}
+	entries, err := userdata.walkTree(ownerVDKey, userdata.Username, userdata.Username, fileInfo.TreeNodePtr, fileInfo.TreeNodeKey, PermissionWrite)
+	if err != nil {
+		return err
+	}
+	inTree := make(map[string]bool)
+	for _, entry := range entries {
+		inTree[entry.Username] = true
+	}
+	for username, revocation := range revoked {
+		if !inTree[username] {
+			newHeader.Revoked[username] = revocation
+		}
+	}
+	err = signContentList(&list, writeSignKey, true)
+	if err != nil {
+		return err
+	}
+	err = userdata.storeContentList(newKeys.FileKey, fileInfo.ContentUUIDListPtr, list)
+	if err != nil {
+		return err
+	}
+	err = userdata.storeFileHeader(fileInfo.HeaderPtr, newHeader, userdata.DKey)
+	if err != nil {
+		return err
+	}
+
+	//// Hand the new keys to everyone in the tree
+	return userdata.redistributeFileKeys(entries, newKeys, userdata.Username, userdata.DKey)
+}
+
+// take a direct recipient of the user and everyone below them out of the
+// user's tree node
+func (userdata *User) removeShareSubtree(fileInfo FileInfo, ownerVDKey []userlib.DSVerifyKey, dsKeys []userlib.DSVerifyKey, recipientUsername string) ([]string, error) {
+	//// Expand the Tree Node & verify if the recipient in my tree node
+	treeNode, err := userdata.getTreeNode(dsKeys, fileInfo.TreeNodePtr, fileInfo.TreeNodeKey)
+	if err != nil {
+		return nil, err
+	}
+	recipientTreeNodeKey, ok1 := treeNode.UsernameToTreeNodeKey[recipientUsername]
+	recipientTreeNodePtr, ok2 := treeNode.UsernameToTreeNodePtr[recipientUsername]
+	if !ok1 || !ok2 {
+		return nil, re("7 " + recipientUsername + " is not shared by " + userdata.Username + ".")
+	}
+
+	//// BFS over this recipient and delete all their relevant information
+	revokedEntries, err := userdata.walkTree(ownerVDKey, recipientUsername, userdata.Username, recipientTreeNodePtr, recipientTreeNodeKey, PermissionRead)
+	if err != nil {
+		return nil, re("1B")
+	}
+	var revoked []string
+	for _, entry := range revokedEntries {
+		userdata.datastoreDelete(entry.Ptr)
+		userdata.datastoreDelete(entry.Node.FileKeyPtr)
+		revoked = append(revoked, entry.Username)
+	}
+
+	// Delete this guy from my tree node
+	delete(treeNode.UsernameToTreeNodeKey, recipientUsername)
+	delete(treeNode.UsernameToTreeNodePtr, recipientUsername)
+	delete(treeNode.UsernameToPermission, recipientUsername)
+	delete(treeNode.UsernameToInvitedAt, recipientUsername)
+	err = userdata.storeTreeNode(fileInfo.TreeNodePtr, fileInfo.TreeNodeKey, treeNode, userdata.DKey)
+	if err != nil {
+		return nil, re("4")
+	}
+	return revoked, nil
+}
+
+// ShareTreeNode is one user in the delegation tree of a file.
+type ShareTreeNode struct {
+	Username string
+	InvitedBy string // empty for the owner
+	InvitedAt int // seq of the invite in the file's audit log
+	Permission Permission
+	Children []*ShareTreeNode
+}
+
+// GetShareTree returns who has access to the file, who invited them and
+// at which audit entry, and what they may do. The owner gets the whole
+// tree; other users only hold the keys for their own subtree, so theirs is
+// rooted at themselves.
+func (userdata *User) GetShareTree(filename string) (tree *ShareTreeNode, err error) {
+	defer userdata.reportBackend(&err)
+	// Get the fileInfoMap First
+	fileInfoMap, userVDKey, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, exist := getFileInfo(filename, fileInfoMap)
+	if !exist {
+		return nil, re("DNE file.")
+	}
+	ctx, err := userdata.openFile(fileInfo, userVDKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// BFS over my tree node
+	parent := fileInfo.InvitedBy
+	if parent == "" {
+		parent = userdata.Username
+	}
+	entries, err := userdata.walkTree(ctx.OwnerKeys, userdata.Username, parent, fileInfo.TreeNodePtr, fileInfo.TreeNodeKey, ctx.Keys.permission())
+	if err != nil {
+		return nil, err
+	}
+
+	// Hook every node up under the node that points to it
+	parentOf := make(map[userlib.UUID]*ShareTreeNode)
+	var root *ShareTreeNode
+	for _, entry := range entries {
+		node := &ShareTreeNode{
+			Username: entry.Username,
+			InvitedAt: entry.InvitedAt,
+			Permission: entry.Permission,
+		}
+		if root == nil {
+			root = node
+			node.InvitedBy = fileInfo.InvitedBy
+		} else {
+			parentNode := parentOf[entry.Ptr]
+			node.InvitedBy = parentNode.Username
+			// keep the children sorted by name
+			i := len(parentNode.Children)
+			parentNode.Children = append(parentNode.Children, node)
+			for ; i > 0 && parentNode.Children[i-1].Username > node.Username; i-- {
+				parentNode.Children[i] = parentNode.Children[i-1]
+			}
+			parentNode.Children[i] = node
+		}
+		for _, childNodePtr := range entry.Node.UsernameToTreeNodePtr {
+			parentOf[childNodePtr] = node
+		}
+	}
+	return root, nil
+}
+
+// *********** Group **************
+// GroupInfo is what the user's group map keeps for each group.
+type GroupInfo struct {
+	GroupPtr userlib.UUID
+	GroupKey []byte
+}
+
+// Group is a named set of users files can be shared with in one go.
+type Group struct {
+	Name string
+	Members []string
+	Files map[string]GroupFile // by hashed filename
+}
+
+// GroupFile is a file shared with a group and who got it through the group.
+type GroupFile struct {
+	Filename string
+	Members []string
+}
+
+func (userdata *User) getGroupMap() (map[string]GroupInfo, error) {
+	verifyDKey, err := userdata.getDSVerify(userdata.Username)
+	if err != nil {
+		return nil, err
+	}
+	encGroupMap, err := userdata.dsDec(verifyDKey, userdata.EncGroupNameToGroupInfoPtr)
+	if err != nil {
+		return nil, re("Group map been modified.")
+	}
+	marshalGroupMap, err := symDec(userdata.GroupMapKey, encGroupMap)
+	if err != nil {
+		return nil, err
+	}
+	var groupMap map[string]GroupInfo
+	err = userlib.Unmarshal(marshalGroupMap, &groupMap)
+	if err != nil {
+		return nil, err
+	}
+	return groupMap, nil
+}
+func (userdata *User) storeGroupMap(groupMap map[string]GroupInfo) error {
+	marshalGroupMap, err := userlib.Marshal(groupMap)
+	if err != nil {
+		return err
+	}
+	dsEncGroupMap, err := dsEnc(userdata.DKey, symEnc(userdata.GroupMapKey, marshalGroupMap))
+	if err != nil {
+		return err
+	}
+	userdata.hmacDatastoreSet(userdata.EncGroupNameToGroupInfoPtr, dsEncGroupMap)
+	return nil
+}
+// get one of the user's groups by name
+func (userdata *User) getGroup(groupName string) (GroupInfo, Group, error) {
+	var group Group
+	groupMap, err := userdata.getGroupMap()
+	if err != nil {
+		return GroupInfo{}, group, err
+	}
+	groupInfo, ok := groupMap[hex.EncodeToString(userlib.Hash([]byte(groupName)))]
+	if !ok {
+		return groupInfo, group, re("DNE group.")
+	}
+	verifyDKey, err := userdata.getDSVerify(userdata.Username)
+	if err != nil {
+		return groupInfo, group, err
+	}
+	encGroup, err := userdata.dsDec(verifyDKey, groupInfo.GroupPtr)
+	if err != nil {
+		return groupInfo, group, re("Group been modified.")
+	}
+	marshalGroup, err := symDec(groupInfo.GroupKey, encGroup)
+	if err != nil {
+		return groupInfo, group, err
+	}
+	err = userlib.Unmarshal(marshalGroup, &group)
+	if err != nil {
+		return groupInfo, group, err
+	}
+	if group.Files == nil {
+		group.Files = make(map[string]GroupFile)
+	}
+	return groupInfo, group, nil
+}
+func (userdata *User) storeGroup(groupInfo GroupInfo, group Group) error {
+	marshalGroup, err := userlib.Marshal(group)
+	if err != nil {
+		return err
+	}
+	dsEncGroup, err := dsEnc(userdata.DKey, symEnc(groupInfo.GroupKey, marshalGroup))
+	if err != nil {
+		return err
+	}
+	userdata.hmacDatastoreSet(groupInfo.GroupPtr, dsEncGroup)
+	return nil
+}
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+func removeName(names []string, name string) []string {
+	var kept []string
+	for _, n := range names {
+		if n != name {
+			kept = append(kept, n)
+		}
+	}
+	return kept
+}
+
+// CreateGroup makes a new empty group with its own group key.
+func (userdata *User) CreateGroup(groupName string) (err error) {
+	defer userdata.transaction()(&err)
+	groupMap, err := userdata.getGroupMap()
+	if err != nil {
+		return err
+	}
+	hashedGroupName := hex.EncodeToString(userlib.Hash([]byte(groupName)))
+	_, exist := groupMap[hashedGroupName]
+	if exist {
+		return re("Exist such group.")
+	}
+
+	var groupInfo GroupInfo
+	groupInfo.GroupPtr = userdata.newID()
+	groupInfo.GroupKey = userlib.RandomBytes(16)
+	var group Group
+	group.Name = groupName
+	group.Files = make(map[string]GroupFile)
+	err = userdata.storeGroup(groupInfo, group)
+	if err != nil {
+		return err
+	}
+
+	groupMap[hashedGroupName] = groupInfo
+	return userdata.storeGroupMap(groupMap)
+}
+
+// GetGroupMembers lists the members of one of the user's groups.
+func (userdata *User) GetGroupMembers(groupName string) (members []string, err error) {
+	defer userdata.reportBackend(&err)
+	_, group, err := userdata.getGroup(groupName)
+	if err != nil {
+		return nil, err
+	}
+	return group.Members, nil
+}
+
+// AddMember puts a user in the group and invites them to every file already
+// shared with it. The invitations come back by filename for the caller to
+// hand over; files the user can already reach through us, and files we no
+// longer have, are skipped. Any other failed invitation fails the whole add.
+func (userdata *User) AddMember(groupName string, username string) (invitations map[string]userlib.UUID, err error) {
+	defer userdata.transaction()(&err)
+	groupInfo, group, err := userdata.getGroup(groupName)
+	if err != nil {
+		return nil, err
+	}
+	if containsName(group.Members, username) {
+		return nil, re(username + " is already in the group.")
+	}
+	_, err = userdata.getPKEPublic(username)
+	if err != nil {
+		return nil, err
+	}
+	group.Members = append(group.Members, username)
+
+	invitations = make(map[string]userlib.UUID)
+	for hashedFilename, groupFile := range group.Files {
+		have, shared, err := userdata.shareState(groupFile.Filename, username)
+		if err != nil {
+			return nil, err
+		}
+		if !have || shared {
+			continue
+		}
+		invitationPtr, err := userdata.CreateInvitation(groupFile.Filename, username)
+		if err != nil {
+			return nil, re(groupFile.Filename + ": " + err.Error())
+		}
+		invitations[groupFile.Filename] = invitationPtr
+		groupFile.Members = append(groupFile.Members, username)
+		group.Files[hashedFilename] = groupFile
+	}
+	return invitations, userdata.storeGroup(groupInfo, group)
+}
+
+// RemoveMember takes a user out of the group and revokes them from every
+// file they got through the group. Files they were already revoked from
+// are skipped.
+func (userdata *User) RemoveMember(groupName string, username string) (err error) {
+	defer userdata.transaction()(&err)
+	groupInfo, group, err := userdata.getGroup(groupName)
+	if err != nil {
+		return err
+	}
+	if !containsName(group.Members, username) {
+		return re(username + " is not in the group.")
+	}
+	group.Members = removeName(group.Members, username)
+
+	for hashedFilename, groupFile := range group.Files {
+		if !containsName(groupFile.Members, username) {
+			continue
+		}
+		// Revoked by hand since, or the file is gone
+		have, shared, err := userdata.shareState(groupFile.Filename, username)
+		if err != nil {
+			return err
+		}
+		if have && shared {
+			err = userdata.RevokeAccess(groupFile.Filename, username)
+			if err != nil {
+				return err
+			}
+		}
+		groupFile.Members = removeName(groupFile.Members, username)
+		group.Files[hashedFilename] = groupFile
+	}
+	return userdata.storeGroup(groupInfo, group)
+}
+// whether we still have the file, and whether we shared it with username
+// ourselves
+func (userdata *User) shareState(filename string, username string) (bool, bool, error) {
+	fileInfoMap, userVDKey, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return false, false, err
+	}
+	fileInfo, exist := getFileInfo(filename, fileInfoMap)
+	if !exist {
+		return false, false, nil
+	}
+	ctx, err := userdata.openFile(fileInfo, userVDKey)
+	if err != nil {
+		return false, false, nil // Lost it, and they with us
+	}
+	treeNode, err := userdata.getTreeNode(ctx.DSKeys, fileInfo.TreeNodePtr, fileInfo.TreeNodeKey)
+	if err != nil {
+		return true, false, err
+	}
+	_, ok := treeNode.UsernameToTreeNodePtr[username]
+	return true, ok, nil
+}
+
+// ShareWithGroup invites every member of the group to the file and keeps
+// the file with the group, so later members get it too. The invitations
+// come back by member for the caller to hand over. Members we already
+// shared the file with ourselves are skipped; if any other invitation
+// fails, nothing is shared and the error names the member.
+func (userdata *User) ShareWithGroup(filename string, groupName string) (invitations map[string]userlib.UUID, err error) {
+	defer userdata.transaction()(&err)
+	groupInfo, group, err := userdata.getGroup(groupName)
+	if err != nil {
+		return nil, err
+	}
+	fileInfoMap, userVDKey, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, exist := getFileInfo(filename, fileInfoMap)
+	if !exist {
+		return nil, re("DNE file.")
+	}
+	// Make sure we still have access
+	_, err = userdata.openFile(fileInfo, userVDKey)
+	if err != nil {
+		return nil, err
+	}
+
+	hashedFilename := hex.EncodeToString(userlib.Hash([]byte(filename)))
+	groupFile, ok := group.Files[hashedFilename]
+	if !ok {
+		groupFile.Filename = filename
+	}
+	invitations = make(map[string]userlib.UUID)
+	for _, member := range group.Members {
+		if containsName(groupFile.Members, member) {
+			continue
+		}
+		_, shared, err := userdata.shareState(filename, member)
+		if err != nil {
+			return nil, err
+		}
+		if shared {
+			continue
+		}
+		invitationPtr, err := userdata.CreateInvitation(filename, member)
+		if err != nil {
+			return nil, re(member + ": " + err.Error())
+		}
+		invitations[member] = invitationPtr
+		groupFile.Members = append(groupFile.Members, member)
+	}
+	group.Files[hashedFilename] = groupFile
+	return invitations, userdata.storeGroup(groupInfo, group)
+}
+
+// *********** Garbage **************
+// The ledger of records we made only grows by entries, so a commit costs
+// the same however many records came before. The head at LedgerPtr holds
+// the newest ids until there are ledgerTailSize of them, then they move to
+// an entry of their own. CollectGarbage folds it all back into one entry.
+type ledgerHead struct {
+	Entries int
+	Tail map[userlib.UUID]userlib.UUID
+}
+
+// most ids the head holds
+const ledgerTailSize = 16
+
+// entry i sits where only the ledger key finds it
+func (userdata *User) ledgerEntryPtr(i int) (userlib.UUID, error) {
+	return userlib.UUIDFromBytes(userlib.Hash([]byte(fmt.Sprintf("LEDGER%d:%x", i, userdata.LedgerKey)))[:16])
+}
+// the head and the entries, for marking them reached
+func (userdata *User) ledgerPtrs() ([]userlib.UUID, error) {
+	head, _, err := userdata.getLedgerHead()
+	if err != nil {
+		return nil, err
+	}
+	ptrs := []userlib.UUID{userdata.LedgerPtr}
+	for i := 0; i < head.Entries; i++ {
+		entryPtr, err := userdata.ledgerEntryPtr(i)
+		if err != nil {
+			return nil, err
+		}
+		ptrs = append(ptrs, entryPtr)
+	}
+	return ptrs, nil
+}
+// sym enc under the ledger key, then sign
+func (userdata *User) storeLedgerRecord(id userlib.UUID, value interface{}) error {
+	marshalValue, err := userlib.Marshal(value)
+	if err != nil {
+		return err
+	}
+	dsEncValue, err := dsEnc(userdata.DKey, symEnc(userdata.LedgerKey, marshalValue))
+	if err != nil {
+		return err
+	}
+	userdata.hmacDatastoreSet(id, dsEncValue)
+	return nil
+}
+func (userdata *User) openLedgerRecord(verifyDKey []userlib.DSVerifyKey, content []byte, value interface{}) error {
+	encValue, err := dsOpen(verifyDKey, content)
+	if err != nil {
+		return re("Ledger been modified.")
+	}
+	marshalValue, err := symDec(userdata.LedgerKey, encValue)
+	if err != nil {
+		return err
+	}
+	return userlib.Unmarshal(marshalValue, value)
+}
+// the head, and the keys it verified by for reading the entries
+func (userdata *User) getLedgerHead() (ledgerHead, []userlib.DSVerifyKey, error) {
+	var head ledgerHead
+	verifyDKey, err := userdata.getDSVerify(userdata.Username)
+	if err != nil {
+		return head, nil, err
+	}
+	content, ok := userdata.hmacDatastoreGet(userdata.LedgerPtr)
+	if !ok {
+		return head, nil, re("Ledger been modified.")
+	}
+	err = userdata.openLedgerRecord(verifyDKey, content, &head)
+	return head, verifyDKey, err
+}
+// every entry folded into one map, id to the file it is for
+func (userdata *User) getLedger() (map[userlib.UUID]userlib.UUID, ledgerHead, error) {
+	head, verifyDKey, err := userdata.getLedgerHead()
+	if err != nil {
+		return nil, head, err
+	}
+	var ptrs []userlib.UUID
+	for i := 0; i < head.Entries; i++ {
+		entryPtr, err := userdata.ledgerEntryPtr(i)
+		if err != nil {
+			return nil, head, err
+		}
+		ptrs = append(ptrs, entryPtr)
+	}
+	records, err := userdata.hmacDatastoreGetBatch(ptrs)
+	if err != nil {
+		return nil, head, err
+	}
+	ledger := make(map[userlib.UUID]userlib.UUID)
+	for _, entryPtr := range ptrs {
+		content, ok := records[entryPtr]
+		if !ok {
+			return nil, head, re("Ledger been modified.")
+		}
+		var entry map[userlib.UUID]userlib.UUID
+		err = userdata.openLedgerRecord(verifyDKey, content, &entry)
+		if err != nil {
+			return nil, head, err
+		}
+		for id, scope := range entry {
+			ledger[id] = scope
+		}
+	}
+	for id, scope := range head.Tail {
+		ledger[id] = scope
+	}
+	return ledger, head, nil
+}
+// replace the entries with one holding the whole ledger
+func (userdata *User) storeLedger(ledger map[userlib.UUID]userlib.UUID, head ledgerHead) error {
+	for i := 0; i < head.Entries; i++ {
+		entryPtr, err := userdata.ledgerEntryPtr(i)
+		if err != nil {
+			return err
+		}
+		userdata.datastoreDelete(entryPtr)
+	}
+	head.Entries = 0
+	head.Tail = nil
+	if len(ledger) > 0 {
+		entryPtr, err := userdata.ledgerEntryPtr(0)
+		if err != nil {
+			return err
+		}
+		err = userdata.storeLedgerRecord(entryPtr, ledger)
+		if err != nil {
+			return err
+		}
+		head.Entries = 1
+	}
+	return userdata.storeLedgerRecord(userdata.LedgerPtr, head)
+}
+// add the ids made in a transaction to the head, moving them to a new
+// entry once there are enough
+func (userdata *User) recordAllocations(allocated map[userlib.UUID]userlib.UUID) error {
+	if len(allocated) == 0 {
+		return nil
+	}
+	head, _, err := userdata.getLedgerHead()
+	if err != nil {
+		return err
+	}
+	if head.Tail == nil {
+		head.Tail = make(map[userlib.UUID]userlib.UUID)
+	}
+	for id, scope := range allocated {
+		head.Tail[id] = scope
+	}
+	if len(head.Tail) >= ledgerTailSize {
+		entryPtr, err := userdata.ledgerEntryPtr(head.Entries)
+		if err != nil {
+			return err
+		}
+		err = userdata.storeLedgerRecord(entryPtr, head.Tail)
+		if err != nil {
+			return err
+		}
+		head.Entries++
+		head.Tail = nil
+	}
+	return userdata.storeLedgerRecord(userdata.LedgerPtr, head)
+}
+// mark everything the file still points to. False if we cannot see all of it
+func (userdata *User) markFile(fileInfo FileInfo, userVDKey []userlib.DSVerifyKey, reached map[userlib.UUID]bool) bool {
+	reached[fileInfo.ContentUUIDListPtr] = true
+	reached[fileInfo.HeaderPtr] = true
+	reached[fileInfo.FileKeyPtr] = true
+	reached[fileInfo.TreeNodePtr] = true
+
+	ctx, err := userdata.openFile(fileInfo, userVDKey)
+	if err != nil {
+		return false
+	}
+	for _, chunk := range ctx.List.Chunks {
+		reached[chunk.ID] = true
+	}
+	parent := fileInfo.InvitedBy
+	if parent == "" {
+		parent = userdata.Username
+	}
+	entries, err := userdata.walkTree(ctx.OwnerKeys, userdata.Username, parent, fileInfo.TreeNodePtr, fileInfo.TreeNodeKey, ctx.Keys.permission())
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		reached[entry.Ptr] = true
+		reached[entry.Node.FileKeyPtr] = true
+		reached[entry.Node.InvitationPtr] = true
+		reached[entry.Node.InviFileInfoPtr] = true
+		reached[entry.Node.OfferPtr] = true
+		reached[entry.Node.OfferInfoPtr] = true
+	}
+	return true
+}
+
+// CollectGarbage finds the records this user made that nothing reachable
+// from their files and groups points to any more, and deletes them unless
+// dryRun. Records made for a file the user can no longer open are kept,
+// since others may still use them.
+func (userdata *User) CollectGarbage(dryRun bool) (orphans []userlib.UUID, err error) {
+	defer userdata.transaction()(&err)
+	ledger, head, err := userdata.getLedger()
+	if err != nil {
+		return nil, err
+	}
+
+	// Mark from the file map
+	fileInfoMap, userVDKey, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return nil, err
+	}
+	reached := make(map[userlib.UUID]bool)
+	seen := make(map[userlib.UUID]bool) // files we saw all of
+	for _, fileInfo := range fileInfoMap {
+		if userdata.markFile(fileInfo, userVDKey, reached) {
+			seen[fileInfo.ContentUUIDListPtr] = true
+		}
+	}
+
+	// Mark from the group map
+	groupMap, err := userdata.getGroupMap()
+	if err != nil {
+		return nil, err
+	}
+	for _, groupInfo := range groupMap {
+		reached[groupInfo.GroupPtr] = true
+	}
+
+	// Sweep the ledger
+	for id, scope := range ledger {
+		if reached[id] {
+			continue
+		}
+		if scope != (userlib.UUID{}) && !seen[scope] {
+			continue
+		}
+		_, exist := userdata.journalGet(id)
+		if exist {
+			orphans = append(orphans, id)
+			if dryRun {
+				continue
+			}
+			userdata.datastoreDelete(id)
+		}
+		delete(ledger, id)
+	}
+	if dryRun {
+		return orphans, nil
+	}
+	return orphans, userdata.storeLedger(ledger, head)
+}
+
+// *********** Account **************
+// delete every record of a file we own, the recipients' keys and tree nodes too
+func (userdata *User) deleteOwnedFile(fileInfo FileInfo, userVDKey []userlib.DSVerifyKey) error {
+	ctx, err := userdata.openFile(fileInfo, userVDKey)
+	if err != nil {
+		return err
+	}
+	entries, err := userdata.walkTree(ctx.OwnerKeys, userdata.Username, userdata.Username, fileInfo.TreeNodePtr, fileInfo.TreeNodeKey, PermissionWrite)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		userdata.datastoreDelete(entry.Ptr)
+		userdata.datastoreDelete(entry.Node.FileKeyPtr)
+		if entry.Node.InvitationPtr != (userlib.UUID{}) {
+			userdata.datastoreDelete(entry.Node.InvitationPtr)
+			userdata.datastoreDelete(entry.Node.InviFileInfoPtr)
+		}
+		if entry.Node.OfferPtr != (userlib.UUID{}) {
+			userdata.datastoreDelete(entry.Node.OfferPtr)
+			userdata.datastoreDelete(entry.Node.OfferInfoPtr)
+		}
+	}
+	err = userdata.releaseChunks(fileInfo.HeaderPtr, ctx.List.Chunks)
+	if err != nil {
+		return err
+	}
+	userdata.datastoreDelete(fileInfo.ContentUUIDListPtr)
+	userdata.datastoreDelete(fileInfo.HeaderPtr)
+	return userdata.deleteAuditLog(fileInfo.HeaderPtr)
+}
+// revoke everyone we shared a file we do not own with
+func (userdata *User) revokeOutgoing(fileInfo FileInfo, userVDKey []userlib.DSVerifyKey) error {
+	ctx, err := userdata.openFile(fileInfo, userVDKey)
+	if err != nil {
+		return nil // Lost it already
+	}
+	treeNode, err := userdata.getTreeNode(ctx.DSKeys, fileInfo.TreeNodePtr, fileInfo.TreeNodeKey)
+	if err != nil {
+		return err
+	}
+	for child := range treeNode.UsernameToTreeNodePtr {
+		_, err = userdata.removeShareSubtree(fileInfo, ctx.OwnerKeys, ctx.DSKeys, child)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+// remove all the user's records and leave the tombstone, the keystore is
+// left alone
+func (userdata *User) deleteRecords(userPtr userlib.UUID) (err error) {
+	defer userdata.transaction()(&err)
+	fileInfoMap, userVDKey, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return err
+	}
+
+	// Revoke first, so what they leave behind is garbage
+	owned := make(map[string]bool)
+	for hashedFilename, fileInfo := range fileInfoMap {
+		owned[hashedFilename], _ = userdata.ownsFile(fileInfo)
+		if !owned[hashedFilename] {
+			err = userdata.revokeOutgoing(fileInfo, userVDKey)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err = userdata.CollectGarbage(false)
+	if err != nil {
+		return err
+	}
+	// Our nodes in others' trees stay until their owners revoke us
+	for hashedFilename, fileInfo := range fileInfoMap {
+		if owned[hashedFilename] {
+			err = userdata.deleteOwnedFile(fileInfo, userVDKey)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Groups
+	groupMap, err := userdata.getGroupMap()
+	if err != nil {
+		return err
+	}
+	for _, groupInfo := range groupMap {
+		userdata.datastoreDelete(groupInfo.GroupPtr)
+	}
+
+	userdata.datastoreDelete(userdata.EncGroupNameToGroupInfoPtr)
+	userdata.datastoreDelete(userdata.EncFileNameToFileInfoPtr)
+	ledgerPtrs, err := userdata.ledgerPtrs()
+	if err != nil {
+		return err
+	}
+	for _, id := range ledgerPtrs {
+		userdata.datastoreDelete(id)
+	}
+	userdata.datastoreDelete(userdata.ContactsPtr)
+	if userdata.RecoveryKey != nil {
+		for _, codePtr := range userdata.RecoveryCodePtrs {
+			userdata.datastoreDelete(codePtr)
+		}
+		err = userdata.deleteShares(userdata.RecoveryTrustees)
+		if err != nil {
+			return err
+		}
+		socialPtr, err := socialRecoveryPtr(userdata.Username)
+		if err != nil {
+			return err
+		}
+		userdata.datastoreDelete(socialPtr)
+		recoveryPtr, err := recoveryUserPtr(userdata.Username)
+		if err != nil {
+			return err
+		}
+		userdata.datastoreDelete(recoveryPtr)
+	}
+	userdata.datastoreDelete(userPtr)
+
+	// The tombstone, with the rest so no half deleted account is left
+	id, err := tombstonePtr(userdata.Username)
+	if err != nil {
+		return err
+	}
+	dsTombstone, err := dsEnc(userdata.DKey, []byte("DELETED" + userdata.Username))
+	if err != nil {
+		return err
+	}
+	userdata.hmacDatastoreSet(id, dsTombstone)
+	return nil
+}
+
+// DeleteAccount revokes everything the user shared, deletes the files they
+// own along with all their records, and tombstones the username so it can
+// never be taken again. Recipients of their files get told the owner is gone.
+func (userdata *User) DeleteAccount(password string) (err error) {
+	defer userdata.reportBackend(&err)
+	if userdata.Device != "" {
+		return re("Needs a password login.")
+	}
+	userPtr, err := userdata.checkPassword(password)
+	if err != nil {
+		return err
+	}
+	return userdata.deleteRecords(userPtr)
+}
+
+// *********** Ownership **************
+// OwnershipOffer is what the owner hands the next owner, until accepted.
+type OwnershipOffer struct {
+	Info FileInfo // points at the root of the tree
+	PackedKeys []byte // the owner's file keys
+	Cert OwnerCert
+}
+
+// the user owns the file, and no one took it over since
+func (userdata *User) ownsFile(fileInfo FileInfo) (bool, error) {
+	if fileInfo.Owner != userdata.Username {
+		return false, nil
+	}
+	owner, _, _, err := userdata.resolveFileOwner(fileInfo.Owner, fileInfo.HeaderPtr)
+	if err != nil {
+		return false, err
+	}
+	return owner == userdata.Username, nil
+}
+
+// TransferOwnership offers the file to newOwner. Nothing changes until they
+// accept the offer; a new offer replaces the last one. Once accepted the
+// old owner loses access and everyone else keeps theirs.
+func (userdata *User) TransferOwnership(filename string, newOwner string) (offerPtr userlib.UUID, err error) {
+	defer userdata.transaction()(&err)
+	err = userdata.checkContact(newOwner)
+	if err != nil {
+		return offerPtr, err
+	}
+	fileInfoMap, userVDKey, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return offerPtr, err
+	}
+	fileInfo, exist := getFileInfo(filename, fileInfoMap)
+	if !exist {
+		return offerPtr, re("DNE file.")
+	}
+	owner, err := userdata.ownsFile(fileInfo)
+	if err != nil {
+		return offerPtr, err
+	}
+	if !owner {
+		return offerPtr, re("Only file owner can hand it over.")
+	}
+	if userdata.Device != "" {
+		return offerPtr, re("Needs a password login.")
+	}
+	if newOwner == userdata.Username {
+		return offerPtr, re("Already the owner.")
+	}
+	_, err = userdata.getPKEPublic(newOwner)
+	if err != nil {
+		return offerPtr, err
+	}
+	ctx, err := userdata.openFile(fileInfo, userVDKey)
+	if err != nil {
+		return offerPtr, err
+	}
+
+	// The offer, with the certificate the next owner puts in the header
+	var offer OwnershipOffer
+	offer.Info.Owner = userdata.Username
+	offer.Info.ContentUUIDListPtr = fileInfo.ContentUUIDListPtr
+	offer.Info.HeaderPtr = fileInfo.HeaderPtr
+	offer.Info.TreeNodePtr = fileInfo.TreeNodePtr
+	offer.Info.TreeNodeKey = fileInfo.TreeNodeKey
+	offer.PackedKeys = ctx.Keys.packOwner()
+	offer.Cert = OwnerCert{From: userdata.Username, To: newOwner, Index: len(ctx.Header.Owners)}
+	err = signOwnerCert(userdata.DKey, fileInfo.HeaderPtr, &offer.Cert)
+	if err != nil {
+		return offerPtr, err
+	}
+	offerKey := userlib.RandomBytes(16)
+	marshalOffer, err := userlib.Marshal(offer)
+	if err != nil {
+		return offerPtr, err
+	}
+	dsEncOffer, err := dsEnc(userdata.DKey, symEnc(offerKey, marshalOffer))
+	if err != nil {
+		return offerPtr, err
+	}
+	offerInfoPtr := userdata.newID()
+	userdata.hmacDatastoreSet(offerInfoPtr, dsEncOffer)
+
+	// Only the next owner can open it
+	pkeEncOfferContent, err := userdata.pkeEncToUser(newOwner, append(offerInfoPtr[:], offerKey...))
+	if err != nil {
+		return offerPtr, err
+	}
+	dsPKEEncOfferContent, err := dsEnc(userdata.DKey, pkeEncOfferContent)
+	if err != nil {
+		return offerPtr, err
+	}
+	offerPtr = userdata.newID()
+	userdata.hmacDatastoreSet(offerPtr, dsPKEEncOfferContent)
+
+	// Keep it in the root, dropping the last offer
+	rootNode, err := userdata.getTreeNode(ctx.DSKeys, fileInfo.TreeNodePtr, fileInfo.TreeNodeKey)
+	if err != nil {
+		return offerPtr, err
+	}
+	if rootNode.OfferPtr != (userlib.UUID{}) {
+		userdata.datastoreDelete(rootNode.OfferPtr)
+		userdata.datastoreDelete(rootNode.OfferInfoPtr)
+	}
+	rootNode.OfferPtr = offerPtr
+	rootNode.OfferInfoPtr = offerInfoPtr
+	err = userdata.storeTreeNode(fileInfo.TreeNodePtr, fileInfo.TreeNodeKey, rootNode, userdata.DKey)
+	if err != nil {
+		return offerPtr, err
+	}
+	return offerPtr, nil
+}
+
+// open an ownership offer sent to us
+func (userdata *User) getOwnershipOffer(senderVDKey []userlib.DSVerifyKey, offerPtr userlib.UUID) (OwnershipOffer, userlib.UUID, error) {
+	var offer OwnershipOffer
+	var offerInfoPtr userlib.UUID
+	pkeEncOfferContent, err := userdata.dsDec(senderVDKey, offerPtr)
+	if err != nil {
+		return offer, offerInfoPtr, re("The offer DNE.")
+	}
+	offerContent, err := userdata.pkeDec(pkeEncOfferContent)
+	if err != nil || len(offerContent) != 32 {
+		return offer, offerInfoPtr, re("The offer been modified.")
+	}
+	copy(offerInfoPtr[:], offerContent[:16])
+	encOffer, err := userdata.dsDec(senderVDKey, offerInfoPtr)
+	if err != nil {
+		return offer, offerInfoPtr, re("The offer been modified.")
+	}
+	marshalOffer, err := symDec(offerContent[16:], encOffer)
+	if err != nil {
+		return offer, offerInfoPtr, err
+	}
+	err = userlib.Unmarshal(marshalOffer, &offer)
+	return offer, offerInfoPtr, err
+}
+
+// AcceptOwnership takes over a file offered by its owner, keeping it under
+// filename. The tree is re-rooted at us and re-signed with our DS key, and
+// the file moves to a new key chain the old owner cannot derive. If we had
+// access before, our node folds into the root and our recipients stay.
+func (userdata *User) AcceptOwnership(senderUsername string, offerPtr userlib.UUID, filename string) (err error) {
+	defer userdata.transaction()(&err)
+	err = userdata.checkContact(senderUsername)
+	if err != nil {
+		return err
+	}
+	senderVDKey, err := userdata.getDSVerify(senderUsername)
+	if err != nil {
+		return err
+	}
+	offer, offerInfoPtr, err := userdata.getOwnershipOffer(senderVDKey, offerPtr)
+	if err != nil {
+		return err
+	}
+	info := offer.Info
+
+	// The sender must still own it, and hand it to us as the next owner
+	owner, _, header, err := userdata.resolveFileOwner(senderUsername, info.HeaderPtr)
+	if err != nil {
+		return err
+	}
+	cert := offer.Cert
+	if owner != senderUsername || cert.From != senderUsername || cert.To != userdata.Username || cert.Index != len(header.Owners) {
+		return re("The offer is out of date.")
+	}
+	err = verifyOwnerCert(senderVDKey, info.HeaderPtr, cert)
+	if err != nil {
+		return err
+	}
+	keys, err := unpackFileKeys(offer.PackedKeys)
+	if err != nil {
+		return err
+	}
+	if keys.ChainSeed == nil {
+		return re("The offer has no owner keys.")
+	}
+
+	// Where it goes in our file map
+	fileInfoMap, _, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return err
+	}
+	hashedFilename := hex.EncodeToString(userlib.Hash([]byte(filename)))
+	oldFileInfo, exist := fileInfoMap[hashedFilename]
+	if exist && oldFileInfo.HeaderPtr != info.HeaderPtr {
+		return re("Exist such file.")
+	}
+
+	//// The tree as the sender signed it
+	entries, err := userdata.walkTree(senderVDKey, senderUsername, senderUsername, info.TreeNodePtr, info.TreeNodeKey, PermissionWrite)
+	if err != nil {
+		return err
+	}
+	root := &entries[0]
+
+	// Our own node folds into the root
+	removed := make(map[userlib.UUID]bool)
+	for i := 1; i < len(entries); i++ {
+		mine := entries[i]
+		if mine.Username != userdata.Username {
+			continue
+		}
+		for j := range entries {
+			ptr, ok := entries[j].Node.UsernameToTreeNodePtr[mine.Username]
+			if ok && ptr == mine.Ptr {
+				delete(entries[j].Node.UsernameToTreeNodePtr, mine.Username)
+				delete(entries[j].Node.UsernameToTreeNodeKey, mine.Username)
+				delete(entries[j].Node.UsernameToPermission, mine.Username)
+				delete(entries[j].Node.UsernameToInvitedAt, mine.Username)
+			}
+		}
+		for child, ptr := range mine.Node.UsernameToTreeNodePtr {
+			_, ok := root.Node.UsernameToTreeNodePtr[child]
+			if ok {
+				continue
+			}
+			root.Node.UsernameToTreeNodePtr[child] = ptr
+			root.Node.UsernameToTreeNodeKey[child] = mine.Node.UsernameToTreeNodeKey[child]
+			root.Node.UsernameToPermission[child] = grantedPermission(mine.Node, child)
+			root.Node.UsernameToInvitedAt[child] = mine.Node.UsernameToInvitedAt[child]
+		}
+		removed[mine.Ptr] = true
+		userdata.datastoreDelete(mine.Ptr)
+		userdata.datastoreDelete(mine.Node.FileKeyPtr)
+	}
+
+	// The root is ours now, with a key blob of our own
+	userdata.datastoreDelete(root.Node.FileKeyPtr)
+	root.Node.FileKeyPtr = userdata.newID()
+	root.Node.OfferPtr = userlib.UUID{}
+	root.Node.OfferInfoPtr = userlib.UUID{}
+	userdata.datastoreDelete(offerPtr)
+	userdata.datastoreDelete(offerInfoPtr)
+	for _, entry := range entries {
+		if removed[entry.Ptr] {
+			continue
+		}
+		err = userdata.storeTreeNode(entry.Ptr, entry.Key, entry.Node, userdata.DKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Our certificate goes in the header, which we sign from now on
+	header.Owners = append(header.Owners, cert)
+	err = userdata.storeFileHeader(info.HeaderPtr, header, userdata.DKey)
+	if err != nil {
+		return err
+	}
+
+	var newFileInfo FileInfo
+	newFileInfo.Owner = userdata.Username // Assign
+	newFileInfo.ContentUUIDListPtr = info.ContentUUIDListPtr // Assign
+	newFileInfo.HeaderPtr = info.HeaderPtr // Assign
+	newFileInfo.TreeNodePtr = info.TreeNodePtr // Assign
+	newFileInfo.TreeNodeKey = info.TreeNodeKey // Assign
+	newFileInfo.FileKeyPtr = root.Node.FileKeyPtr // Assign
+	newFileInfo.EncName = symEnc(userdata.FileNameKey, []byte(filename)) // Assign
+	fileInfoMap[hashedFilename] = newFileInfo
+	marshalNewFileInfoMap, err := userlib.Marshal(fileInfoMap)
+	if err != nil {
+		return err
+	}
+	encNewFileInfoMap := symEnc(userlib.Hash([]byte(userdata.Username))[:16], marshalNewFileInfoMap)
+	dsEncNewFileInfoMap, err := dsEnc(userdata.DKey, encNewFileInfoMap)
+	if err != nil {
+		return err
+	}
+	userdata.hmacDatastoreSet(userdata.EncFileNameToFileInfoPtr, dsEncNewFileInfoMap)
+
+	//// A new chain the old owner cannot derive, handed out to everyone left
+	userVDKey, err := userdata.getDSVerify(userdata.Username)
+	if err != nil {
+		return err
+	}
+	return userdata.rekeyFile(newFileInfo, userVDKey, keys, newFileKeys(), false, nil)
+}
+
+// *********** Key Rotation **************
+// KeyRotation publishes a user's next keys, signed by their previous DS key.
+type KeyRotation struct {
+	Username string
+	Version int
+	PKey userlib.PKEEncKey
+	DKey userlib.DSVerifyKey
+}
+
+func keyFingerprint(key userlib.PublicKeyType) string {
+	marshalKey, err := userlib.Marshal(key)
+	if err != nil {
+		return ""
+	}
+	return string(userlib.Hash(marshalKey))
+}
+// where version v of the user's keys live, v 0 is from InitUser
+func keystoreName(prefix string, version int, username string) string {
+	if version == 0 {
+		return string(userlib.Hash([]byte(prefix + username))[:16])
+	}
+	return string(userlib.Hash([]byte(fmt.Sprintf("R%s%d:%s", prefix, version, username)))[:16])
+}
+func rotationPtr(version int, username string) (userlib.UUID, error) {
+	return userlib.UUIDFromBytes(userlib.Hash([]byte(fmt.Sprintf("ROTATE%d:%s", version, username)))[:16])
+}
+
+// every version of the user's keys, oldest first, each checked against the
+// rotation signed by the one before. Anyone can fill a keystore name, so a
+// version without a good rotation is skipped, not an error.
+func (userdata *User) getKeyChain(username string) ([]userlib.DSVerifyKey, []userlib.PKEEncKey, error) {
+	dsKey, ok := userdata.keystoreGet(keystoreName("D", 0, username))
+	if !ok {
+		return nil, nil, re(username + " has no DS verify key.")
+	}
+	dsKeys := []userlib.DSVerifyKey{dsKey}
+	var pkeKeys []userlib.PKEEncKey
+	pkeKey, ok := userdata.keystoreGet(keystoreName("P", 0, username))
+	if ok {
+		pkeKeys = append(pkeKeys, pkeKey)
+	}
+
+	for version := 1; userdata.keyVersionTaken(version, username); version++ {
+		dsKey, pkeKey, ok := userdata.checkRotation(dsKeys[len(dsKeys) - 1], version, username)
+		if ok {
+			dsKeys = append(dsKeys, dsKey)
+			pkeKeys = append(pkeKeys, pkeKey)
+		}
+	}
+	return dsKeys, pkeKeys, nil
+}
+// whether anything sits at either keystore name of version
+func (userdata *User) keyVersionTaken(version int, username string) bool {
+	_, dsTaken := userdata.keystoreGet(keystoreName("D", version, username))
+	_, pkeTaken := userdata.keystoreGet(keystoreName("P", version, username))
+	return dsTaken || pkeTaken
+}
+// the keys of version, if its rotation is signed by prevKey and matches the
+// keystore
+func (userdata *User) checkRotation(prevKey userlib.DSVerifyKey, version int, username string) (
+	userlib.DSVerifyKey, userlib.PKEEncKey, bool) {
+	dsKey, ok1 := userdata.keystoreGet(keystoreName("D", version, username))
+	pkeKey, ok2 := userdata.keystoreGet(keystoreName("P", version, username))
+	id, err := rotationPtr(version, username)
+	if !ok1 || !ok2 || err != nil {
+		return dsKey, pkeKey, false
+	}
+	content, ok := userdata.hmacDatastoreGet(id)
+	if !ok || len(content) < 256 {
+		return dsKey, pkeKey, false
+	}
+	marshalRotation, signature := content[:len(content) - 256], content[len(content) - 256:]
+	if userlib.DSVerify(prevKey, marshalRotation, signature) != nil {
+		return dsKey, pkeKey, false
+	}
+	var rotation KeyRotation
+	err = userlib.Unmarshal(marshalRotation, &rotation)
+	if err != nil || rotation.Username != username || rotation.Version != version ||
+		keyFingerprint(rotation.DKey) != keyFingerprint(dsKey) || keyFingerprint(rotation.PKey) != keyFingerprint(pkeKey) {
+		return dsKey, pkeKey, false
+	}
+	return dsKey, pkeKey, true
+}
+
+// PKE dec by our key, or an older one for what was sealed before a
+// rotation. Content sealed to a user with devices has one slot per key.
+func (userdata *User) pkeDec(content []byte) ([]byte, error) {
+	slots := [][]byte{content}
+	if len(content) > pkeSlotLen && len(content) % pkeSlotLen == 0 {
+		slots = nil
+		for i := 0; i < len(content); i += pkeSlotLen {
+			slots = append(slots, content[i:i + pkeSlotLen])
+		}
+	}
+	var err error
+	for _, slot := range slots {
+		var plain []byte
+		plain, err = userlib.PKEDec(userdata.PKey, slot)
+		if err == nil {
+			return plain, nil
+		}
+		for i := len(userdata.OldPKeys) - 1; i >= 0; i-- {
+			plain, oldErr := userlib.PKEDec(userdata.OldPKeys[i], slot)
+			if oldErr == nil {
+				return plain, nil
+			}
+		}
+	}
+	return nil, err
+}
+
+// seal the user struct under the password and sign it
+func (userdata *User) storeUser(userPtr userlib.UUID, password string) error {
+	userdata.loginKey = LoginKey(userdata.Username, password)
+	return userdata.storeUserRecord(userPtr)
+}
+// seal the user struct under the key the session logged in with
+func (userdata *User) storeUserRecord(userPtr userlib.UUID) error {
+	if userdata.loginKey == nil {
+		return re("Needs a password login.")
+	}
+	// Marshal
+	marshalUser, err := userlib.Marshal(userdata)
+	if err != nil {
+		return err
+	}
+	// Sym Enc
+	encUser := symEnc(userdata.loginKey, marshalUser)
+	// DS Enc
+	dsEncUser, err := dsEnc(userdata.DKey, encUser)
+	if err != nil {
+		return err
+	}
+	userdata.hmacDatastoreSet(userPtr, dsEncUser)
+
+	// Keep the recovery copy in step
+	if userdata.RecoveryKey != nil {
+		recoveryPtr, err := recoveryUserPtr(userdata.Username)
+		if err != nil {
+			return err
+		}
+		dsEncRecovery, err := dsEnc(userdata.DKey, symEnc(userdata.RecoveryKey, marshalUser))
+		if err != nil {
+			return err
+		}
+		userdata.hmacDatastoreSet(recoveryPtr, dsEncRecovery)
+	}
+	return nil
+}
+// check the password against the stored user
+func (userdata *User) checkPassword(password string) (userlib.UUID, error) {
+	userPtr, err := userlib.UUIDFromBytes(userlib.Hash([]byte(userdata.Username))[:16])
+	if err != nil {
+		return userPtr, err
+	}
+	userVDKey, err := userdata.getDSVerify(userdata.Username)
+	if err != nil {
+		return userPtr, err
+	}
+	encUser, err := userdata.dsDec(userVDKey, userPtr)
+	if err != nil {
+		return userPtr, re("User been modified by unknown.")
+	}
+	marshalUser, err := symDec(byte16(userdata.Username + "USER" + password), encUser)
+	if err != nil {
+		return userPtr, re("Wrong password.")
+	}
+	var stored User
+	err = userlib.Unmarshal(marshalUser, &stored)
+	if err != nil || stored.Username != userdata.Username {
+		return userPtr, re("Wrong password.")
+	}
+	return userPtr, nil
+}
+
+// RotateKeys publishes a new PKE and DS key pair for the user, signed by
+// the current DS key. Records signed or sealed under the old keys stay
+// readable; other sessions of the user should log in again to pick up
+// the new keys.
+func (userdata *User) RotateKeys(password string) (err error) {
+	defer userdata.reportBackend(&err)
+	if userdata.Device != "" {
+		return re("Needs a password login.")
+	}
+	userPtr, err := userdata.checkPassword(password)
+	if err != nil {
+		return err
+	}
+	// The first version nobody took, someone may have filled the next ones
+	version := 1
+	for userdata.keyVersionTaken(version, userdata.Username) {
+		version++
+	}
+
+	// New keys and the rotation signed by the old DS key
+	var rotation KeyRotation
+	rotation.Username = userdata.Username
+	rotation.Version = version
+	var newPKey userlib.PKEDecKey
+	rotation.PKey, newPKey, err = userlib.PKEKeyGen()
+	if err != nil {
+		return re("Fail generate PKE key.")
+	}
+	var newDKey userlib.DSSignKey
+	newDKey, rotation.DKey, err = userlib.DSKeyGen()
+	if err != nil {
+		return re("Fail generate DS key.")
+	}
+	marshalRotation, err := userlib.Marshal(rotation)
+	if err != nil {
+		return err
+	}
+	dsRotation, err := dsEnc(userdata.DKey, marshalRotation)
+	if err != nil {
+		return err
+	}
+	rotationID, err := rotationPtr(version, userdata.Username)
+	if err != nil {
+		return err
+	}
+	userdata.hmacDatastoreSet(rotationID, dsRotation)
+
+	// The user keeps the old PKE key for what was sealed to it
+	oldPKey, oldDKey, oldPKeys := userdata.PKey, userdata.DKey, userdata.OldPKeys
+	userdata.OldPKeys = append(append([]userlib.PKEDecKey{}, oldPKeys...), oldPKey)
+	userdata.PKey = newPKey
+	userdata.DKey = newDKey
+	err = userdata.storeUser(userPtr, password)
+	if err == nil && userdata.backendErr == nil {
+		// Publish last, the PKE key first since readers look for the DS key
+		err = userdata.store().KeystoreSet(keystoreName("P", version, userdata.Username), rotation.PKey)
+		if err == nil {
+			err = userdata.store().KeystoreSet(keystoreName("D", version, userdata.Username), rotation.DKey)
+		}
+	}
+	if err != nil || userdata.backendErr != nil {
+		// Back to the old keys
+		userdata.PKey, userdata.DKey, userdata.OldPKeys = oldPKey, oldDKey, oldPKeys
+		userdata.storeUser(userPtr, password)
+		userdata.datastoreDelete(rotationID)
+		return re("Fail publish rotated keys.")
+	}
+	return nil
+}
+
+// *********** Devices **************
+// Device is one of a user's devices, with its own keys.
+type Device struct {
+	Name string
+	PKey userlib.PKEEncKey
+	DKey userlib.DSVerifyKey
+}
+
+// RSA ciphertext length, one slot per key content is sealed to
+const pkeSlotLen = 256
+
+func deviceID(username string, deviceName string) []byte {
+	return userlib.Hash(append(userlib.Hash([]byte(username)), []byte(deviceName)...))
+}
+func devicesPtr(username string) (userlib.UUID, error) {
+	return userlib.UUIDFromBytes(userlib.Hash([]byte("DEVICES" + username))[:16])
+}
+func deviceRecordPtr(username string, deviceName string) (userlib.UUID, error) {
+	return userlib.UUIDFromBytes(userlib.Hash(append([]byte("DEVICE"), deviceID(username, deviceName)...))[:16])
+}
+func deviceTombstonePtr(username string, deviceName string) (userlib.UUID, error) {
+	return userlib.UUIDFromBytes(userlib.Hash(append([]byte("REVOKED"), deviceID(username, deviceName)...))[:16])
+}
+func userKeysPtr(username string) (userlib.UUID, error) {
+	return userlib.UUIDFromBytes(userlib.Hash([]byte("USERKEYS" + username))[:16])
+}
+// revoked devices leave a tombstone signed by one of the user's master keys
+func (userdata *User) deviceRevoked(username string, deviceName string, dsKeys []userlib.DSVerifyKey) bool {
+	id, err := deviceTombstonePtr(username, deviceName)
+	if err != nil {
+		return false
+	}
+	content, err := userdata.dsDec(dsKeys, id)
+	return err == nil && userlib.HMACEqual(content, append([]byte("REVOKED"), deviceID(username, deviceName)...))
+}
+
+// the user's active devices, the list has to be signed by one of their
+// master keys
+func (userdata *User) getDevices(username string, dsKeys []userlib.DSVerifyKey) ([]Device, error) {
+	id, err := devicesPtr(username)
+	if err != nil {
+		return nil, err
+	}
+	content, ok := userdata.hmacDatastoreGet(id)
+	if !ok {
+		return nil, nil
+	}
+	if len(content) < 256 {
+		return nil, re("Device list been modified.")
+	}
+	marshalDevices, signature := content[:len(content) - 256], content[len(content) - 256:]
+	verified := false
+	for _, dsKey := range dsKeys {
+		if userlib.DSVerify(dsKey, marshalDevices, signature) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, re("Device list been modified.")
+	}
+	var devices []Device
+	err = userlib.Unmarshal(marshalDevices, &devices)
+	if err != nil {
+		return nil, err
+	}
+	var active []Device
+	for _, device := range devices {
+		if !userdata.deviceRevoked(username, device.Name, dsKeys) {
+			active = append(active, device)
+		}
+	}
+	return active, nil
+}
+func (userdata *User) storeDevices(devices []Device) error {
+	id, err := devicesPtr(userdata.Username)
+	if err != nil {
+		return err
+	}
+	marshalDevices, err := userlib.Marshal(devices)
+	if err != nil {
+		return err
+	}
+	dsEncDevices, err := dsEnc(userdata.DKey, marshalDevices)
+	if err != nil {
+		return err
+	}
+	userdata.hmacDatastoreSet(id, dsEncDevices)
+	return nil
+}
+
+// PKE enc to the user's latest key and each of their active devices
+func (userdata *User) pkeEncToUser(username string, content []byte) ([]byte, error) {
+	dsKeys, pkeKeys, err := userdata.getKeyChain(username)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkeKeys) == 0 {
+		return nil, re(username + " has no public PKE key.")
+	}
+	devices, err := userdata.getDevices(username, dsKeys)
+	if err != nil {
+		return nil, err
+	}
+	encContent, err := userlib.PKEEnc(pkeKeys[len(pkeKeys) - 1], content)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		encSlot, err := userlib.PKEEnc(device.PKey, content)
+		if err != nil {
+			return nil, err
+		}
+		encContent = append(encContent, encSlot...)
+	}
+	return encContent, nil
+}
+
+// The user's own sym keys. Device sessions are not stored with them but
+// read them sealed to the active devices, so revoking one can move the
+// others over to new keys.
+func (userdata *User) packUserKeys() []byte {
+	var packedKeys []byte
+	for _, key := range [][]byte{userdata.FileNameKey, userdata.GroupMapKey, userdata.JournalKey, userdata.LedgerKey, userdata.ContactsKey} {
+		packedKeys = append(packedKeys, key...)
+	}
+	return packedKeys
+}
+func (userdata *User) unpackUserKeys(packedKeys []byte) error {
+	if len(packedKeys) != 80 {
+		return re("Invalid user key length.")
+	}
+	userdata.FileNameKey = packedKeys[0:16]
+	userdata.GroupMapKey = packedKeys[16:32]
+	userdata.JournalKey = packedKeys[32:48]
+	userdata.LedgerKey = packedKeys[48:64]
+	userdata.ContactsKey = packedKeys[64:80]
+	return nil
+}
+// seal the user's sym keys to their active devices
+func (userdata *User) storeUserKeys() error {
+	id, err := userKeysPtr(userdata.Username)
+	if err != nil {
+		return err
+	}
+	dsEncKeys, err := userdata.sealFileKeys(userdata.Username, userdata.packUserKeys(), userdata.DKey)
+	if err != nil {
+		return err
+	}
+	userdata.hmacDatastoreSet(id, dsEncKeys)
+	return nil
+}
+// a device session opens the sym keys, signed by one of the master keys
+func (userdata *User) loadUserKeys(dsKeys []userlib.DSVerifyKey) error {
+	id, err := userKeysPtr(userdata.Username)
+	if err != nil {
+		return err
+	}
+	encKeys, err := userdata.dsDec(dsKeys, id)
+	if err != nil {
+		return re("Device been modified by unknown.")
+	}
+	packedKeys, err := userdata.pkeDec(encKeys)
+	if err != nil {
+		return re("Device been revoked.")
+	}
+	return userdata.unpackUserKeys(packedKeys)
+}
+
+// seal each of our own file keys again, so the current devices can open them
+func (userdata *User) resealOwnFileKeys() error {
+	fileInfoMap, userVDKey, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return err
+	}
+	for _, fileInfo := range fileInfoMap {
+		ctx, err := userdata.openFile(fileInfo, userVDKey)
+		if err != nil {
+			continue // Lost it already
+		}
+		packedKeys := ctx.Keys.pack(ctx.Keys.permission())
+		if ctx.Keys.ChainSeed != nil {
+			packedKeys = ctx.Keys.packOwner()
+		}
+		dsEncFileKey, err := userdata.sealFileKeys(userdata.Username, packedKeys, userdata.DKey)
+		if err != nil {
+			return err
+		}
+		userdata.hmacDatastoreSet(fileInfo.FileKeyPtr, dsEncFileKey)
+	}
+	return nil
+}
+
+// AddDevice gives a new device its own keys, certified in the user's device
+// list. The returned secret logs the device in with GetUserOnDevice; the
+// device never holds the password or the master keys. Invitations already
+// waiting for the user still need a password login to accept.
+func (userdata *User) AddDevice(deviceName string) (deviceSecret []byte, err error) {
+	defer userdata.transaction()(&err)
+	if userdata.Device != "" {
+		return nil, re("Needs a password login.")
+	}
+	dsKeys, _, err := userdata.getKeyChain(userdata.Username)
+	if err != nil {
+		return nil, err
+	}
+	if userdata.deviceRevoked(userdata.Username, deviceName, dsKeys) {
+		return nil, re("Device name belonged to a revoked device.")
+	}
+	devices, err := userdata.getDevices(userdata.Username, dsKeys)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		if device.Name == deviceName {
+			return nil, re("Exist such device.")
+		}
+	}
+
+	// The device's own keys, and its session sealed under the secret
+	var device Device
+	device.Name = deviceName
+	session := *userdata
+	session.Device = deviceName
+	session.OldPKeys = nil
+	session.RecoveryKey = nil
+	session.RecoveryCodePtrs = nil
+	session.RecoveryCodeKeys = nil
+	session.RecoveryTrustees = nil
+	session.FileNameKey = nil
+	session.GroupMapKey = nil
+	session.JournalKey = nil
+	session.LedgerKey = nil
+	session.ContactsKey = nil
+	device.PKey, session.PKey, err = userlib.PKEKeyGen()
+	if err != nil {
+		return nil, re("Fail generate PKE key.")
+	}
+	session.DKey, device.DKey, err = userlib.DSKeyGen()
+	if err != nil {
+		return nil, re("Fail generate DS key.")
+	}
+	deviceSecret = userlib.RandomBytes(16)
+	marshalSession, err := userlib.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	dsEncSession, err := dsEnc(userdata.DKey, symEnc(deviceSecret, marshalSession))
+	if err != nil {
+		return nil, err
+	}
+	recordPtr, err := deviceRecordPtr(userdata.Username, deviceName)
+	if err != nil {
+		return nil, err
+	}
+	userdata.hmacDatastoreSet(recordPtr, dsEncSession)
+
+	err = userdata.storeDevices(append(devices, device))
+	if err != nil {
+		return nil, err
+	}
+	err = userdata.storeUserKeys()
+	if err != nil {
+		return nil, err
+	}
+	return deviceSecret, userdata.resealOwnFileKeys()
+}
+
+// GetUserOnDevice logs in as one of the user's devices with the secret
+// AddDevice gave it.
+func GetUserOnDevice(username string, deviceName string, deviceSecret []byte) (userdataptr *User, err error) {
+	return userlibClient.GetUserOnDevice(username, deviceName, deviceSecret)
+}
+// GetUserOnDevice is the package's GetUserOnDevice, on the client's backend.
+func (c *Client) GetUserOnDevice(username string, deviceName string, deviceSecret []byte) (userdataptr *User, err error) {
+	userdata := User{backend: c.backend}
+	defer userdata.reportBackend(&err)
+	if userdata.accountDeleted(username) {
+		return nil, re(username + " deleted their account.")
+	}
+	dsKeys, _, err := userdata.getKeyChain(username)
+	if err != nil {
+		return nil, err
+	}
+	if userdata.deviceRevoked(username, deviceName, dsKeys) {
+		return nil, re("Device been revoked.")
+	}
+	userVDKey, err := userdata.getDSVerify(username)
+	if err != nil {
+		return nil, err
+	}
+	recordPtr, err := deviceRecordPtr(username, deviceName)
+	if err != nil {
+		return nil, err
+	}
+	encSession, err := userdata.dsDec(userVDKey, recordPtr)
+	if err != nil {
+		return nil, re("Device been modified by unknown.")
+	}
+	if len(deviceSecret) != 16 || len(encSession) < 16 {
+		return nil, re("Wrong device secret.")
+	}
+	marshalSession, err := symDec(deviceSecret, encSession)
+	if err != nil {
+		return nil, re("Wrong device secret.")
+	}
+	err = userlib.Unmarshal(marshalSession, &userdata)
+	if err != nil || userdata.Username != username || userdata.Device != deviceName {
+		return nil, re("Wrong device secret.")
+	}
+	err = userdata.loadUserKeys(dsKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	// Finish the last commit if it got cut off
+	err = userdata.replayJournal(userVDKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &userdata, nil
+}
+
+// ListDevices lists the user's active devices.
+func (userdata *User) ListDevices() (names []string, err error) {
+	defer userdata.reportBackend(&err)
+	dsKeys, _, err := userdata.getKeyChain(userdata.Username)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := userdata.getDevices(userdata.Username, dsKeys)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		names = append(names, device.Name)
+	}
+	return names, nil
+}
+
+// RevokeDevice stops a device: new file keys are no longer sealed to it and
+// its signatures stop verifying. What it signed that the user can still
+// reach is signed again by the master key first. The user's own files
+// start a new key chain and the user's sym keys are replaced, so what is
+// stored after the revoke is out of the device's reach; files others
+// shared with the user stay readable to it until their owners start a new
+// epoch. Other sessions of the user should log in again to pick up the
+// new keys.
+func (userdata *User) RevokeDevice(deviceName string) (err error) {
+	oldKeys := userdata.packUserKeys()
+	defer func() {
+		if err != nil {
+			// Back to the old keys
+			userdata.unpackUserKeys(oldKeys)
+		}
+	}()
+	defer userdata.transaction()(&err)
+	if userdata.Device != "" {
+		return re("Needs a password login.")
+	}
+	dsKeys, _, err := userdata.getKeyChain(userdata.Username)
+	if err != nil {
+		return err
+	}
+	devices, err := userdata.getDevices(userdata.Username, dsKeys)
+	if err != nil {
+		return err
+	}
+	var revoked *Device
+	var kept []Device
+	for i := range devices {
+		if devices[i].Name == deviceName {
+			revoked = &devices[i]
+		} else {
+			kept = append(kept, devices[i])
+		}
+	}
+	if revoked == nil {
+		return re("DNE device.")
+	}
+	userPtr, err := userlib.UUIDFromBytes(userlib.Hash([]byte(userdata.Username))[:16])
+	if err != nil {
+		return err
+	}
+
+	err = userdata.resignDeviceRecords(deviceName, revoked.DKey, kept)
+	if err != nil {
+		return err
+	}
+
+	// The device holds the chain seeds, so a new chain for each of our files
+	fileInfoMap, userVDKey, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return err
+	}
+	for _, fileInfo := range fileInfoMap {
+		ctx, err := userdata.openFile(fileInfo, userVDKey)
+		if err != nil || ctx.Keys.ChainSeed == nil {
+			continue // Lost it already, or not ours
+		}
+		err = userdata.rekeyFile(fileInfo, ctx.OwnerKeys, ctx.Keys, newFileKeys(), false, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	// New sym keys, sealed to the devices we keep
+	err = userdata.rotateUserKeys()
+	if err != nil {
+		return err
+	}
+	err = userdata.storeUserRecord(userPtr)
+	if err != nil {
+		return err
+	}
+	return userdata.storeUserKeys()
+}
+
+// seal the user's own records again under new sym keys
+func (userdata *User) rotateUserKeys() error {
+	// The names in the file map
+	fileInfoMap, _, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return err
+	}
+	fileNameKey := userlib.RandomBytes(16)
+	for hashedFilename, fileInfo := range fileInfoMap {
+		filename, err := symDec(userdata.FileNameKey, fileInfo.EncName)
+		if err != nil || hex.EncodeToString(userlib.Hash(filename)) != hashedFilename {
+			return re("File map been modified.")
+		}
+		fileInfo.EncName = symEnc(fileNameKey, filename)
+		fileInfoMap[hashedFilename] = fileInfo
+	}
+	marshalFileInfoMap, err := userlib.Marshal(fileInfoMap)
+	if err != nil {
+		return err
+	}
+	dsEncFileInfoMap, err := dsEnc(userdata.DKey, symEnc(userlib.Hash([]byte(userdata.Username))[:16], marshalFileInfoMap))
+	if err != nil {
+		return err
+	}
+	userdata.hmacDatastoreSet(userdata.EncFileNameToFileInfoPtr, dsEncFileInfoMap)
+	userdata.FileNameKey = fileNameKey
+
+	// Each group, then the map of them
+	groupMap, err := userdata.getGroupMap()
+	if err != nil {
+		return err
+	}
+	verifyDKey, err := userdata.getDSVerify(userdata.Username)
+	if err != nil {
+		return err
+	}
+	for hashedGroupName, groupInfo := range groupMap {
+		encGroup, err := userdata.dsDec(verifyDKey, groupInfo.GroupPtr)
+		if err != nil {
+			return re("Group been modified.")
+		}
+		marshalGroup, err := symDec(groupInfo.GroupKey, encGroup)
+		if err != nil {
+			return err
+		}
+		groupInfo.GroupKey = userlib.RandomBytes(16)
+		dsEncGroup, err := dsEnc(userdata.DKey, symEnc(groupInfo.GroupKey, marshalGroup))
+		if err != nil {
 			return err
 		}
+		userdata.hmacDatastoreSet(groupInfo.GroupPtr, dsEncGroup)
+		groupMap[hashedGroupName] = groupInfo
+	}
+	userdata.GroupMapKey = userlib.RandomBytes(16)
+	err = userdata.storeGroupMap(groupMap)
+	if err != nil {
+		return err
+	}
 
-		// Encrypt current content
-		encContent := symEnc(fileKey, content)
-		contentPtr := newID()
-		hmacDatastoreSet(contentPtr, encContent)
+	// The contact book
+	contacts, err := userdata.getContacts()
+	if err != nil {
+		return err
+	}
+	userdata.ContactsKey = userlib.RandomBytes(16)
+	err = userdata.storeContacts(contacts)
+	if err != nil {
+		return err
+	}
 
-		// Update the idList
-		newIdList := []userlib.UUID{contentPtr}
-		marshalNewIdList, err := userlib.Marshal(newIdList)
+	// The ledger, its entries sit where only the old key finds them
+	ledger, head, err := userdata.getLedger()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < head.Entries; i++ {
+		entryPtr, err := userdata.ledgerEntryPtr(i)
 		if err != nil {
 			return err
 		}
-		encNewIdList := symEnc(fileKey, marshalNewIdList)
-		hmacDatastoreSet(fileInfo.ContentUUIDListPtr, encNewIdList)
-	} else {
-		// Create a new file info
-		var newFileInfo FileInfo
+		userdata.datastoreDelete(entryPtr)
+	}
+	userdata.LedgerKey = userlib.RandomBytes(16)
+	err = userdata.storeLedger(ledger, ledgerHead{})
+	if err != nil {
+		return err
+	}
 
-		// New a file key and store by self pke ds key enc
-		fileKey := userlib.RandomBytes(16)
-		pPKey, err := getPKEPublic(userdata.Username)
+	// The running transaction is logged under the key it started with
+	userdata.JournalKey = userlib.RandomBytes(16)
+	return nil
+}
+
+// sign again by the master key what the device signed, then drop it from
+// the device list and leave its tombstone
+func (userdata *User) resignDeviceRecords(deviceName string, deviceVDKey userlib.DSVerifyKey, kept []Device) (err error) {
+	defer userdata.transaction()(&err)
+
+	// Everything we can reach
+	fileInfoMap, userVDKey, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return err
+	}
+	reached := make(map[userlib.UUID]bool)
+	for _, fileInfo := range fileInfoMap {
+		userdata.markFile(fileInfo, userVDKey, reached)
+		err = userdata.resignDeviceChunks(fileInfo, userVDKey, deviceVDKey)
 		if err != nil {
-			return re(userdata.Username + " has no PKE pub key.")
+			return err
 		}
-		encFileKey, err := userlib.PKEEnc(pPKey, fileKey)
-		if err != nil{
+		err = userdata.resignDeviceAudit(fileInfo, userVDKey, deviceVDKey)
+		if err != nil {
 			return err
 		}
-		dsEncFileKey, err := dsEnc(userdata.DKey, encFileKey)
-		if err != nil{
+	}
+	groupMap, err := userdata.getGroupMap()
+	if err != nil {
+		return err
+	}
+	for _, groupInfo := range groupMap {
+		reached[groupInfo.GroupPtr] = true
+	}
+	reached[userdata.EncFileNameToFileInfoPtr] = true
+	reached[userdata.EncGroupNameToGroupInfoPtr] = true
+	reached[userdata.ContactsPtr] = true
+	ledgerPtrs, err := userdata.ledgerPtrs()
+	if err != nil {
+		return err
+	}
+	for _, id := range ledgerPtrs {
+		reached[id] = true
+	}
+
+	for id := range reached {
+		content, ok := userdata.hmacDatastoreGet(id)
+		if !ok || len(content) < 256 {
+			continue
+		}
+		signedContent, signature := content[:len(content) - 256], content[len(content) - 256:]
+		if userlib.DSVerify(deviceVDKey, signedContent, signature) != nil {
+			continue
+		}
+		dsEncContent, err := dsEnc(userdata.DKey, signedContent)
+		if err != nil {
 			return err
 		}
-		newFileInfo.FileKeyPtr = newID() // Assign
-		hmacDatastoreSet(newFileInfo.FileKeyPtr, dsEncFileKey)
+		userdata.hmacDatastoreSet(id, dsEncContent)
+	}
+
+	// Its session goes too
+	recordPtr, err := deviceRecordPtr(userdata.Username, deviceName)
+	if err != nil {
+		return err
+	}
+	userdata.datastoreDelete(recordPtr)
+	id, err := deviceTombstonePtr(userdata.Username, deviceName)
+	if err != nil {
+		return err
+	}
+	dsTombstone, err := dsEnc(userdata.DKey, append([]byte("REVOKED"), deviceID(userdata.Username, deviceName)...))
+	if err != nil {
+		return err
+	}
+	userdata.hmacDatastoreSet(id, dsTombstone)
+	return userdata.storeDevices(kept)
+}
+
+// *********** Recovery **************
+func recoveryUserPtr(username string) (userlib.UUID, error) {
+	return userlib.UUIDFromBytes(userlib.Hash([]byte("RECOVERYUSER" + username))[:16])
+}
+// codes are all the same length, so code and username cannot run together
+func recoveryCodePtr(username string, code string) (userlib.UUID, error) {
+	return userlib.UUIDFromBytes(userlib.Hash([]byte("RECOVERY" + code + username))[:16])
+}
+func recoveryCodeKey(code string) []byte {
+	return userlib.Hash([]byte("RECOVERYKEY" + code))[:16]
+}
+
+// wrap the recovery key under one of the codes
+func (userdata *User) storeRecoveryWrap(codePtr userlib.UUID, codeKey []byte) error {
+	dsEncWrap, err := dsEnc(userdata.DKey, symEnc(codeKey, userdata.RecoveryKey))
+	if err != nil {
+		return err
+	}
+	userdata.hmacDatastoreSet(codePtr, dsEncWrap)
+	return nil
+}
+
+// InitUserWithRecovery is InitUser plus codeCount recovery codes. Each code
+// wraps the key of a recovery copy of the user struct on its own, and can
+// be used once with RecoverUser. The codes are only ever returned here.
+func InitUserWithRecovery(username string, password string, codeCount int) (userdataptr *User, codes []string, err error) {
+	return userlibClient.InitUserWithRecovery(username, password, codeCount)
+}
+// InitUserWithRecovery is the package's InitUserWithRecovery, on the client's backend.
+func (c *Client) InitUserWithRecovery(username string, password string, codeCount int) (userdataptr *User, codes []string, err error) {
+	if codeCount < 1 {
+		return nil, nil, re("Need at least one recovery code.")
+	}
+	userdata, err := c.InitUser(username, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	userPtr, err := userlib.UUIDFromBytes(userlib.Hash([]byte(username))[:16])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	userdata.RecoveryKey = userlib.RandomBytes(16)
+	userdata.RecoveryCodeKeys = make(map[userlib.UUID][]byte)
+	for i := 0; i < codeCount; i++ {
+		code := hex.EncodeToString(userlib.RandomBytes(16))
+		codePtr, err := recoveryCodePtr(username, code)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = userdata.storeRecoveryWrap(codePtr, recoveryCodeKey(code))
+		if err != nil {
+			return nil, nil, err
+		}
+		userdata.RecoveryCodePtrs = append(userdata.RecoveryCodePtrs, codePtr)
+		userdata.RecoveryCodeKeys[codePtr] = recoveryCodeKey(code)
+		codes = append(codes, code)
+	}
+	err = userdata.storeUser(userPtr, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	return userdata, codes, nil
+}
+
+// RecoverUser logs in with a recovery code instead of the password and sets
+// newPassword. The code cannot be used again, and the recovery key it
+// unwrapped is replaced.
+func RecoverUser(username string, code string, newPassword string) (userdataptr *User, err error) {
+	return userlibClient.RecoverUser(username, code, newPassword)
+}
+// RecoverUser is the package's RecoverUser, on the client's backend.
+func (c *Client) RecoverUser(username string, code string, newPassword string) (userdataptr *User, err error) {
+	userdata := User{backend: c.backend}
+	defer userdata.reportBackend(&err)
+	if userdata.accountDeleted(username) {
+		return nil, re(username + " deleted their account.")
+	}
+	userVDKey, err := userdata.getDSVerify(username)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unwrap the recovery key
+	codePtr, err := recoveryCodePtr(username, code)
+	if err != nil {
+		return nil, err
+	}
+	encWrap, err := userdata.dsDec(userVDKey, codePtr)
+	if err != nil || len(encWrap) < 16 {
+		return nil, re("Invalid or used recovery code.")
+	}
+	recoveryKey, err := symDec(recoveryCodeKey(code), encWrap)
+	if err != nil || len(recoveryKey) != 16 {
+		return nil, re("Invalid or used recovery code.")
+	}
+
+	err = userdata.openRecoveryCopy(username, userVDKey, recoveryKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use up the code and seal under the new password. A used code put
+	// back in the datastore is no longer on the user's list.
+	var left []userlib.UUID
+	for _, ptr := range userdata.RecoveryCodePtrs {
+		if ptr != codePtr {
+			left = append(left, ptr)
+		}
+	}
+	if len(left) == len(userdata.RecoveryCodePtrs) {
+		return nil, re("Invalid or used recovery code.")
+	}
+	userdata.RecoveryCodePtrs = left
+	delete(userdata.RecoveryCodeKeys, codePtr)
+	userdata.datastoreDelete(codePtr)
+	err = userdata.resetPassword(userVDKey, newPassword)
+	if err != nil {
+		return nil, err
+	}
+	return &userdata, nil
+}
+
+// load the recovery copy of the user struct, sealed under the recovery key,
+// into userdata
+func (userdata *User) openRecoveryCopy(username string, userVDKey []userlib.DSVerifyKey, recoveryKey []byte) error {
+	recoveryPtr, err := recoveryUserPtr(username)
+	if err != nil {
+		return err
+	}
+	encUser, err := userdata.dsDec(userVDKey, recoveryPtr)
+	if err != nil {
+		return re("User been modified by unknown.")
+	}
+	marshalUser, err := symDec(recoveryKey, encUser)
+	if err != nil {
+		return err
+	}
+	err = userlib.Unmarshal(marshalUser, userdata)
+	if err != nil || userdata.Username != username {
+		return re("User been modified by unknown.")
+	}
+	return nil
+}
+
+// seal a recovered user under a new recovery key and the new password
+func (userdata *User) resetPassword(userVDKey []userlib.DSVerifyKey, newPassword string) (err error) {
+	// Finish the last commit if it got cut off
+	err = userdata.replayJournal(userVDKey)
+	if err != nil {
+		return err
+	}
 
-		// Sym Enc content by file key
-		encContent := symEnc(fileKey, content)
-		encContentPtr := newID()
-		hmacDatastoreSet(encContentPtr, encContent)
+	defer userdata.transaction()(&err)
+	userPtr, err := userlib.UUIDFromBytes(userlib.Hash([]byte(userdata.Username))[:16])
+	if err != nil {
+		return err
+	}
+	err = userdata.rotateRecoveryKey(userVDKey)
+	if err != nil {
+		return err
+	}
+	return userdata.storeUser(userPtr, newPassword)
+}
 
-		// Content id list enc and store
-		idList := []userlib.UUID{encContentPtr}
-		marshalIdList, err := userlib.Marshal(idList)
+// Whoever unwrapped the old recovery key may keep it, so each recovery
+// moves to a new one: the codes left wrap it again and the trustees get
+// new shares. The recovery copy follows when the user is stored.
+func (userdata *User) rotateRecoveryKey(userVDKey []userlib.DSVerifyKey) error {
+	if userdata.RecoveryKey == nil {
+		return nil
+	}
+	userdata.RecoveryKey = userlib.RandomBytes(16)
+	var left []userlib.UUID
+	for _, codePtr := range userdata.RecoveryCodePtrs {
+		codeKey, ok := userdata.RecoveryCodeKeys[codePtr]
+		if !ok {
+			// Made before the code keys were kept, it cannot follow
+			userdata.datastoreDelete(codePtr)
+			continue
+		}
+		err := userdata.storeRecoveryWrap(codePtr, codeKey)
 		if err != nil {
 			return err
 		}
-		encIdList := symEnc(fileKey, marshalIdList)
-		newFileInfo.ContentUUIDListPtr = newID() // Assign
-		hmacDatastoreSet(newFileInfo.ContentUUIDListPtr, encIdList)
+		left = append(left, codePtr)
+	}
+	userdata.RecoveryCodePtrs = left
 
-		// Owner is user
-		newFileInfo.Owner = userdata.Username // Assign
+	if len(userdata.RecoveryTrustees) == 0 {
+		return nil
+	}
+	social, err := userdata.getSocialRecovery(userdata.Username, userVDKey)
+	if err != nil {
+		return err
+	}
+	return userdata.splitRecoveryKey(userdata.RecoveryTrustees, social.Threshold, true)
+}
 
-		// TreeNode
-		newFileInfo.TreeNodeKey = userlib.RandomBytes(16) // Assign
+// *********** Social recovery **************
+// SocialRecovery is public and signed by the user, so a recovering user
+// knows whom to ask. Wrap seals the recovery key under the shared secret.
+type SocialRecovery struct {
+	Threshold int
+	Trustees []string
+	Wrap []byte
+}
+
+// RecoveryRequest stays with the recovering user. Ptr goes to the trustees
+// out of band, the same way invitation pointers do.
+type RecoveryRequest struct {
+	Username string
+	Ptr userlib.UUID
+	Key userlib.PKEDecKey
+}
+
+// the published half of a request, addressed by its own hash
+type recoveryRequestRecord struct {
+	Username string
+	PubKey userlib.PKEEncKey
+}
+
+func socialRecoveryPtr(username string) (userlib.UUID, error) {
+	return userlib.UUIDFromBytes(userlib.Hash([]byte("SOCIAL" + username))[:16])
+}
+func sharePtr(username string, trustee string) (userlib.UUID, error) {
+	return userlib.UUIDFromBytes(userlib.Hash(append([]byte("SHARE"), deviceID(username, trustee)...))[:16])
+}
+func approvalPtr(requestPtr userlib.UUID, trustee string) (userlib.UUID, error) {
+	return userlib.UUIDFromBytes(userlib.Hash(append(append([]byte("APPROVAL"), requestPtr[:]...), trustee...))[:16])
+}
+
+// GF(2^8) with the AES polynomial
+func gfMul(a byte, b byte) byte {
+	var p byte
+	for b != 0 {
+		if b & 1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return p
+}
+// a^254 is a^-1
+func gfInv(a byte) byte {
+	inv := byte(1)
+	for i := 0; i < 254; i++ {
+		inv = gfMul(inv, a)
+	}
+	return inv
+}
+
+// Shamir shares of secret, byte by byte. A share is x followed by the
+// polynomials at x, the secret sits at x = 0.
+func splitSecret(secret []byte, n int, k int) [][]byte {
+	coeffs := userlib.RandomBytes(len(secret) * (k - 1))
+	shares := make([][]byte, n)
+	for i := range shares {
+		x := byte(i + 1)
+		share := []byte{x}
+		for j, s := range secret {
+			var y byte
+			for c := k - 1; c >= 1; c-- {
+				y = gfMul(y ^ coeffs[j * (k - 1) + c - 1], x)
+			}
+			share = append(share, y ^ s)
+		}
+		shares[i] = share
+	}
+	return shares
+}
+// Lagrange at x = 0, subtraction is xor
+func combineShares(shares [][]byte) ([]byte, error) {
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if len(share) != len(shares[0]) || len(share) < 2 || share[0] == 0 || seen[share[0]] {
+			return nil, re("Bad share.")
+		}
+		seen[share[0]] = true
+	}
+	secret := make([]byte, len(shares[0]) - 1)
+	for i, share := range shares {
+		weight := byte(1)
+		for m, other := range shares {
+			if m != i {
+				weight = gfMul(weight, gfMul(other[0], gfInv(other[0] ^ share[0])))
+			}
+		}
+		for j := range secret {
+			secret[j] ^= gfMul(weight, share[j + 1])
+		}
+	}
+	return secret, nil
+}
 
-		var treeNode TreeNode
-		treeNode.UsernameToTreeNodeKey = make(map[string][]byte)
-		treeNode.UsernameToTreeNodePtr = make(map[string]userlib.UUID)
-		treeNode.FileKeyPtr = newFileInfo.FileKeyPtr
-		marshalTreeNode, err := userlib.Marshal(treeNode)
+func (userdata *User) deleteShares(trustees []string) error {
+	for _, trustee := range trustees {
+		id, err := sharePtr(userdata.Username, trustee)
 		if err != nil {
 			return err
 		}
-		encTreeNode := symEnc(newFileInfo.TreeNodeKey, marshalTreeNode)
-		dsEncTreeNode, err := dsEnc(userdata.DKey, encTreeNode)
+		userdata.datastoreDelete(id)
+	}
+	return nil
+}
+
+// SetupSocialRecovery splits a fresh secret among trustees, any threshold of
+// whom can later approve a reset together. Running it again replaces the
+// trustees, and shares handed out before stop working.
+func (userdata *User) SetupSocialRecovery(password string, trustees []string, threshold int) (err error) {
+	defer userdata.transaction()(&err)
+	if userdata.Device != "" {
+		return re("Needs a password login.")
+	}
+	userPtr, err := userdata.checkPassword(password)
+	if err != nil {
+		return err
+	}
+	if threshold < 1 || threshold > len(trustees) || len(trustees) > 255 {
+		return re("Bad threshold.")
+	}
+	for i, trustee := range trustees {
+		if trustee == userdata.Username || containsName(trustees[:i], trustee) {
+			return re("Bad trustee " + trustee + ".")
+		}
+		err = userdata.checkContact(trustee)
 		if err != nil {
 			return err
 		}
-		newFileInfo.TreeNodePtr = newID()
-		hmacDatastoreSet(newFileInfo.TreeNodePtr, dsEncTreeNode)
+	}
 
-		// Add new file info to the map
-		newFileInfoMap, err := addFileInfo(filename, fileInfoMap, newFileInfo)
+	if userdata.RecoveryKey == nil {
+		userdata.RecoveryKey = userlib.RandomBytes(16)
+	}
+	err = userdata.splitRecoveryKey(trustees, threshold, false)
+	if err != nil {
+		return err
+	}
+	return userdata.storeUser(userPtr, password)
+}
+
+// wrap the recovery key under a fresh secret and split that among the
+// trustees. A trustee who cannot be sealed to any more is skipped when
+// lenient, the others may still reach the threshold.
+func (userdata *User) splitRecoveryKey(trustees []string, threshold int, lenient bool) error {
+	secret := userlib.RandomBytes(16)
+	social := SocialRecovery{threshold, trustees, symEnc(secret, userdata.RecoveryKey)}
+
+	// Each share is sealed to its trustee and signed by us
+	err := userdata.deleteShares(userdata.RecoveryTrustees)
+	if err != nil {
+		return err
+	}
+	for i, share := range splitSecret(secret, len(trustees), threshold) {
+		encShare, err := userdata.pkeEncToUser(trustees[i], share)
+		if err != nil && lenient {
+			continue
+		}
 		if err != nil {
 			return err
 		}
-		marshalNewFileInfoMap, err := userlib.Marshal(newFileInfoMap)
+		dsEncShare, err := dsEnc(userdata.DKey, encShare)
 		if err != nil {
 			return err
 		}
-		encNewFileInfoMap := symEnc(userlib.Hash([]byte(userdata.Username))[:16], marshalNewFileInfoMap)
-		dsEncNewFileInfoMap, err := dsEnc(userdata.DKey, encNewFileInfoMap)
+		id, err := sharePtr(userdata.Username, trustees[i])
 		if err != nil {
 			return err
 		}
-		hmacDatastoreSet(userdata.EncFileNameToFileInfoPtr, dsEncNewFileInfoMap)
+		userdata.hmacDatastoreSet(id, dsEncShare)
+	}
+
+	marshalSocial, err := userlib.Marshal(social)
+	if err != nil {
+		return err
+	}
+	dsEncSocial, err := dsEnc(userdata.DKey, marshalSocial)
+	if err != nil {
+		return err
+	}
+	socialPtr, err := socialRecoveryPtr(userdata.Username)
+	if err != nil {
+		return err
 	}
+	userdata.hmacDatastoreSet(socialPtr, dsEncSocial)
+	userdata.RecoveryTrustees = append([]string{}, trustees...)
 	return nil
 }
+// the user's published trustees and threshold
+func (userdata *User) getSocialRecovery(username string, userVDKey []userlib.DSVerifyKey) (SocialRecovery, error) {
+	var social SocialRecovery
+	socialPtr, err := socialRecoveryPtr(username)
+	if err != nil {
+		return social, err
+	}
+	marshalSocial, err := userdata.dsDec(userVDKey, socialPtr)
+	if err != nil {
+		return social, re(username + " has no trustees.")
+	}
+	err = userlib.Unmarshal(marshalSocial, &social)
+	return social, err
+}
 
-func (userdata *User) AppendToFile(filename string, content []byte) error {
-	// Get the fileInfoMap First
-	fileInfoMap, userVDKey, err := getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+// RequestRecovery starts a reset for username with a one-off key pair.
+// Hand request.Ptr to the trustees.
+func RequestRecovery(username string) (request RecoveryRequest, err error) {
+	return userlibClient.RequestRecovery(username)
+}
+// RequestRecovery is the package's RequestRecovery, on the client's backend.
+func (c *Client) RequestRecovery(username string) (request RecoveryRequest, err error) {
+	userdata := User{backend: c.backend}
+	defer userdata.reportBackend(&err)
+	if userdata.accountDeleted(username) {
+		return request, re(username + " deleted their account.")
+	}
+	pubKey, privKey, err := userlib.PKEKeyGen()
 	if err != nil {
-		return err
+		return request, err
+	}
+	marshalRecord, err := userlib.Marshal(recoveryRequestRecord{username, pubKey})
+	if err != nil {
+		return request, err
+	}
+	requestPtr, err := userlib.UUIDFromBytes(userlib.Hash(marshalRecord)[:16])
+	if err != nil {
+		return request, err
 	}
+	userdata.hmacDatastoreSet(requestPtr, marshalRecord)
+	return RecoveryRequest{username, requestPtr, privKey}, nil
+}
 
-	// Check if user have the file
-	fileInfo, exist := getFileInfo(filename, fileInfoMap)
-	if !exist {
-		return re("DNE file so cannot append.")
+// ApproveRecovery passes our share of username's secret on to the request.
+// Only approve a pointer that reached you from username out of band.
+func (userdata *User) ApproveRecovery(username string, requestPtr userlib.UUID) (err error) {
+	defer userdata.reportBackend(&err)
+	marshalRecord, ok := userdata.hmacDatastoreGet(requestPtr)
+	if !ok {
+		return re("The request DNE.")
+	}
+	hashPtr, err := userlib.UUIDFromBytes(userlib.Hash(marshalRecord)[:16])
+	if err != nil || hashPtr != requestPtr {
+		return re("Request been modified by unknown.")
+	}
+	var record recoveryRequestRecord
+	err = userlib.Unmarshal(marshalRecord, &record)
+	if err != nil || record.Username != username {
+		return re("The request is not from " + username + ".")
 	}
 
-	// This file can be accessed by me and the owner
-	ownerVDKey, err := getDSVerify(fileInfo.Owner)
+	// Our share, signed by them
+	err = userdata.checkContact(username)
 	if err != nil {
 		return err
 	}
-	dsKeys := []userlib.DSVerifyKey{ownerVDKey, userVDKey}
-
-	// Get the file key for later encryption
-	fileKey, err := getFileKey(dsKeys, userdata.PKey, fileInfo.FileKeyPtr)
+	userVDKey, err := userdata.getDSVerify(username)
 	if err != nil {
 		return err
 	}
-
-	// verify old data see if anyone damage it
-	_, err = getEncDS(dsKeys, fileInfo.TreeNodePtr) // treenode
+	id, err := sharePtr(username, userdata.Username)
 	if err != nil {
 		return err
 	}
-	_,_, err = getEncContentList(fileKey, fileInfo.ContentUUIDListPtr, false) // prev content
+	encShare, err := userdata.dsDec(userVDKey, id)
+	if err != nil {
+		return re("No share from " + username + ".")
+	}
+	share, err := userdata.pkeDec(encShare)
 	if err != nil {
 		return err
 	}
 
-	// Get the content list uuid list
-	encIdList, ok := hmacDatastoreGet(fileInfo.ContentUUIDListPtr)
-	if !ok {
-		return re("No content list data.")
+	encApproval, err := userlib.PKEEnc(record.PubKey, share)
+	if err != nil {
+		return err
 	}
-	marshalIdList, err := symDec(fileKey, encIdList)
-	var idList []userlib.UUID
-	err = userlib.Unmarshal(marshalIdList, &idList)
+	dsEncApproval, err := dsEnc(userdata.DKey, encApproval)
 	if err != nil {
 		return err
 	}
-
-	// Append the newest one to the end of the list
-	idList = append(idList, newID())
-
-	// Encrypt the content
-	encContent := symEnc(fileKey, content)
-	hmacDatastoreSet(idList[len(idList)-1], encContent)
-
-	// Store new idList
-	marshalIdList, err = userlib.Marshal(idList)
+	id, err = approvalPtr(requestPtr, userdata.Username)
 	if err != nil {
 		return err
 	}
-	encIdList = symEnc(fileKey, marshalIdList)
-	hmacDatastoreSet(fileInfo.ContentUUIDListPtr, encIdList)
-
+	userdata.hmacDatastoreSet(id, dsEncApproval)
 	return nil
 }
 
-func (userdata *User) LoadFile(filename string) (content []byte, err error) {
-	// Get the fileInfoMap First
-	fileInfoMap, userVDKey, err := getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+// CompleteRecovery logs in once enough trustees approved the request, and
+// sets newPassword. The trustees get new shares of a new recovery key.
+func CompleteRecovery(request RecoveryRequest, newPassword string) (userdataptr *User, err error) {
+	return userlibClient.CompleteRecovery(request, newPassword)
+}
+// CompleteRecovery is the package's CompleteRecovery, on the client's backend.
+func (c *Client) CompleteRecovery(request RecoveryRequest, newPassword string) (userdataptr *User, err error) {
+	userdata := User{backend: c.backend}
+	defer userdata.reportBackend(&err)
+	username := request.Username
+	if userdata.accountDeleted(username) {
+		return nil, re(username + " deleted their account.")
+	}
+	userVDKey, err := userdata.getDSVerify(username)
 	if err != nil {
 		return nil, err
 	}
-
-	// Check if user have the file
-	fileInfo, exist := getFileInfo(filename, fileInfoMap)
-	if !exist {
-		return nil, re("DNE file.")
-	}
-
-	// This file can be accessed by me and the owner
-	ownerVDKey, err := getDSVerify(fileInfo.Owner)
+	social, err := userdata.getSocialRecovery(username, userVDKey)
 	if err != nil {
 		return nil, err
 	}
-	dsKeys := []userlib.DSVerifyKey{ownerVDKey, userVDKey}
 
-	// Get the file key for later encryption
-	fileKey, err := getFileKey(dsKeys, userdata.PKey, fileInfo.FileKeyPtr)
+	// Gather approvals until the threshold
+	var shares [][]byte
+	var approvals []userlib.UUID
+	for _, trustee := range social.Trustees {
+		if len(shares) == social.Threshold {
+			break
+		}
+		if userdata.accountDeleted(trustee) {
+			continue
+		}
+		trusteeVDKey, err := userdata.getDSVerify(trustee)
+		if err != nil {
+			continue
+		}
+		id, err := approvalPtr(request.Ptr, trustee)
+		if err != nil {
+			return nil, err
+		}
+		encShare, err := userdata.dsDec(trusteeVDKey, id)
+		if err != nil {
+			continue
+		}
+		share, err := userlib.PKEDec(request.Key, encShare)
+		if err != nil {
+			continue
+		}
+		shares = append(shares, share)
+		approvals = append(approvals, id)
+	}
+	if len(shares) < social.Threshold {
+		return nil, re("Not enough trustees approved.")
+	}
+	secret, err := combineShares(shares)
 	if err != nil {
 		return nil, err
 	}
+	recoveryKey, err := symDec(secret, social.Wrap)
+	if err != nil {
+		return nil, re("A trustee sent a bad share.")
+	}
 
-	// verify old data tree node see if anyone damage it
-	_, err = getEncDS(dsKeys, fileInfo.TreeNodePtr) // treenode
+	err = userdata.openRecoveryCopy(username, userVDKey, recoveryKey)
 	if err != nil {
 		return nil, err
 	}
-	encContentList, _, err := getEncContentList(fileKey, fileInfo.ContentUUIDListPtr, false) // prev content
+	for _, id := range approvals {
+		userdata.datastoreDelete(id)
+	}
+	userdata.datastoreDelete(request.Ptr)
+	err = userdata.resetPassword(userVDKey, newPassword)
 	if err != nil {
 		return nil, err
 	}
+	return &userdata, nil
+}
 
-	fContent := []byte{}
-	for i := 0; i < len(encContentList); i++ {
-		rawContent, err := symDec(fileKey, encContentList[i])
-		if err != nil {
-			return nil, err
-		}
-		fContent = append(fContent, rawContent...)
-	}
-	return fContent, nil
+// *********** Contacts **************
+// Contact pins the keys we first saw for a user. Later keys are accepted
+// only through rotations signed by pinned ones.
+type Contact struct {
+	Fingerprints []string // One per key version, oldest first
+	Verified bool // Checked out of band
 }
 
-func (userdata *User) CreateInvitation(filename string, recipientUsername string) (
-	invitationPtr userlib.UUID, err error) {
-	invitationPtr = newID()
-	// Get the fileInfoMap First
-	fileInfoMap, userVDKey, err := getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+func (userdata *User) getContacts() (map[string]Contact, error) {
+	verifyDKey, err := userdata.getDSVerify(userdata.Username)
 	if err != nil {
-		return invitationPtr, re("1")
+		return nil, err
 	}
-
-	// Check if user have the file
-	fileInfo, exist := getFileInfo(filename, fileInfoMap)
-	if !exist {
-		return invitationPtr, re("DNE file.2")
+	encContacts, err := userdata.dsDec(verifyDKey, userdata.ContactsPtr)
+	if err != nil {
+		return nil, re("Contact book been modified.")
 	}
-
-	// Get the file key
-	ownerVDKey, err := getDSVerify(fileInfo.Owner)
+	marshalContacts, err := symDec(userdata.ContactsKey, encContacts)
 	if err != nil {
-		return invitationPtr, re("3")
+		return nil, err
 	}
-	dsKeys := []userlib.DSVerifyKey{ownerVDKey, userVDKey}
-	fileKey, err := getFileKey(dsKeys, userdata.PKey, fileInfo.FileKeyPtr)
+	var contacts map[string]Contact
+	err = userlib.Unmarshal(marshalContacts, &contacts)
 	if err != nil {
-		return invitationPtr, re("4")
+		return nil, err
 	}
-
-	// verify old data see if anyone damage it
-	encTreeNode, err := getEncDS(dsKeys, fileInfo.TreeNodePtr) // treenode
+	return contacts, nil
+}
+func (userdata *User) storeContacts(contacts map[string]Contact) error {
+	marshalContacts, err := userlib.Marshal(contacts)
 	if err != nil {
-		return invitationPtr, re("5")
+		return err
 	}
-	_,_, err = getEncContentList(fileKey, fileInfo.ContentUUIDListPtr, false) // prev content
+	dsEncContacts, err := dsEnc(userdata.DKey, symEnc(userdata.ContactsKey, marshalContacts))
 	if err != nil {
-		return invitationPtr, re("6")
+		return err
 	}
+	userdata.hmacDatastoreSet(userdata.ContactsPtr, dsEncContacts)
+	return nil
+}
 
-	// Check if the recipient already accessible
-	marshalTreeNode, err := symDec(fileInfo.TreeNodeKey, encTreeNode)
+// one fingerprint per version of the user's keys
+func (userdata *User) chainFingerprints(username string) ([]string, error) {
+	dsKeys, pkeKeys, err := userdata.getKeyChain(username)
 	if err != nil {
-		return invitationPtr, re("7")
-	}
-	var treeNodeHost TreeNode
-	err = userlib.Unmarshal(marshalTreeNode, &treeNodeHost)
-	if len(treeNodeHost.UsernameToTreeNodePtr) != len(treeNodeHost.UsernameToTreeNodeKey) {
-		return invitationPtr, re("The inheritance relation is messed up.8")
+		return nil, err
 	}
-	_, exist = treeNodeHost.UsernameToTreeNodePtr[recipientUsername]
-	if exist {
-		return invitationPtr, re(recipientUsername + "Already accessible.9")
+	if len(pkeKeys) != len(dsKeys) {
+		return nil, re(username + " has no public PKE key.")
 	}
-	_, exist = treeNodeHost.UsernameToTreeNodeKey[recipientUsername]
-	if exist {
-		return invitationPtr, re("The inheritance relation is messed up since some keymap ptrmap have difference keys.10")
+	var fingerprints []string
+	for i := range dsKeys {
+		fingerprint := userlib.Hash([]byte(keyFingerprint(dsKeys[i]) + keyFingerprint(pkeKeys[i])))
+		fingerprints = append(fingerprints, hex.EncodeToString(fingerprint[:16]))
 	}
+	return fingerprints, nil
+}
 
-	// New a fileInfo struct for the recipient
-	var newFileInfo FileInfo
-	newFileInfo.ContentUUIDListPtr = fileInfo.ContentUUIDListPtr // Assign
-	newFileInfo.Owner = fileInfo.Owner // Assign
-	newFileInfo.FileKeyPtr = newID() // Assign
-	newFileInfo.TreeNodePtr = newID() // Assign
-	newFileInfo.TreeNodeKey = userlib.RandomBytes(16) // Assign
-
-	// Complete the file info abstract struct (including thing it points to)
-	// filekey
-	recipientPKey, err := getPKEPublic(recipientUsername)
-	if err != nil {
-		return invitationPtr, re("11No public PKE key for " + recipientUsername)
+// pin username's keys on first use, and fail if they changed since
+func (userdata *User) checkContact(username string) error {
+	if username == userdata.Username {
+		return nil
 	}
-	encNewFileKey, err := userlib.PKEEnc(recipientPKey, fileKey)
+	fingerprints, err := userdata.chainFingerprints(username)
 	if err != nil {
-		return invitationPtr, re("12New file key PKE Encryption failed.")
+		return err
 	}
-	dsEncNewFileKey, err := dsEnc(userdata.DKey, encNewFileKey)
+	contacts, err := userdata.getContacts()
 	if err != nil {
-		return invitationPtr, re("13New file key DS Encryption failed.")
+		return err
 	}
-	hmacDatastoreSet(newFileInfo.FileKeyPtr, dsEncNewFileKey)
-	// treenode
-	var newTreeNode TreeNode
-	newTreeNode.UsernameToTreeNodePtr = make(map[string]userlib.UUID)
-	newTreeNode.UsernameToTreeNodeKey = make(map[string][]byte)
-	newTreeNode.FileKeyPtr = newFileInfo.FileKeyPtr
-	marshalNewTreeNode, err := userlib.Marshal(newTreeNode)
-	if err != nil {
-		return invitationPtr, re("14")
+	contact, ok := contacts[username]
+	if ok {
+		if len(fingerprints) < len(contact.Fingerprints) {
+			return re(username + "'s keys changed, check their fingerprint.")
+		}
+		for i := range contact.Fingerprints {
+			if fingerprints[i] != contact.Fingerprints[i] {
+				return re(username + "'s keys changed, check their fingerprint.")
+			}
+		}
+		if len(fingerprints) == len(contact.Fingerprints) {
+			return nil
+		}
 	}
-	encNewTreeNode := symEnc(newFileInfo.TreeNodeKey, marshalNewTreeNode)
-	dsEncNewTreeNode, err := dsEnc(userdata.DKey, encNewTreeNode)
+	contact.Fingerprints = fingerprints
+	contacts[username] = contact
+	return userdata.storeContacts(contacts)
+}
+
+// Fingerprint is the fingerprint of username's first keys, to compare out
+// of band. Every later key is vouched for by the ones before it.
+func (userdata *User) Fingerprint(username string) (fingerprint string, err error) {
+	defer userdata.reportBackend(&err)
+	fingerprints, err := userdata.chainFingerprints(username)
 	if err != nil {
-		return invitationPtr, re("15")
+		return "", err
 	}
-	hmacDatastoreSet(newFileInfo.TreeNodePtr, dsEncNewTreeNode)
+	return fingerprints[0], nil
+}
 
-	treeNodeHost.UsernameToTreeNodeKey[recipientUsername] = newFileInfo.TreeNodeKey
-	treeNodeHost.UsernameToTreeNodePtr[recipientUsername] = newFileInfo.TreeNodePtr
-	marshalTreeNodeHost, err := userlib.Marshal(treeNodeHost)
+// VerifyContact pins username's current keys once fingerprint was checked
+// out of band. This is also how to accept keys that changed.
+func (userdata *User) VerifyContact(username string, fingerprint string) (err error) {
+	defer userdata.transaction()(&err)
+	fingerprints, err := userdata.chainFingerprints(username)
 	if err != nil {
-		return invitationPtr, re("16")
+		return err
+	}
+	if fingerprints[0] != fingerprint {
+		return re("Fingerprint does not match " + username + "'s keys.")
 	}
-	encTreeNodeHost := symEnc(fileInfo.TreeNodeKey, marshalTreeNodeHost)
-	dsEncTreeNodeHost, err := dsEnc(userdata.DKey, encTreeNodeHost)
+	contacts, err := userdata.getContacts()
 	if err != nil {
-		return invitationPtr, re("17")
+		return err
 	}
-	hmacDatastoreSet(fileInfo.TreeNodePtr, dsEncTreeNodeHost)
+	contacts[username] = Contact{fingerprints, true}
+	return userdata.storeContacts(contacts)
+}
 
-	// Store new File info struct
-	keyForNewFileInfo := userlib.RandomBytes(16)
-	marshalNewFileInfo, err := userlib.Marshal(newFileInfo)
+// ListContacts gives every pinned contact and whether they were verified.
+func (userdata *User) ListContacts() (verified map[string]bool, err error) {
+	defer userdata.reportBackend(&err)
+	contacts, err := userdata.getContacts()
 	if err != nil {
-		return invitationPtr, re("18")
+		return nil, err
 	}
-	encNewFileInfo := symEnc(keyForNewFileInfo, marshalNewFileInfo)
-	dsEncNewFileInfo, err := dsEnc(userdata.DKey, encNewFileInfo)
-	uuidForNewFileInfo := newID()
-	hmacDatastoreSet(uuidForNewFileInfo, dsEncNewFileInfo)
+	verified = make(map[string]bool)
+	for username, contact := range contacts {
+		verified[username] = contact.Verified
+	}
+	return verified, nil
+}
 
-	// Generate the invitation ptr record
-	byteUUIdForNewFileInfo := make([]byte, 16)
-	for i := 0; i < 16; i++ {
-		byteUUIdForNewFileInfo[i] = uuidForNewFileInfo[i]
+// *********** Dedup **************
+// FileOptions are per StoreFileWithOptions.
+//
+// Dedup stores the content in convergent chunks of dedupChunkLen bytes: each
+// chunk is encrypted under a key derived from its own content and stored at
+// a location derived from that key, so equal chunks in any user's dedup
+// files take up the space once. This leaks:
+//   - which dedup files, of any users, share a chunk, by their header
+//     pointers, to anyone who can read the datastore: each reference is
+//     the chunk and header pointer in plaintext, at slots anyone can find
+//     from the chunk pointer
+//   - how many files reference each chunk, by counting those slots
+//   - whether a guessed chunk is stored at all, to anyone who can guess it
+//   - file length in whole chunks
+//   - chunks a revoked user has seen, while the file still holds them, since
+//     a revoke does not re-encrypt convergent chunks
+//
+// The references are not signed or keyed to any user, so anyone who can
+// write the datastore can add, rewrite or remove them: an added one keeps
+// a chunk around, a removed one lets the last file to let go delete a
+// chunk another file still uses.
+//
+// Compress runs each chunk through compress before it is encrypted. The
+// result is padded up to a power of two, so the stored size only tells
+// which bucket the compressed size falls in.
+type FileOptions struct {
+	Dedup bool
+	Compress bool
+}
+
+const dedupChunkLen = 4096
+
+func dedupChunkPtr(key []byte) (userlib.UUID, error) {
+	return userlib.UUIDFromBytes(userlib.Hash(append([]byte("DEDUPID"), key...))[:16])
+}
+// dedupRef is one reference of a file to a convergent chunk. A chunk's
+// references fill slots 0, 1, ... with no gaps; each file only ever adds or
+// takes away its own, so there is no shared count to forge. A slot that
+// does not parse still counts, so rewriting one can only keep a chunk
+// around; removing slots is not caught, see FileOptions.
+type dedupRef struct {
+	Chunk userlib.UUID
+	File userlib.UUID // header of the referencing file
+}
+
+func dedupRefPtr(id userlib.UUID, slot int) (userlib.UUID, error) {
+	return userlib.UUIDFromBytes(userlib.Hash([]byte(fmt.Sprintf("DEDUPREF%d:%s", slot, id.String())))[:16])
+}
+// the chunk's reference slots in order, what does not parse is left zero
+func (userdata *User) getDedupRefs(id userlib.UUID) ([]userlib.UUID, []dedupRef, error) {
+	var ptrs []userlib.UUID
+	var refs []dedupRef
+	for slot := 0; ; slot++ {
+		refPtr, err := dedupRefPtr(id, slot)
+		if err != nil {
+			return nil, nil, err
+		}
+		stored, ok := userdata.journalGet(refPtr)
+		if !ok {
+			return ptrs, refs, nil
+		}
+		var ref dedupRef
+		content, ok := hmacOpen(refPtr, stored)
+		if !ok || userlib.Unmarshal(content, &ref) != nil || ref.Chunk != id {
+			ref = dedupRef{}
+		}
+		ptrs = append(ptrs, refPtr)
+		refs = append(refs, ref)
 	}
-	inviContent := append(byteUUIdForNewFileInfo, keyForNewFileInfo...)
-	pkeEncInviContent, err := userlib.PKEEnc(recipientPKey, inviContent)
+}
+func (userdata *User) addDedupRef(id userlib.UUID, fileID userlib.UUID) error {
+	ptrs, _, err := userdata.getDedupRefs(id)
 	if err != nil {
-		return invitationPtr, re("19")
+		return err
 	}
-	dsPKEEncInviContent, err := dsEnc(userdata.DKey, pkeEncInviContent)
+	refPtr, err := dedupRefPtr(id, len(ptrs))
 	if err != nil {
-		return invitationPtr, re("20")
+		return err
 	}
-
-	// Store the invitation info
-	hmacDatastoreSet(invitationPtr, dsPKEEncInviContent)
-
-	return invitationPtr, nil
+	marshalRef, err := userlib.Marshal(dedupRef{id, fileID})
+	if err != nil {
+		return err
+	}
+	userdata.hmacDatastoreSet(refPtr, marshalRef)
+	return nil
 }
-
-func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr userlib.UUID, filename string) error {
-	// Sender VDKey
-	senderVDKey, err := getDSVerify(senderUsername)
+// take away one of the file's references, the last slot moves into its
+// place. Reports whether any reference is left.
+func (userdata *User) releaseDedupRef(id userlib.UUID, fileID userlib.UUID) (bool, error) {
+	ptrs, refs, err := userdata.getDedupRefs(id)
 	if err != nil {
-		return re("1")
+		return true, err
+	}
+	for i := range refs {
+		if refs[i].File != fileID {
+			continue
+		}
+		last := len(ptrs) - 1
+		if i != last {
+			// A damaged slot moves as it is, so it still counts
+			stored, _ := userdata.journalGet(ptrs[last])
+			content, ok := hmacOpen(ptrs[last], stored)
+			if ok {
+				userdata.hmacDatastoreSet(ptrs[i], content)
+			} else {
+				userdata.journalSet(ptrs[i], stored)
+			}
+		}
+		userdata.datastoreDelete(ptrs[last])
+		return last > 0, nil
 	}
+	// Not ours to take, whatever is there stays
+	return len(ptrs) > 0, nil
+}
 
-	// If exist such invitation, if so ds dec
-	pkeEncInviConent, err := dsDec(senderVDKey, invitationPtr)
+// store one convergent chunk, or take another reference to it
+func (userdata *User) storeDedupChunk(fileID userlib.UUID, content []byte) (ChunkRef, error) {
+	key := userlib.Hash(append([]byte("DEDUPKEY"), content...))[:16]
+	id, err := dedupChunkPtr(key)
 	if err != nil {
-		return re("2The invitation DNE.")
+		return ChunkRef{}, err
+	}
+	// Same content, same key and iv, same bytes
+	iv := userlib.Hash(append([]byte("DEDUPIV"), key...))[:16]
+	encContent := symEncIV(key, iv, append([]byte{}, content...))
+	ref := ChunkRef{ID: id, Hash: userlib.Hash(encContent), Key: key}
+	stored, ok := userdata.hmacDatastoreGet(id)
+	if !ok || !userlib.HMACEqual(userlib.Hash(stored), ref.Hash) {
+		userdata.hmacDatastoreSet(id, encContent)
 	}
+	return ref, userdata.addDedupRef(id, fileID)
+}
 
-	// Delete the invitation ptr since we got its content
-	userlib.DatastoreDelete(invitationPtr)
+// enc content into new chunks as the options say, signed by the user
+func (userdata *User) storeChunks(keys fileKeys, fileID userlib.UUID, seq int, content []byte, options FileOptions) ([]ChunkRef, error) {
+	pieceLen := len(content) + 1
+	if options.Dedup {
+		pieceLen = dedupChunkLen
+	}
+	var chunks []ChunkRef
+	// One piece at least, so empty content still has a chunk
+	for start := 0; start == 0 || start < len(content); start += pieceLen {
+		end := start + pieceLen
+		if end > len(content) {
+			end = len(content)
+		}
+		piece := content[start:end]
+		if options.Compress {
+			piece = packCompressed(piece)
+		}
+		var ref ChunkRef
+		if options.Dedup {
+			var err error
+			ref, err = userdata.storeDedupChunk(fileID, piece)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			ref = userdata.storeChunk(keys.FileKey, keys.Epoch, piece)
+		}
+		ref.Compressed = options.Compress
+		ref.Len = end - start
+		err := userdata.signChunk(&ref, fileID, content[start:end], seq)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, ref)
+	}
+	return chunks, nil
+}
 
-	// PKE dec invitation
-	inviContent, err := userlib.PKEDec(userdata.PKey, pkeEncInviConent)
-	if len(inviContent) != 32 {
-		return re("3")
+// drop chunks the file's content list no longer uses, convergent ones only
+// once nothing else references them
+func (userdata *User) releaseChunks(fileID userlib.UUID, chunks []ChunkRef) error {
+	for _, chunk := range chunks {
+		if chunk.Key == nil {
+			userdata.datastoreDelete(chunk.ID)
+			continue
+		}
+		used, err := userdata.releaseDedupRef(chunk.ID, fileID)
+		if err != nil {
+			return err
+		}
+		if !used {
+			userdata.datastoreDelete(chunk.ID)
+		}
+	}
+	return nil
+}
+
+// *********** Compression **************
+// An LZ77 stream of tokens. A control byte below 128 is followed by that
+// many plus one literal bytes. From 128 up it is a match of
+// control - 128 + minMatchLen bytes, at a two byte distance back.
+const minMatchLen = 4
+const maxMatchLen = 127 + minMatchLen
+const maxMatchDist = 65535
+
+func compress(content []byte) []byte {
+	var out []byte
+	table := make(map[uint32]int) // last position of each 4 bytes
+	literalStart := 0
+	flushLiterals := func(end int) {
+		for literalStart < end {
+			n := end - literalStart
+			if n > 128 {
+				n = 128
+			}
+			out = append(out, byte(n - 1))
+			out = append(out, content[literalStart:literalStart + n]...)
+			literalStart += n
+		}
+	}
+	for i := 0; i + minMatchLen <= len(content); {
+		h := uint32(content[i]) | uint32(content[i + 1]) << 8 | uint32(content[i + 2]) << 16 | uint32(content[i + 3]) << 24
+		candidate, ok := table[h]
+		table[h] = i
+		if !ok || i - candidate > maxMatchDist {
+			i++
+			continue
+		}
+		n := 0
+		for i + n < len(content) && n < maxMatchLen && content[candidate + n] == content[i + n] {
+			n++
+		}
+		if n < minMatchLen {
+			i++
+			continue
+		}
+		flushLiterals(i)
+		dist := i - candidate
+		out = append(out, byte(128 + n - minMatchLen), byte(dist >> 8), byte(dist))
+		i += n
+		literalStart = i
 	}
+	flushLiterals(len(content))
+	return out
+}
 
-	// Bytes uuid & symkey for fileinfo
-	var inviFileInfoPtr userlib.UUID
-	for i := 0; i < 16; i++ {
-		inviFileInfoPtr[i] = inviContent[i]
+func decompress(data []byte) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(data); {
+		control := int(data[i])
+		i++
+		if control < 128 {
+			n := control + 1
+			if i + n > len(data) {
+				return nil, re("Compressed content been modified.")
+			}
+			out = append(out, data[i:i + n]...)
+			i += n
+			continue
+		}
+		if i + 2 > len(data) {
+			return nil, re("Compressed content been modified.")
+		}
+		n := control - 128 + minMatchLen
+		dist := int(data[i]) << 8 | int(data[i + 1])
+		i += 2
+		if dist == 0 || dist > len(out) {
+			return nil, re("Compressed content been modified.")
+		}
+		// Byte by byte, a match may overlap what it copies
+		for j := 0; j < n; j++ {
+			out = append(out, out[len(out) - dist])
+		}
 	}
-	inviFileInfoKey := inviContent[16:32]
+	return out, nil
+}
 
-	// Get the inviFileInfo
-	encInviFileInfo, err := dsDec(senderVDKey, inviFileInfoPtr)
-	if err != nil {
-		return re("4")
+// compress, then pad up to a power of two behind a length prefix
+func packCompressed(content []byte) []byte {
+	compressed := compress(content)
+	n := len(compressed)
+	bucket := 16
+	for bucket < n + 4 {
+		bucket *= 2
 	}
-	marshalInvifileInfo, err  := symDec(inviFileInfoKey, encInviFileInfo)
-	if err != nil {
-		return re("5")
+	packed := make([]byte, bucket)
+	packed[0], packed[1], packed[2], packed[3] = byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)
+	copy(packed[4:], compressed)
+	return packed
+}
+func unpackCompressed(packed []byte) ([]byte, error) {
+	if len(packed) < 4 {
+		return nil, re("Compressed content been modified.")
 	}
-	var inviFileInfo FileInfo
-	err = userlib.Unmarshal(marshalInvifileInfo, &inviFileInfo)
-	if err != nil {
-		return re("6")
+	n := int(packed[0]) << 24 | int(packed[1]) << 16 | int(packed[2]) << 8 | int(packed[3])
+	if n < 0 || n > len(packed) - 4 {
+		return nil, re("Compressed content been modified.")
 	}
+	return decompress(packed[4:4 + n])
+}
 
-	// Delete invitation File info record
-	userlib.DatastoreDelete(inviFileInfoPtr)
+// *********** Blame **************
+// what a writer signs for each chunk they write
+type chunkClaim struct {
+	File userlib.UUID // header ptr, the same for every member
+	ContentHash []byte
+	Author string
+	Seq int
+}
 
-	// For later DS verify usage
-	ownerVDKey, err := getDSVerify(inviFileInfo.Owner)
+func chunkClaimContent(fileID userlib.UUID, ref ChunkRef) ([]byte, error) {
+	return userlib.Marshal(chunkClaim{fileID, ref.ContentHash, ref.Author, ref.Seq})
+}
+func (userdata *User) signChunk(ref *ChunkRef, fileID userlib.UUID, content []byte, seq int) error {
+	ref.Author = userdata.Username
+	ref.Seq = seq
+	ref.ContentHash = userlib.Hash(content)
+	marshalClaim, err := chunkClaimContent(fileID, *ref)
 	if err != nil {
-		return re("7")
+		return err
 	}
-	dsKeys := []userlib.DSVerifyKey{ownerVDKey, senderVDKey}
-
-	// Check FileKey and DS resign
-	fileKey, err := getFileKey(dsKeys, userdata.PKey, inviFileInfo.FileKeyPtr)
-	if len(fileKey) != 16 {
-		return re("8")
+	ref.AuthorSig, err = userlib.DSSign(userdata.DKey, marshalClaim)
+	if err != nil {
+		return re("Fail to sign chunk.")
 	}
-	pkeEncFileKey, err := verifyDSIntegrity(dsKeys, inviFileInfo.FileKeyPtr)
+	return nil
+}
+// the author signed chunk i for this file, and was not revoked by then; the
+// content is checked against the signed hash once decrypted
+func verifyChunkAuthor(header FileHeader, fileID userlib.UUID, list ContentList, i int, authorKeys []userlib.DSVerifyKey) error {
+	ref := list.Chunks[i]
+	marshalClaim, err := chunkClaimContent(fileID, ref)
 	if err != nil {
-		return re("9")
+		return err
 	}
-	dsEncFileKey, err := dsEnc(userdata.DKey, pkeEncFileKey)
+	err = verifyChainSig(ref.Author, authorKeys, marshalClaim, ref.AuthorSig)
 	if err != nil {
-		return re("10")
+		return re("Chunk not signed by its author.")
+	}
+	if revokedChunk(header, list, i) {
+		return re("Chunk written by " + ref.Author + " after their revocation.")
+	}
+	return nil
+}
+// chunk i was put in the list after its author was revoked
+func revokedChunk(header FileHeader, list ContentList, i int) bool {
+	revocation, ok := header.Revoked[list.Chunks[i].Author]
+	if !ok {
+		return false
 	}
-	hmacDatastoreSet(inviFileInfo.FileKeyPtr, dsEncFileKey)
+	return list.Version > revocation.Version || (list.Version == revocation.Version && i >= revocation.Len)
+}
 
-	// Check tree node and Ds resign
-	encInviTreeNode, err := getEncDS(dsKeys, inviFileInfo.TreeNodePtr)
+// sign again by the master key the chunks a device wrote into the file,
+// where the user may still sign the content list
+func (userdata *User) resignDeviceChunks(fileInfo FileInfo, userVDKey []userlib.DSVerifyKey, deviceVDKey userlib.DSVerifyKey) error {
+	ctx, err := userdata.openFile(fileInfo, userVDKey)
 	if err != nil {
-		return re("11")
+		return nil // Lost it already
 	}
-	marInviTreeNode, err := symDec(inviFileInfo.TreeNodeKey, encInviTreeNode)
+	signKey, write, err := getSignKey(ctx.Header, ctx.Keys)
 	if err != nil {
-		return re("12")
+		return nil // Read only, nothing we can sign
 	}
-	var inviTreeNode TreeNode
-	err = userlib.Unmarshal(marInviTreeNode, &inviTreeNode)
+	levels, err := merkleLevels(ctx.List.Chunks)
 	if err != nil {
-		return re("13")
+		return err
 	}
-	if inviTreeNode.UsernameToTreeNodePtr == nil || inviTreeNode.UsernameToTreeNodeKey == nil {
-		return re("14")
+	var ours []int
+	for i, ref := range ctx.List.Chunks {
+		if ref.Author == userdata.Username && (i >= ctx.List.BaseLen || write) {
+			ours = append(ours, i)
+		}
 	}
-	inviTreeNode.FileKeyPtr = inviFileInfo.FileKeyPtr
-	marInviTreeNode, err = userlib.Marshal(inviTreeNode)
+	rawContents, err := userdata.readChunks(ctx, levels, ours)
 	if err != nil {
-		return re("14")
+		return err
 	}
-	encInviTreeNode = symEnc(inviFileInfo.TreeNodeKey, marInviTreeNode)
-	dsEncInviTreeNode, err := dsEnc(userdata.DKey, encInviTreeNode)
+	changed := false
+	for pos, i := range ours {
+		ref := ctx.List.Chunks[i]
+		rawContent := rawContents[pos]
+		marshalClaim, err := chunkClaimContent(fileInfo.HeaderPtr, ref)
+		if err != nil {
+			return err
+		}
+		if userlib.DSVerify(deviceVDKey, marshalClaim, ref.AuthorSig) != nil {
+			continue
+		}
+		err = userdata.signChunk(&ctx.List.Chunks[i], fileInfo.HeaderPtr, rawContent, ref.Seq)
+		if err != nil {
+			return err
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	err = signContentList(&ctx.List, signKey, write)
 	if err != nil {
-		return re("15")
+		return err
 	}
-	hmacDatastoreSet(inviFileInfo.TreeNodePtr, dsEncInviTreeNode)
+	return userdata.storeContentList(ctx.Keys.FileKey, fileInfo.ContentUUIDListPtr, ctx.List)
+}
 
-	// Add the new fileInfo back to user fileMap
+// BlameRange is a run of file bytes from a single write.
+type BlameRange struct {
+	Start int
+	End int // exclusive
+	Author string
+	Seq int // of the write in the file's audit log
+}
+
+// Blame tells who wrote each part of the file and in which write, checking
+// every chunk against its author's signature.
+func (userdata *User) Blame(filename string) (ranges []BlameRange, err error) {
+	defer userdata.reportBackend(&err)
 	// Get the fileInfoMap First
-	fileInfoMap, _, err := getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	fileInfoMap, userVDKey, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
 	if err != nil {
-		return re("16")
+		return nil, err
 	}
 
 	// Check if user have the file
-	_, exist := getFileInfo(filename, fileInfoMap)
-	if exist {
-		return re("17The user has the file, cannot accept the invitation again.")
+	fileInfo, exist := getFileInfo(filename, fileInfoMap)
+	if !exist {
+		return nil, re("DNE file.")
 	}
 
-	// add this new file info to the user data
-	newFileInfoMap, err := addFileInfo(filename, fileInfoMap, inviFileInfo)
+	// Get the file keys, header and list, verifying along the way
+	ctx, err := userdata.openFile(fileInfo, userVDKey)
 	if err != nil {
-		return re("18")
+		return nil, err
 	}
-	marshalNewFileInfoMap, err := userlib.Marshal(newFileInfoMap)
+	levels, err := merkleLevels(ctx.List.Chunks)
 	if err != nil {
-		return re("19")
+		return nil, err
 	}
-	encNewFileInfoMap := symEnc(userlib.Hash([]byte(userdata.Username))[:16], marshalNewFileInfoMap)
-	dsEncNewFileInfoMap, err := dsEnc(userdata.DKey, encNewFileInfoMap)
+
+	// One range per write, the chunks of a write run together
+	indices := make([]int, len(ctx.List.Chunks))
+	for i := range indices {
+		indices[i] = i
+	}
+	rawContents, err := userdata.readChunks(ctx, levels, indices)
 	if err != nil {
-		return re("20")
+		return nil, err
+	}
+	start := 0
+	for i, rawContent := range rawContents {
+		ref := ctx.List.Chunks[i]
+		end := start + len(rawContent)
+		last := len(ranges) - 1
+		if last >= 0 && ranges[last].Author == ref.Author && ranges[last].Seq == ref.Seq {
+			ranges[last].End = end
+		} else if end > start {
+			ranges = append(ranges, BlameRange{start, end, ref.Author, ref.Seq})
+		}
+		start = end
 	}
-	hmacDatastoreSet(userdata.EncFileNameToFileInfoPtr, dsEncNewFileInfoMap)
+	return ranges, nil
+}
 
-	return nil
+// *********** Audit **************
+// AuditEntry is one event in the audit log of a file. Entry Seq sits at a
+// place derived from the file and Seq, signed by its actor and holding the
+// hash of the entry before it, so edits and gaps break the chain. Dropping
+// entries from the end is caught by every reader back to the last store or
+// append, which the content list signs, and by the owner back to the last
+// entry their file info pins.
+type AuditEntry struct {
+	File userlib.UUID // header ptr
+	Seq int
+	Actor string
+	Action string // store, append, invite, accept or revoke
+	Target string // who was invited, accepted from or revoked
+	ListVersion int // the content list the entry was logged against
+	ListLen int
+	PrevHash []byte
 }
 
-func (userdata *User) RevokeAccess(filename string, recipientUsername string) error {
-	//// Check self if is the owner of the file
-	// Get the fileInfoMap First
-	fileInfoMap, ownerVDKey, err := getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username) // The verify key will be used iif the user is the owner
+// an entry as stored, encrypted under the file key of Epoch
+type auditRecord struct {
+	Epoch int
+	EncEntry []byte // sym enc of a signedAudit
+}
+type signedAudit struct {
+	Entry []byte // marshaled AuditEntry, as signed and hashed
+	Sig []byte
+}
+
+func auditEntryPtr(fileID userlib.UUID, seq int) (userlib.UUID, error) {
+	return userlib.UUIDFromBytes(userlib.Hash([]byte(fmt.Sprintf("AUDIT%v:%d", fileID, seq)))[:16])
+}
+// entry seq of the log, false past its end
+func (userdata *User) readAuditRecord(keys fileKeys, fileID userlib.UUID, seq int) (signedAudit, bool, error) {
+	var signed signedAudit
+	id, err := auditEntryPtr(fileID, seq)
 	if err != nil {
-		return re("0")
+		return signed, false, err
 	}
-
-	// Check if user have the file
-	fileInfo, exist := getFileInfo(filename, fileInfoMap)
+	content, exist := userdata.journalGet(id)
 	if !exist {
-		return re("1You don't have the file.")
+		return signed, false, nil
 	}
-
-	// If not the owner return
-	if fileInfo.Owner != userdata.Username {
-		return re("2 Only fil owner can revoke.")
+	signed, err = openAuditRecord(keys, id, content)
+	return signed, err == nil, err
+}
+// the ids and records of the whole log, fetched in windows that grow, one
+// round trip each
+func (userdata *User) fetchAuditLog(fileID userlib.UUID) ([]userlib.UUID, [][]byte, error) {
+	var ids []userlib.UUID
+	var records [][]byte
+	for window := 16; ; window *= 2 {
+		from := len(ids)
+		var batch []userlib.UUID
+		for seq := from; seq < from + window; seq++ {
+			id, err := auditEntryPtr(fileID, seq)
+			if err != nil {
+				return nil, nil, err
+			}
+			batch = append(batch, id)
+		}
+		fetched, err := userdata.journalGetBatch(batch)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, id := range batch {
+			content, exist := fetched[id]
+			if !exist {
+				return ids, records, nil
+			}
+			ids = append(ids, id)
+			records = append(records, content)
+		}
 	}
-	dsKeys := []userlib.DSVerifyKey{ownerVDKey}
-
-	//// Expand the Tree Node & verify if the recipient in my tree node
-	// Expand the tree node
-	encInviTreeNode, err := getEncDS(dsKeys, fileInfo.TreeNodePtr)
+}
+// every entry of the log, oldest first
+func (userdata *User) readAuditLog(keys fileKeys, fileID userlib.UUID) ([]signedAudit, error) {
+	ids, records, err := userdata.fetchAuditLog(fileID)
 	if err != nil {
-		return re("3")
+		return nil, err
+	}
+	log := make([]signedAudit, len(ids))
+	for seq := range ids {
+		log[seq], err = openAuditRecord(keys, ids[seq], records[seq])
+		if err != nil {
+			return nil, err
+		}
 	}
-	marInviTreeNode, err := symDec(fileInfo.TreeNodeKey, encInviTreeNode)
+	return log, nil
+}
+func openAuditRecord(keys fileKeys, id userlib.UUID, content []byte) (signedAudit, error) {
+	var signed signedAudit
+	content, ok := hmacOpen(id, content)
+	if !ok {
+		return signed, re("Audit log been modified.")
+	}
+	var record auditRecord
+	err := userlib.Unmarshal(content, &record)
 	if err != nil {
-		return re("4")
+		return signed, re("Audit log been modified.")
 	}
-	var inviTreeNode TreeNode
-	err = userlib.Unmarshal(marInviTreeNode, &inviTreeNode)
+	key, err := keys.key(record.Epoch)
 	if err != nil {
-		return re("5")
+		return signed, err
 	}
-
-	// Verify if the username in it
-	if len(inviTreeNode.UsernameToTreeNodeKey) != len(inviTreeNode.UsernameToTreeNodePtr) {
-		return re("6 Inheritance relation messed up.")
+	marshalSigned, err := symDec(key, record.EncEntry)
+	if err != nil {
+		return signed, err
 	}
-	recipientTreeNodeKey, ok1 := inviTreeNode.UsernameToTreeNodeKey[recipientUsername]
-	recipientTreeNodePtr, ok2 := inviTreeNode.UsernameToTreeNodePtr[recipientUsername]
-	if !ok1 || !ok2 {
-		return re("7 Inheritance relation messed up.")
+	err = userlib.Unmarshal(marshalSigned, &signed)
+	if err != nil {
+		return signed, re("Audit log been modified.")
 	}
-	delete(inviTreeNode.UsernameToTreeNodeKey, recipientUsername) // Delete this guy
-	delete(inviTreeNode.UsernameToTreeNodePtr, recipientUsername) // Delete this guy
-
-	//// BFS over this recipient and delete all their relevant information
-	usernameQueue := []string{recipientUsername}
-	treeNodePtrQueue := []userlib.UUID{recipientTreeNodePtr}
-	treeNodeKeyQueue := [][]byte{recipientTreeNodeKey}
-	userParentNameQueue := []string{userdata.Username}
-	for len(usernameQueue) > 0 {
-		// Get current info
-		curUsername := usernameQueue[0]
-		curTreeNodePtr := treeNodePtrQueue[0]
-		curTreeNodeKey := treeNodeKeyQueue[0]
-		curUserParentName := userParentNameQueue[0]
-
-		// Update the queue
-		usernameQueue = usernameQueue[1:]
-		treeNodePtrQueue = treeNodePtrQueue[1:]
-		treeNodeKeyQueue = treeNodeKeyQueue[1:]
-		userParentNameQueue = userParentNameQueue[1:]
-
-		// Get ds keys for encrytion
-		curUserVDKey, err := getDSVerify(curUsername)
-		if err != nil {
-			return re("1B0")
-		}
-		parentVDKey, err := getDSVerify(curUserParentName)
-		if err != nil {
-			return re("1B1")
-		}
-		dsKeys := []userlib.DSVerifyKey{ownerVDKey, curUserVDKey, parentVDKey}
+	return signed, nil
+}
+func (userdata *User) storeAuditRecord(keys fileKeys, fileID userlib.UUID, seq int, signed signedAudit) error {
+	id, err := auditEntryPtr(fileID, seq)
+	if err != nil {
+		return err
+	}
+	marshalSigned, err := userlib.Marshal(signed)
+	if err != nil {
+		return err
+	}
+	marshalRecord, err := userlib.Marshal(auditRecord{keys.Epoch, symEnc(keys.FileKey, marshalSigned)})
+	if err != nil {
+		return err
+	}
+	userdata.hmacDatastoreSet(id, marshalRecord)
+	return nil
+}
 
-		// Get the encrypted tree node
-		encTreeNode, err := getEncDS(dsKeys, curTreeNodePtr)
+// add an entry to the end of the file's audit log, right after the list's
+// head, signed by the user. Moves the head and gives back its seq and hash.
+func (userdata *User) logAudit(fileID userlib.UUID, keys fileKeys, list *ContentList, action string, target string) (int, []byte, error) {
+	// From the head, or from the last write if the head does not hold
+	seq, prevHash := -1, []byte(nil)
+	if list.AuditHash != nil {
+		seq, prevHash = list.AuditSeq, list.AuditHash
+	}
+	if list.AuditHead > seq {
+		signed, ok, err := userdata.readAuditRecord(keys, fileID, list.AuditHead)
 		if err != nil {
-			return re("1B2")
+			return 0, nil, err
 		}
-		curMarTreeNode, err := symDec(curTreeNodeKey, encTreeNode)
-		if err != nil {
-			return re("1B3")
+		if ok && userlib.HMACEqual(userlib.Hash(signed.Entry), list.AuditHeadHash) {
+			seq, prevHash = list.AuditHead, list.AuditHeadHash
 		}
-		var curTreeNode TreeNode
-		err = userlib.Unmarshal(curMarTreeNode, &curTreeNode)
+	}
+	// A head left behind never writes over what is past it
+	for {
+		signed, ok, err := userdata.readAuditRecord(keys, fileID, seq + 1)
 		if err != nil {
-			return re("1B4")
-		}
-
-		// Delete the tree node record in the data store
-		userlib.DatastoreDelete(curTreeNodePtr)
-
-		// Verify current TreeNode
-		if curTreeNode.UsernameToTreeNodePtr == nil || curTreeNode.UsernameToTreeNodeKey == nil {
-			return re("Inheritance messed up (nil) when do BFS checking to be revoked.")
-		}
-		if len(curTreeNode.UsernameToTreeNodePtr) != len(curTreeNode.UsernameToTreeNodeKey) {
-			return re("Inheritance messed up (length not same) when do BFS checking to be revoked.")
+			return 0, nil, err
 		}
-		for childName, childrenNodePtr := range curTreeNode.UsernameToTreeNodePtr {
-			childrenNodekey, exist := curTreeNode.UsernameToTreeNodeKey[childName]
-			if !exist {
-				return re("Inheritance messed up (non-match keys) when do BFS checking to be revoked.")
-			}
-			usernameQueue = append(usernameQueue, childName)
-			treeNodePtrQueue = append(treeNodePtrQueue, childrenNodePtr)
-			treeNodeKeyQueue = append(treeNodeKeyQueue, childrenNodekey)
-			userParentNameQueue = append(userParentNameQueue, curUsername)
+		if !ok {
+			break
 		}
-
-		// Delete corresponding file key
-		userlib.DatastoreDelete(curTreeNode.FileKeyPtr)
+		seq++
+		prevHash = userlib.Hash(signed.Entry)
 	}
+	seq++
 
-	//// Update the file content and its ID LIST
-	// Get original fileKey
-	fileKey, err := getFileKey(dsKeys, userdata.PKey, fileInfo.FileKeyPtr)
+	marshalEntry, err := userlib.Marshal(AuditEntry{fileID, seq, userdata.Username, action, target, list.Version, len(list.Chunks), prevHash})
 	if err != nil {
-		return re("7.5")
+		return 0, nil, err
 	}
-
-	// Get idList & Content List
-	fileContentList, idList, err := getEncContentList(fileKey, fileInfo.ContentUUIDListPtr, false)
+	signature, err := userlib.DSSign(userdata.DKey, marshalEntry)
 	if err != nil {
-		return re("8")
+		return 0, nil, re("Fail to sign audit entry.")
 	}
-
-	// New a file key and update owner
-	newFileKey := userlib.RandomBytes(16)
-
-	// Re enc idList
-	newMarIDList, err := userlib.Marshal(idList)
+	err = userdata.storeAuditRecord(keys, fileID, seq, signedAudit{marshalEntry, signature})
 	if err != nil {
-		return re("9")
+		return 0, nil, err
 	}
-	newEncIDList := symEnc(newFileKey, newMarIDList)
-	hmacDatastoreSet(fileInfo.ContentUUIDListPtr, newEncIDList)
+	list.AuditHead, list.AuditHeadHash = seq, userlib.Hash(marshalEntry)
+	return seq, list.AuditHeadHash, nil
+}
+// log an event that writes no content, only the list's head moves
+func (userdata *User) logAuditEvent(fileInfo FileInfo, keys fileKeys, header FileHeader, action string, target string) (int, error) {
+	list, err := userdata.getContentList(keys.FileKey, fileInfo.ContentUUIDListPtr, header)
+	if err != nil {
+		return 0, err
+	}
+	seq, _, err := userdata.logAudit(fileInfo.HeaderPtr, keys, &list, action, target)
+	if err != nil {
+		return 0, err
+	}
+	return seq, userdata.storeContentList(keys.FileKey, fileInfo.ContentUUIDListPtr, list)
+}
 
-	// Re enc contentList
-	if len(idList) != len(fileContentList) {
-		return re("10")
+// move every entry over to newKeys, for a new key chain
+func (userdata *User) reencryptAuditLog(fileID userlib.UUID, keys fileKeys, newKeys fileKeys) error {
+	log, err := userdata.readAuditLog(keys, fileID)
+	if err != nil {
+		return err
 	}
-	for i := 0; i < len(fileContentList); i++ {
-		curEncContent := fileContentList[i]
-		curContent, err := symDec(fileKey, curEncContent)
+	for seq := range log {
+		err = userdata.storeAuditRecord(newKeys, fileID, seq, log[seq])
 		if err != nil {
-			return re("10.5")
+			return err
 		}
-		encCurContent := symEnc(newFileKey, curContent)
-		hmacDatastoreSet(idList[i], encCurContent)
 	}
-
-	ownerPKEKey, err := getPKEPublic(userdata.Username)
+	return nil
+}
+func (userdata *User) deleteAuditLog(fileID userlib.UUID) error {
+	ids, _, err := userdata.fetchAuditLog(fileID)
 	if err != nil {
-		return re("1.5B0")
+		return err
 	}
-	pkeEncNewFileKey, err := userlib.PKEEnc(ownerPKEKey, newFileKey)
+	for _, id := range ids {
+		userdata.datastoreDelete(id)
+	}
+	return nil
+}
+
+// sign again by the master key the entries a device logged for the file
+func (userdata *User) resignDeviceAudit(fileInfo FileInfo, userVDKey []userlib.DSVerifyKey, deviceVDKey userlib.DSVerifyKey) error {
+	ctx, err := userdata.openFile(fileInfo, userVDKey)
 	if err != nil {
-		return re("1.5B1")
+		return nil // Lost it already
 	}
-	dsPKEEncNewFileKey, err := dsEnc(userdata.DKey, pkeEncNewFileKey)
+	log, err := userdata.readAuditLog(ctx.Keys, fileInfo.HeaderPtr)
 	if err != nil {
-		return re("1.5B1")
+		return err
 	}
-	hmacDatastoreSet(inviTreeNode.FileKeyPtr, dsPKEEncNewFileKey)
-	//hmacDatastoreSet(fileInfo.FileKeyPtr, dsPKEEncNewFileKey)
-
-	//// BFS over myself and update all their information
-	// New a BFS for everyone else to update
-	usernameQueue = []string{}
-	treeNodePtrQueue = []userlib.UUID{}
-	treeNodeKeyQueue = [][]byte{}
-	userParentNameQueue = []string{}
-	for childName, childrenNodePtr := range inviTreeNode.UsernameToTreeNodePtr {
-		childrenNodeKey, exist := inviTreeNode.UsernameToTreeNodeKey[childName]
-		if !exist {
-			return re("1.5B2 Inheritance messed up (non-match keys) when do BFS checking to be revoked.")
+	for seq, signed := range log {
+		if userlib.DSVerify(deviceVDKey, signed.Entry, signed.Sig) != nil {
+			continue
 		}
-		usernameQueue = append(usernameQueue, childName)
-		treeNodePtrQueue = append(treeNodePtrQueue, childrenNodePtr)
-		treeNodeKeyQueue = append(treeNodeKeyQueue, childrenNodeKey)
-		userParentNameQueue = append(userParentNameQueue, userdata.Username)
-	}
-	for len(usernameQueue) > 0 {
-		// Get current info
-		curUsername := usernameQueue[0]
-		curTreeNodePtr := treeNodePtrQueue[0]
-		curTreeNodeKey := treeNodeKeyQueue[0]
-		curUserParentName := userParentNameQueue[0]
-
-		// Update the queue
-		usernameQueue = usernameQueue[1:]
-		treeNodePtrQueue = treeNodePtrQueue[1:]
-		treeNodeKeyQueue = treeNodeKeyQueue[1:]
-		userParentNameQueue = userParentNameQueue[1:]
-
-		// Get ds keys for encrytion
-		curUserVDKey, err := getDSVerify(curUsername)
+		signed.Sig, err = userlib.DSSign(userdata.DKey, signed.Entry)
 		if err != nil {
-			return re("2B0")
+			return re("Fail to sign audit entry.")
 		}
-		parentVDKey, err := getDSVerify(curUserParentName)
+		err = userdata.storeAuditRecord(ctx.Keys, fileInfo.HeaderPtr, seq, signed)
 		if err != nil {
-			return re("2B1")
+			return err
 		}
-		curDsKeys := []userlib.DSVerifyKey{ownerVDKey, curUserVDKey, parentVDKey}
+	}
+	return nil
+}
 
-		// Get the encrypted tree node
-		encTreeNode, err := getEncDS(curDsKeys, curTreeNodePtr)
-		if err != nil {
-			return re("2B2")
-		}
-		curMarTreeNode, err := symDec(curTreeNodeKey, encTreeNode)
-		if err != nil {
-			return re("2B3")
-		}
-		var curTreeNode TreeNode
-		err = userlib.Unmarshal(curMarTreeNode, &curTreeNode)
-		if err != nil {
-			return re("2B4")
-		}
+// AuditLog returns the file's audit log, oldest first, for the owner only.
+// It fails if an entry was edited, dropped or signed by someone else, or if
+// the log is shorter than when the owner last read it.
+func (userdata *User) AuditLog(filename string) (entries []AuditEntry, err error) {
+	defer userdata.transaction()(&err)
+	// Get the fileInfoMap First
+	fileInfoMap, userVDKey, err := userdata.getFileMap(userdata.EncFileNameToFileInfoPtr, userdata.Username)
+	if err != nil {
+		return nil, err
+	}
 
-		// Verify current TreeNode
-		if curTreeNode.UsernameToTreeNodePtr == nil || curTreeNode.UsernameToTreeNodeKey == nil {
-			return re("Inheritance messed up (nil) when do BFS checking to be revoked.")
-		}
-		if len(curTreeNode.UsernameToTreeNodePtr) != len(curTreeNode.UsernameToTreeNodeKey) {
-			return re("Inheritance messed up (length not same) when do BFS checking to be revoked.")
-		}
-		for childName, childrenNodePtr := range curTreeNode.UsernameToTreeNodePtr {
-			childrenNodeKey, exist := curTreeNode.UsernameToTreeNodeKey[childName]
-			if !exist {
-				return re("Inheritance messed up (non-match keys) when do BFS checking to be revoked.")
-			}
-			usernameQueue = append(usernameQueue, childName)
-			treeNodePtrQueue = append(treeNodePtrQueue, childrenNodePtr)
-			treeNodeKeyQueue = append(treeNodeKeyQueue, childrenNodeKey)
-			userParentNameQueue = append(userParentNameQueue, curUsername)
-		}
+	// Check if user have the file
+	fileInfo, exist := getFileInfo(filename, fileInfoMap)
+	if !exist {
+		return nil, re("DNE file.")
+	}
+	owner, err := userdata.ownsFile(fileInfo)
+	if err != nil {
+		return nil, err
+	}
+	if !owner {
+		return nil, re("Only file owner can read the audit log.")
+	}
+	ctx, err := userdata.openFile(fileInfo, userVDKey)
+	if err != nil {
+		return nil, err
+	}
 
-		// Update corresponding file key
-		curUserPKEKey, err := getPKEPublic(curUsername)
+	// Walk the chain from the first entry
+	log, err := userdata.readAuditLog(ctx.Keys, fileInfo.HeaderPtr)
+	if err != nil {
+		return nil, err
+	}
+	var hashes [][]byte
+	var prevHash []byte
+	for seq, signed := range log {
+		var entry AuditEntry
+		err = userlib.Unmarshal(signed.Entry, &entry)
+		if err != nil || entry.File != fileInfo.HeaderPtr || entry.Seq != seq || !userlib.HMACEqual(entry.PrevHash, prevHash) {
+			return nil, re("Audit log been modified.")
+		}
+		err = userdata.verifyUserSig(entry.Actor, signed.Entry, signed.Sig)
 		if err != nil {
-			return re(curUsername + " has no PKE public key!")
+			return nil, re("Audit entry not signed by its actor.")
+		}
+		revocation, ok := ctx.Header.Revoked[entry.Actor]
+		if ok && entry.Seq > revocation.Seq {
+			return nil, re("Audit entry by " + entry.Actor + " after their revocation.")
 		}
-		pkeEncFileKey, err := userlib.PKEEnc(curUserPKEKey, newFileKey)
-		dsPKEEncFileKey, err := dsEnc(userdata.DKey, pkeEncFileKey)
-		hmacDatastoreSet(curTreeNode.FileKeyPtr, dsPKEEncFileKey)
+		prevHash = userlib.Hash(signed.Entry)
+		hashes = append(hashes, prevHash)
+		entries = append(entries, entry)
 	}
 
-	return nil
+	// Nothing we saw before may be gone
+	if len(entries) < fileInfo.AuditSeen {
+		return nil, re("Audit log been truncated.")
+	}
+	if fileInfo.AuditSeen > 0 && !userlib.HMACEqual(hashes[fileInfo.AuditSeen - 1], fileInfo.AuditSeenHash) {
+		return nil, re("Audit log been modified.")
+	}
+	if len(entries) == fileInfo.AuditSeen {
+		return entries, nil
+	}
+	fileInfo.AuditSeen = len(entries)
+	fileInfo.AuditSeenHash = prevHash
+	fileInfoMap[hex.EncodeToString(userlib.Hash([]byte(filename)))] = fileInfo
+	marshalNewFileInfoMap, err := userlib.Marshal(fileInfoMap)
+	if err != nil {
+		return nil, err
+	}
+	encNewFileInfoMap := symEnc(userlib.Hash([]byte(userdata.Username))[:16], marshalNewFileInfoMap)
+	dsEncNewFileInfoMap, err := dsEnc(userdata.DKey, encNewFileInfoMap)
+	if err != nil {
+		return nil, err
+	}
+	userdata.hmacDatastoreSet(userdata.EncFileNameToFileInfoPtr, dsEncNewFileInfoMap)
+	return entries, nil
 }
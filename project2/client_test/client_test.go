@@ -92,6 +92,35 @@ var someFileContent []byte
 var someShortFileContent []byte
 var someLongFileContent []byte
 
+// a backend that counts its round trips, and fails them all while down
+type countingBackend struct {
+	client.UserlibBackend
+	gets int
+	writes int
+	down bool
+}
+
+type backendDown struct{}
+
+func (backendDown) Error() string {
+	return "The backend is down."
+}
+
+func (b *countingBackend) DatastoreGetBatch(ids []userlib.UUID) (map[userlib.UUID][]byte, error) {
+	b.gets++
+	if b.down {
+		return nil, backendDown{}
+	}
+	return b.UserlibBackend.DatastoreGetBatch(ids)
+}
+func (b *countingBackend) DatastoreWriteBatch(sets map[userlib.UUID][]byte, deletes []userlib.UUID) error {
+	b.writes++
+	if b.down {
+		return backendDown{}
+	}
+	return b.UserlibBackend.DatastoreWriteBatch(sets, deletes)
+}
+
 // ================================================
 // The top level Describe() contains all tests in
 // this test suite in nested Describe() blocks.
@@ -236,6 +265,22 @@ var _ = Describe("Client Tests", func() {
 			_, err = client.GetUser("Alicexxxxx", "xxxxxxx")
 			Expect(err).ToNot(BeNil(), "Failed to check the username and password.")
 		})
+
+		It("should get a user by the login key the password derives", func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+			alice.StoreFile(someFilename, someFileContent)
+
+			aliceLaptop, err := client.GetUserWithKey(aliceUsername, client.LoginKey(aliceUsername, alicePassword))
+			Expect(err).To(BeNil(), "Failed to get Alice by her login key.")
+			downloadedContent, err := aliceLaptop.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load her file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+
+			_, err = client.GetUserWithKey(aliceUsername, client.LoginKey(aliceUsername, "xxxxxx"))
+			Expect(err).ToNot(BeNil(), "Failed to check the login key.")
+			_, err = client.GetUserWithKey(aliceUsername, []byte("short"))
+			Expect(err).ToNot(BeNil(), "Took a login key of the wrong length.")
+		})
 	})
 
 	// 3
@@ -827,4 +872,1750 @@ var _ = Describe("Client Tests", func() {
 			}
 		})
 	})
+
+	Describe("Permissions", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+			bob, _ = client.InitUser(bobUsername, bobPassword)
+			olga, _ = client.InitUser(olgaUsername, olgaPassword)
+		})
+
+		It("read only recipient can load but not write", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, err := alice.CreateInvitationWithPermission(someFilename, bobUsername, client.PermissionRead)
+			Expect(err).To(BeNil(), "Alice failed to share a file with Bob.")
+			err = bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+			Expect(err).To(BeNil(), "Bob could not receive the file that Alice shared.")
+
+			downloadedContent, err := bob.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Bob could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+
+			err = bob.StoreFile(someFilename, []byte("bob's"))
+			Expect(err).ToNot(BeNil(), "Read only Bob overwrote the file.")
+			err = bob.AppendToFile(someFilename, []byte("bob's"))
+			Expect(err).ToNot(BeNil(), "Read only Bob appended to the file.")
+
+			_, err = bob.CreateInvitationWithPermission(someFilename, olgaUsername, client.PermissionWrite)
+			Expect(err).ToNot(BeNil(), "Bob granted more than Bob holds.")
+
+			downloadedContent, err = alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+		})
+
+		It("append only recipient can append but not overwrite", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, _ := alice.CreateInvitationWithPermission(someFilename, bobUsername, client.PermissionAppend)
+			err := bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+			Expect(err).To(BeNil(), "Bob could not receive the file that Alice shared.")
+
+			err = bob.AppendToFile(someFilename, []byte("012"))
+			Expect(err).To(BeNil(), "Bob could not append to the file.")
+			err = bob.StoreFile(someFilename, []byte("bob's"))
+			Expect(err).ToNot(BeNil(), "Append only Bob overwrote the file.")
+
+			err = alice.AppendToFile(someFilename, []byte("345"))
+			Expect(err).To(BeNil(), "Alice could not append to the file.")
+
+			downloadedContent, err := alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(append(someFileContent, []byte("012345")...)))
+		})
+
+		It("should downgrade a recipient and their subtree", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+			ptr, _ = bob.CreateInvitation(someFilename, olgaUsername)
+			err := olga.AcceptInvitation(bobUsername, ptr, someFilename)
+			Expect(err).To(BeNil(), "Olga could not receive the file that Bob shared.")
+
+			err = bob.ChangePermission(someFilename, olgaUsername, client.PermissionRead)
+			Expect(err).ToNot(BeNil(), "Only the owner changes permissions.")
+
+			err = alice.ChangePermission(someFilename, bobUsername, client.PermissionRead)
+			Expect(err).To(BeNil(), "Alice could not downgrade Bob.")
+
+			err = bob.StoreFile(someFilename, []byte("bob's"))
+			Expect(err).ToNot(BeNil(), "Downgraded Bob overwrote the file.")
+			err = olga.AppendToFile(someFilename, []byte("olga's"))
+			Expect(err).ToNot(BeNil(), "Olga kept more than Bob holds.")
+
+			downloadedContent, err := olga.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Olga could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+
+			err = alice.StoreFile(someFilename, someLongFileContent)
+			Expect(err).To(BeNil(), "Alice could not overwrite the file.")
+			downloadedContent, err = bob.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Bob could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someLongFileContent))
+		})
+
+		It("should share again after a revoke", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+
+			err := alice.RevokeAccess(someFilename, bobUsername)
+			Expect(err).To(BeNil(), "Alice could not revoke Bob.")
+			err = alice.RevokeAccess(someFilename, bobUsername)
+			Expect(err).ToNot(BeNil(), "Alice revoked Bob twice.")
+
+			ptr, err = alice.CreateInvitation(someFilename, bobUsername)
+			Expect(err).To(BeNil(), "Alice could not share with Bob again.")
+			err = bob.AcceptInvitation(aliceUsername, ptr, someOtherFilename)
+			Expect(err).To(BeNil(), "Bob could not receive the file again.")
+			downloadedContent, err := bob.LoadFile(someOtherFilename)
+			Expect(err).To(BeNil(), "Bob could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+		})
+	})
+
+	Describe("Revoke own sub-shares", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+			bob, _ = client.InitUser(bobUsername, bobPassword)
+			olga, _ = client.InitUser(olgaUsername, olgaPassword)
+			marco, _ = client.InitUser(marcoUsername, marcoPassword)
+		})
+
+		It("should let a non-owner revoke who they shared with", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+			ptr, _ = alice.CreateInvitation(someFilename, marcoUsername)
+			marco.AcceptInvitation(aliceUsername, ptr, someFilename)
+			ptr, _ = bob.CreateInvitation(someFilename, olgaUsername)
+			olga.AcceptInvitation(bobUsername, ptr, someFilename)
+
+			err := bob.RevokeAccess(someFilename, marcoUsername)
+			Expect(err).ToNot(BeNil(), "Bob revoked someone Alice shared with.")
+			err = bob.RevokeAccess(someFilename, aliceUsername)
+			Expect(err).ToNot(BeNil(), "Bob revoked the owner.")
+
+			err = bob.RevokeAccess(someFilename, olgaUsername)
+			Expect(err).To(BeNil(), "Bob could not revoke Olga.")
+			_, err = olga.LoadFile(someFilename)
+			Expect(err).ToNot(BeNil(), "Olga still can access.")
+
+			for _, u := range []*client.User{alice, bob, marco} {
+				downloadedContent, err := u.LoadFile(someFilename)
+				Expect(err).To(BeNil(), "Lost access after Bob revoked Olga.")
+				Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+			}
+
+			ptr, err = bob.CreateInvitation(someFilename, olgaUsername)
+			Expect(err).To(BeNil(), "Bob could not share with Olga again.")
+			err = olga.AcceptInvitation(bobUsername, ptr, someOtherFilename)
+			Expect(err).To(BeNil(), "Olga could not receive the file again.")
+
+			err = alice.RevokeAccess(someFilename, bobUsername)
+			Expect(err).To(BeNil(), "Alice could not revoke Bob.")
+			_, err = olga.LoadFile(someOtherFilename)
+			Expect(err).ToNot(BeNil(), "Olga still can access.")
+			_, err = marco.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Marco lost access.")
+		})
+
+		It("should have the owner rotate keys after a non-owner revoke", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+			ptr, _ = bob.CreateInvitation(someFilename, olgaUsername)
+			olga.AcceptInvitation(bobUsername, ptr, someFilename)
+			kept := map[userlib.UUID][]byte{}
+			for k, v := range userlib.DatastoreGetMap() {
+				kept[k] = v
+			}
+
+			err := bob.RevokeAccess(someFilename, olgaUsername)
+			Expect(err).To(BeNil(), "Bob could not revoke Olga.")
+			err = alice.AppendToFile(someFilename, someShortFileContent)
+			Expect(err).To(BeNil(), "Alice could not append.")
+
+			// Olga kept her key blob and tree node, the new epoch is past them
+			for k, v := range kept {
+				_, ok := userlib.DatastoreGet(k)
+				if !ok {
+					userlib.DatastoreSet(k, v)
+				}
+			}
+			_, err = olga.LoadFile(someFilename)
+			Expect(err).ToNot(BeNil(), "Olga read the file with her old keys.")
+			downloadedContent, err := bob.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Bob lost access.")
+			Expect(downloadedContent).To(BeEquivalentTo(append(append([]byte{}, someFileContent...), someShortFileContent...)))
+
+			// Bob revoked her, not Alice, so Bob may let her back in
+			_, err = bob.CreateInvitation(someFilename, olgaUsername)
+			Expect(err).To(BeNil(), "Bob could not share with Olga again.")
+			entries, err := alice.AuditLog(someFilename)
+			Expect(err).To(BeNil(), "Alice could not read the audit log.")
+			Expect(entries[5].Actor).To(Equal(bobUsername))
+			Expect(entries[5].Action).To(Equal("revoke"))
+		})
+	})
+
+	Describe("Share tree", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+			bob, _ = client.InitUser(bobUsername, bobPassword)
+			olga, _ = client.InitUser(olgaUsername, olgaPassword)
+			marco, _ = client.InitUser(marcoUsername, marcoPassword)
+		})
+
+		It("should list who has access and how they got it", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, _ := alice.CreateInvitation(someFilename, marcoUsername)
+			marco.AcceptInvitation(aliceUsername, ptr, someFilename)
+			ptr, _ = alice.CreateInvitationWithPermission(someFilename, bobUsername, client.PermissionAppend)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+			ptr, _ = bob.CreateInvitationWithPermission(someFilename, olgaUsername, client.PermissionRead)
+			olga.AcceptInvitation(bobUsername, ptr, someFilename)
+
+			tree, err := alice.GetShareTree(someFilename)
+			Expect(err).To(BeNil(), "Alice could not get the share tree.")
+			Expect(tree.Username).To(Equal(aliceUsername))
+			Expect(tree.InvitedBy).To(Equal(""))
+			Expect(tree.Permission).To(Equal(client.PermissionWrite))
+			Expect(tree.Children).To(HaveLen(2))
+
+			bobNode := tree.Children[0]
+			Expect(bobNode.Username).To(Equal(bobUsername))
+			Expect(bobNode.InvitedBy).To(Equal(aliceUsername))
+			Expect(bobNode.Permission).To(Equal(client.PermissionAppend))
+			Expect(bobNode.InvitedAt).To(Equal(3)) // store, invite, accept, then Bob's invite
+			Expect(bobNode.Children).To(HaveLen(1))
+			Expect(bobNode.Children[0].Username).To(Equal(olgaUsername))
+			Expect(bobNode.Children[0].InvitedBy).To(Equal(bobUsername))
+			Expect(bobNode.Children[0].Permission).To(Equal(client.PermissionRead))
+			Expect(bobNode.Children[0].InvitedAt).To(BeNumerically(">", bobNode.InvitedAt))
+			Expect(tree.Children[1].Username).To(Equal(marcoUsername))
+			Expect(tree.Children[1].Permission).To(Equal(client.PermissionWrite))
+
+			subtree, err := bob.GetShareTree(someFilename)
+			Expect(err).To(BeNil(), "Bob could not get the share tree.")
+			Expect(subtree.Username).To(Equal(bobUsername))
+			Expect(subtree.InvitedBy).To(Equal(aliceUsername))
+			Expect(subtree.Children).To(HaveLen(1))
+
+			alice.RevokeAccess(someFilename, bobUsername)
+			tree, err = alice.GetShareTree(someFilename)
+			Expect(err).To(BeNil(), "Alice could not get the share tree.")
+			Expect(tree.Children).To(HaveLen(1))
+			_, err = bob.GetShareTree(someFilename)
+			Expect(err).ToNot(BeNil(), "Revoked Bob still sees the tree.")
+		})
+	})
+
+	Describe("Lazy revoke", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+			bob, _ = client.InitUser(bobUsername, bobPassword)
+			olga, _ = client.InitUser(olgaUsername, olgaPassword)
+			marco, _ = client.InitUser(marcoUsername, marcoPassword)
+		})
+
+		It("should keep old chunks readable until the next write", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			alice.AppendToFile(someFilename, []byte("0"))
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+			ptr, _ = alice.CreateInvitationWithPermission(someFilename, olgaUsername, client.PermissionAppend)
+			olga.AcceptInvitation(aliceUsername, ptr, someFilename)
+			ptr, _ = alice.CreateInvitation(someFilename, marcoUsername)
+			marco.AcceptInvitation(aliceUsername, ptr, someFilename)
+
+			err := alice.RevokeAccessWithMode(someFilename, bobUsername, client.RevokeLazy)
+			Expect(err).To(BeNil(), "Alice could not revoke Bob.")
+			_, err = bob.LoadFile(someFilename)
+			Expect(err).ToNot(BeNil(), "Bob still can access.")
+
+			expected := append(append([]byte{}, someFileContent...), []byte("0")...)
+			downloadedContent, err := marco.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Marco could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(expected))
+
+			// an appender cannot move old chunks, they stay readable
+			err = olga.AppendToFile(someFilename, []byte("1"))
+			Expect(err).To(BeNil(), "Olga could not append to the file.")
+			expected = append(expected, []byte("1")...)
+			downloadedContent, err = alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(expected))
+
+			// a second lazy revoke stacks another old key
+			err = alice.RevokeAccessWithMode(someFilename, olgaUsername, client.RevokeLazy)
+			Expect(err).To(BeNil(), "Alice could not revoke Olga.")
+			downloadedContent, err = marco.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Marco could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(expected))
+
+			err = marco.AppendToFile(someFilename, []byte("2"))
+			Expect(err).To(BeNil(), "Marco could not append to the file.")
+			expected = append(expected, []byte("2")...)
+			downloadedContent, err = alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(expected))
+
+			err = alice.RevokeAccess(someFilename, marcoUsername)
+			Expect(err).To(BeNil(), "Alice could not revoke Marco.")
+			downloadedContent, err = alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(expected))
+		})
+
+		It("should re-encrypt old chunks on a plain revoke", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+
+			// the records the append writes its content to
+			before := make(map[uuid.UUID]string)
+			for k, v := range userlib.DatastoreGetMap() {
+				before[k] = string(v)
+			}
+			content := userlib.RandomBytes(4096)
+			err := alice.AppendToFile(someFilename, content)
+			Expect(err).To(BeNil(), "Alice could not append to the file.")
+			chunks := make(map[uuid.UUID]string)
+			for k, v := range userlib.DatastoreGetMap() {
+				if len(v) >= len(content) && before[k] != string(v) {
+					chunks[k] = string(v)
+				}
+			}
+			Expect(chunks).ToNot(BeEmpty())
+
+			err = alice.RevokeAccess(someFilename, bobUsername)
+			Expect(err).To(BeNil(), "Alice could not revoke Bob.")
+			for k, v := range chunks {
+				Expect(string(userlib.DatastoreGetMap()[k])).ToNot(Equal(v), "A chunk stayed under the revoked epoch.")
+			}
+			downloadedContent, err := alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(append(append([]byte{}, someFileContent...), content...)))
+		})
+	})
+
+	Describe("Key epochs", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+			bob, _ = client.InitUser(bobUsername, bobPassword)
+			marco, _ = client.InitUser(marcoUsername, marcoPassword)
+		})
+
+		It("should keep every epoch readable to current members only", func() {
+			alice.StoreFile(someFilename, []byte("0"))
+			ptr, _ := alice.CreateInvitation(someFilename, marcoUsername)
+			marco.AcceptInvitation(aliceUsername, ptr, someFilename)
+
+			expected := []byte("0")
+			for i := 1; i <= 3; i++ {
+				ptr, err := alice.CreateInvitation(someFilename, bobUsername)
+				Expect(err).To(BeNil(), "Alice could not share with Bob.")
+				err = bob.AcceptInvitation(aliceUsername, ptr, someFilename+string(rune('0'+i)))
+				Expect(err).To(BeNil(), "Bob could not receive the file.")
+				err = bob.AppendToFile(someFilename+string(rune('0'+i)), []byte("b"))
+				Expect(err).To(BeNil(), "Bob could not append to the file.")
+				expected = append(expected, 'b')
+
+				err = alice.RevokeAccess(someFilename, bobUsername)
+				Expect(err).To(BeNil(), "Alice could not revoke Bob.")
+				_, err = bob.LoadFile(someFilename + string(rune('0'+i)))
+				Expect(err).ToNot(BeNil(), "Bob still can access.")
+
+				downloadedContent, err := marco.LoadFile(someFilename)
+				Expect(err).To(BeNil(), "Marco could not load the file.")
+				Expect(downloadedContent).To(BeEquivalentTo(expected))
+			}
+
+			err := alice.RevokeAccessWithMode(someFilename, marcoUsername, client.RevokeEager)
+			Expect(err).To(BeNil(), "Alice could not revoke Marco.")
+			downloadedContent, err := alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(expected))
+		})
+	})
+
+	Describe("Groups", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+			bob, _ = client.InitUser(bobUsername, bobPassword)
+			marco, _ = client.InitUser(marcoUsername, marcoPassword)
+		})
+
+		It("should share with members and revoke removed members", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			err := alice.CreateGroup("team")
+			Expect(err).To(BeNil(), "Alice could not create the group.")
+			err = alice.CreateGroup("team")
+			Expect(err).ToNot(BeNil(), "Alice created the same group twice.")
+
+			invitations, err := alice.AddMember("team", bobUsername)
+			Expect(err).To(BeNil(), "Alice could not add Bob.")
+			Expect(invitations).To(BeEmpty())
+
+			invitations, err = alice.ShareWithGroup(someFilename, "team")
+			Expect(err).To(BeNil(), "Alice could not share with the group.")
+			err = bob.AcceptInvitation(aliceUsername, invitations[bobUsername], someFilename)
+			Expect(err).To(BeNil(), "Bob could not receive the file.")
+
+			// late members get the group's files too
+			invitations, err = alice.AddMember("team", marcoUsername)
+			Expect(err).To(BeNil(), "Alice could not add Marco.")
+			err = marco.AcceptInvitation(aliceUsername, invitations[someFilename], someFilename)
+			Expect(err).To(BeNil(), "Marco could not receive the file.")
+
+			members, err := alice.GetGroupMembers("team")
+			Expect(err).To(BeNil(), "Alice could not list the group.")
+			Expect(members).To(Equal([]string{bobUsername, marcoUsername}))
+
+			err = alice.RemoveMember("team", bobUsername)
+			Expect(err).To(BeNil(), "Alice could not remove Bob.")
+			_, err = bob.LoadFile(someFilename)
+			Expect(err).ToNot(BeNil(), "Bob still can access.")
+			downloadedContent, err := marco.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Marco could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+
+			err = bob.CreateGroup("team")
+			Expect(err).To(BeNil(), "Bob could not create a group.")
+			_, err = bob.ShareWithGroup(someFilename, "team")
+			Expect(err).ToNot(BeNil(), "Bob shared a revoked file.")
+		})
+
+		It("should not report a member added when an invitation fails", func() {
+			marco.StoreFile(someFilename, someFileContent)
+			ptr, _ := marco.CreateInvitation(someFilename, aliceUsername)
+			alice.AcceptInvitation(marcoUsername, ptr, someFilename)
+			ptr, _ = marco.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(marcoUsername, ptr, someFilename)
+			err := marco.RevokeAccess(someFilename, bobUsername)
+			Expect(err).To(BeNil(), "Marco could not revoke Bob.")
+
+			alice.CreateGroup("team")
+			_, err = alice.ShareWithGroup(someFilename, "team")
+			Expect(err).To(BeNil(), "Alice could not share with the group.")
+			// Only Marco can let Bob back in
+			_, err = alice.AddMember("team", bobUsername)
+			Expect(err).ToNot(BeNil(), "Alice added Bob without sharing the file.")
+			members, err := alice.GetGroupMembers("team")
+			Expect(err).To(BeNil(), "Alice could not list the group.")
+			Expect(members).To(BeEmpty())
+		})
+
+		It("should remove a member already revoked by hand", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			alice.CreateGroup("team")
+			alice.AddMember("team", bobUsername)
+			invitations, err := alice.ShareWithGroup(someFilename, "team")
+			Expect(err).To(BeNil(), "Alice could not share with the group.")
+			err = bob.AcceptInvitation(aliceUsername, invitations[bobUsername], someFilename)
+			Expect(err).To(BeNil(), "Bob could not receive the file.")
+
+			err = alice.RevokeAccess(someFilename, bobUsername)
+			Expect(err).To(BeNil(), "Alice could not revoke Bob.")
+			err = alice.RemoveMember("team", bobUsername)
+			Expect(err).To(BeNil(), "Alice could not remove Bob.")
+			members, err := alice.GetGroupMembers("team")
+			Expect(err).To(BeNil(), "Alice could not list the group.")
+			Expect(members).To(BeEmpty())
+		})
+	})
+
+	Describe("Journal", func() {
+		var crashingStore = func(at int, op func()) {
+			set := userlib.DatastoreSet
+			defer func() {
+				userlib.DatastoreSet = set
+				recover()
+			}()
+			writes := 0
+			userlib.DatastoreSet = func(key userlib.UUID, value []byte) {
+				writes++
+				if writes == at {
+					panic("crash")
+				}
+				set(key, value)
+			}
+			op()
+		}
+
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+		})
+
+		It("should finish a commit that got cut off", func() {
+			alice.StoreFile(someFilename, []byte("old"))
+			// the log is the first write, so crash on the second
+			crashingStore(2, func() {
+				alice.StoreFile(someFilename, []byte("new"))
+			})
+			alice, err := client.GetUser(aliceUsername, alicePassword)
+			Expect(err).To(BeNil(), "Alice could not log in.")
+			downloadedContent, err := alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo([]byte("new")))
+		})
+
+		It("should drop a commit cut off before its log", func() {
+			alice.StoreFile(someFilename, []byte("old"))
+			crashingStore(1, func() {
+				alice.StoreFile(someFilename, []byte("new"))
+			})
+			alice, err := client.GetUser(aliceUsername, alicePassword)
+			Expect(err).To(BeNil(), "Alice could not log in.")
+			downloadedContent, err := alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo([]byte("old")))
+
+			err = alice.AppendToFile(someFilename, []byte("!"))
+			Expect(err).To(BeNil(), "Alice could not append after the crash.")
+			downloadedContent, err = alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo([]byte("old!")))
+		})
+	})
+
+	Describe("Garbage collection", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+			bob, _ = client.InitUser(bobUsername, bobPassword)
+			marco, _ = client.InitUser(marcoUsername, marcoPassword)
+		})
+
+		It("should delete invitations that can no longer be accepted", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, _ := alice.CreateInvitation(someFilename, marcoUsername)
+			marco.AcceptInvitation(aliceUsername, ptr, someFilename)
+			alice.AppendToFile(someFilename, someFileContent)
+
+			orphans, err := alice.CollectGarbage(true)
+			Expect(err).To(BeNil(), "Alice could not collect garbage.")
+			Expect(orphans).To(BeEmpty())
+
+			// Bob never accepts before losing access
+			bobPtr, err := alice.CreateInvitation(someFilename, bobUsername)
+			Expect(err).To(BeNil(), "Alice could not share with Bob.")
+			err = alice.RevokeAccess(someFilename, bobUsername)
+			Expect(err).To(BeNil(), "Alice could not revoke Bob.")
+
+			orphans, err = alice.CollectGarbage(true)
+			Expect(err).To(BeNil(), "Alice could not collect garbage.")
+			Expect(orphans).To(HaveLen(2))
+			Expect(orphans).To(ContainElement(bobPtr))
+			_, ok := userlib.DatastoreGet(bobPtr)
+			Expect(ok).To(BeTrue(), "A dry run deleted a record.")
+
+			orphans, err = alice.CollectGarbage(false)
+			Expect(err).To(BeNil(), "Alice could not collect garbage.")
+			Expect(orphans).To(HaveLen(2))
+			_, ok = userlib.DatastoreGet(bobPtr)
+			Expect(ok).To(BeFalse(), "The invitation is still there.")
+
+			orphans, err = alice.CollectGarbage(false)
+			Expect(err).To(BeNil(), "Alice could not collect garbage.")
+			Expect(orphans).To(BeEmpty())
+
+			expected := append(append([]byte{}, someFileContent...), someFileContent...)
+			downloadedContent, err := alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(expected))
+			downloadedContent, err = marco.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Marco could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(expected))
+		})
+
+		It("should keep chunks in files the user lost", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+			err := bob.AppendToFile(someFilename, []byte("bob"))
+			Expect(err).To(BeNil(), "Bob could not append to the file.")
+			alice.RevokeAccess(someFilename, bobUsername)
+
+			_, err = bob.CollectGarbage(false)
+			Expect(err).To(BeNil(), "Bob could not collect garbage.")
+			downloadedContent, err := alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(append(append([]byte{}, someFileContent...), []byte("bob")...)))
+		})
+	})
+
+	Describe("Ledger", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+		})
+
+		It("should append at the same cost however many records came before", func() {
+			// bytes to and from the Datastore
+			moved := 0
+			datastoreGet, datastoreSet := userlib.DatastoreGet, userlib.DatastoreSet
+			userlib.DatastoreGet = func(k userlib.UUID) ([]byte, bool) {
+				v, ok := datastoreGet(k)
+				moved += len(v)
+				return v, ok
+			}
+			userlib.DatastoreSet = func(k userlib.UUID, v []byte) {
+				moved += len(v)
+				datastoreSet(k, v)
+			}
+			defer func() { userlib.DatastoreGet, userlib.DatastoreSet = datastoreGet, datastoreSet }()
+			appendCost := func() int {
+				moved = 0
+				err := alice.AppendToFile(someFilename, someShortFileContent)
+				Expect(err).To(BeNil(), "Alice could not append to the file.")
+				return moved
+			}
+
+			for i := 0; i < 10; i++ {
+				alice.StoreFile(someOtherFilename + string(rune('0'+i)), someShortFileContent)
+			}
+			alice.StoreFile(someFilename, someShortFileContent)
+			alice.AppendToFile(someFilename, someShortFileContent)
+			before := appendCost()
+			for i := 0; i < 10; i++ {
+				for j := 0; j < 10; j++ {
+					alice.AppendToFile(someOtherFilename + string(rune('0'+i)), someShortFileContent)
+				}
+			}
+			// one more chunk in the list is all that may add to it
+			Expect(appendCost()).To(BeNumerically("<", before + before / 8), "Appending costs more once more records exist.")
+
+			// the ledger still reads whole
+			orphans, err := alice.CollectGarbage(false)
+			Expect(err).To(BeNil(), "Alice could not collect garbage.")
+			Expect(orphans).To(BeEmpty())
+			downloadedContent, err := alice.LoadFile(someOtherFilename + "9")
+			Expect(err).To(BeNil(), "Alice could not load the file.")
+			Expect(len(downloadedContent)).To(Equal(11 * len(someShortFileContent)))
+		})
+	})
+
+	Describe("Delete account", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+			bob, _ = client.InitUser(bobUsername, bobPassword)
+			marco, _ = client.InitUser(marcoUsername, marcoPassword)
+		})
+
+		It("should remove the user and tell recipients", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+			pendingPtr, _ := alice.CreateInvitation(someFilename, marcoUsername)
+
+			// Alice passes on Marco's file to Bob
+			marco.StoreFile(someOtherFilename, someFileContent)
+			ptr, _ = marco.CreateInvitation(someOtherFilename, aliceUsername)
+			alice.AcceptInvitation(marcoUsername, ptr, someOtherFilename)
+			ptr, _ = alice.CreateInvitation(someOtherFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someOtherFilename)
+
+			err := alice.DeleteAccount("wrong" + alicePassword)
+			Expect(err).ToNot(BeNil(), "Alice deleted the account with a wrong password.")
+			err = alice.DeleteAccount(alicePassword)
+			Expect(err).To(BeNil(), "Alice could not delete the account.")
+
+			_, err = client.GetUser(aliceUsername, alicePassword)
+			Expect(err).ToNot(BeNil(), "Alice still can log in.")
+			_, err = client.InitUser(aliceUsername, "new"+alicePassword)
+			Expect(err).ToNot(BeNil(), "Someone took over Alice's name.")
+
+			_, err = bob.LoadFile(someFilename)
+			Expect(err).ToNot(BeNil(), "Bob still can load the file.")
+			Expect(err.Error()).To(ContainSubstring("deleted their account"))
+			_, err = bob.CreateInvitation(someFilename, marcoUsername)
+			Expect(err).ToNot(BeNil(), "Bob shared a file of a deleted account.")
+			Expect(err.Error()).To(ContainSubstring(aliceUsername + " deleted their account"))
+			err = marco.AcceptInvitation(aliceUsername, pendingPtr, someFilename)
+			Expect(err).ToNot(BeNil(), "Marco accepted an invitation from a deleted account.")
+			Expect(err.Error()).To(ContainSubstring(aliceUsername + " deleted their account"))
+
+			_, err = bob.LoadFile(someOtherFilename)
+			Expect(err).ToNot(BeNil(), "Bob still can load a file shared by Alice.")
+			downloadedContent, err := marco.LoadFile(someOtherFilename)
+			Expect(err).To(BeNil(), "Marco could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+			err = marco.RevokeAccess(someOtherFilename, aliceUsername)
+			Expect(err).To(BeNil(), "Marco could not revoke Alice.")
+		})
+
+		It("should not take a tombstone Alice did not sign", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+
+			// Marco deletes his own account and copies his tombstone to Alice's
+			marcoTombstone, _ := uuid.FromBytes(userlib.Hash([]byte("TOMBSTONE" + marcoUsername))[:16])
+			aliceTombstone, _ := uuid.FromBytes(userlib.Hash([]byte("TOMBSTONE" + aliceUsername))[:16])
+			err := marco.DeleteAccount(marcoPassword)
+			Expect(err).To(BeNil(), "Marco could not delete the account.")
+			tombstone, _ := userlib.DatastoreGet(marcoTombstone)
+			userlib.DatastoreSet(aliceTombstone, tombstone)
+			_, dsKey, _ := userlib.DSKeyGen()
+			userlib.KeystoreSet(string(userlib.Hash([]byte("T" + aliceUsername))[:16]), dsKey)
+
+			_, err = client.GetUser(aliceUsername, alicePassword)
+			Expect(err).To(BeNil(), "Alice could not log in.")
+			downloadedContent, err := bob.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Bob could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+		})
+	})
+
+	Describe("Ownership transfer", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+			bob, _ = client.InitUser(bobUsername, bobPassword)
+			marco, _ = client.InitUser(marcoUsername, marcoPassword)
+			nilufar, _ = client.InitUser(nilufarUsername, nilufarPassword)
+			olga, _ = client.InitUser(olgaUsername, olgaPassword)
+		})
+
+		It("should hand the file to a recipient and keep everyone else", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+			ptr, _ = bob.CreateInvitation(someFilename, marcoUsername)
+			marco.AcceptInvitation(bobUsername, ptr, someFilename)
+			ptr, _ = alice.CreateInvitation(someFilename, nilufarUsername)
+			nilufar.AcceptInvitation(aliceUsername, ptr, someFilename)
+
+			_, err := bob.TransferOwnership(someFilename, marcoUsername)
+			Expect(err).ToNot(BeNil(), "Bob handed over a file owned by Alice.")
+			offerPtr, err := alice.TransferOwnership(someFilename, bobUsername)
+			Expect(err).To(BeNil(), "Alice could not offer the file to Bob.")
+			err = bob.AcceptOwnership(aliceUsername, offerPtr, someFilename)
+			Expect(err).To(BeNil(), "Bob could not take over the file.")
+
+			_, err = alice.LoadFile(someFilename)
+			Expect(err).ToNot(BeNil(), "Alice still can access.")
+			err = alice.RevokeAccess(someFilename, nilufarUsername)
+			Expect(err).ToNot(BeNil(), "Alice still can revoke.")
+
+			err = marco.AppendToFile(someFilename, []byte("m"))
+			Expect(err).To(BeNil(), "Marco could not append to the file.")
+			expected := append(append([]byte{}, someFileContent...), 'm')
+			downloadedContent, err := nilufar.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Nilufar could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(expected))
+
+			tree, err := bob.GetShareTree(someFilename)
+			Expect(err).To(BeNil(), "Bob could not get the share tree.")
+			Expect(tree.Username).To(Equal(bobUsername))
+			Expect(tree.Children).To(HaveLen(2))
+			Expect(tree.Children[0].Username).To(Equal(marcoUsername))
+			Expect(tree.Children[1].Username).To(Equal(nilufarUsername))
+
+			err = bob.RevokeAccess(someFilename, nilufarUsername)
+			Expect(err).To(BeNil(), "Bob could not revoke Nilufar.")
+			_, err = nilufar.LoadFile(someFilename)
+			Expect(err).ToNot(BeNil(), "Nilufar still can access.")
+			downloadedContent, err = marco.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Marco could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(expected))
+		})
+
+		It("should hand the file to someone new and honour the latest offer only", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+
+			staleOfferPtr, err := alice.TransferOwnership(someFilename, marcoUsername)
+			Expect(err).To(BeNil(), "Alice could not offer the file to Marco.")
+			offerPtr, err := alice.TransferOwnership(someFilename, olgaUsername)
+			Expect(err).To(BeNil(), "Alice could not offer the file to Olga.")
+			err = marco.AcceptOwnership(aliceUsername, staleOfferPtr, someFilename)
+			Expect(err).ToNot(BeNil(), "Marco took over with a replaced offer.")
+
+			err = olga.AcceptOwnership(aliceUsername, offerPtr, someOtherFilename)
+			Expect(err).To(BeNil(), "Olga could not take over the file.")
+			downloadedContent, err := olga.LoadFile(someOtherFilename)
+			Expect(err).To(BeNil(), "Olga could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+			downloadedContent, err = bob.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Bob could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+
+			// and on again, the chain follows both hand overs
+			offerPtr, err = olga.TransferOwnership(someOtherFilename, marcoUsername)
+			Expect(err).To(BeNil(), "Olga could not offer the file to Marco.")
+			err = marco.AcceptOwnership(olgaUsername, offerPtr, someFilename)
+			Expect(err).To(BeNil(), "Marco could not take over the file.")
+			err = bob.StoreFile(someFilename, []byte("new"))
+			Expect(err).To(BeNil(), "Bob could not overwrite the file.")
+			downloadedContent, err = marco.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Marco could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo([]byte("new")))
+			_, err = olga.LoadFile(someOtherFilename)
+			Expect(err).ToNot(BeNil(), "Olga still can access.")
+		})
+	})
+
+	Describe("Key rotation", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+			bob, _ = client.InitUser(bobUsername, bobPassword)
+			marco, _ = client.InitUser(marcoUsername, marcoPassword)
+		})
+
+		It("should keep old records readable across rotations", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+			pendingPtr, _ := alice.CreateInvitation(someFilename, marcoUsername)
+
+			err := alice.RotateKeys("wrong" + alicePassword)
+			Expect(err).ToNot(BeNil(), "Alice rotated with a wrong password.")
+			for i := 0; i < 2; i++ {
+				err = alice.RotateKeys(alicePassword)
+				Expect(err).To(BeNil(), "Alice could not rotate keys.")
+			}
+			err = bob.RotateKeys(bobPassword)
+			Expect(err).To(BeNil(), "Bob could not rotate keys.")
+
+			// signed and sealed before the rotation
+			err = marco.AcceptInvitation(aliceUsername, pendingPtr, someFilename)
+			Expect(err).To(BeNil(), "Marco could not accept an invitation from before the rotation.")
+			downloadedContent, err := bob.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Bob could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+
+			// and after
+			err = alice.AppendToFile(someFilename, []byte("a"))
+			Expect(err).To(BeNil(), "Alice could not append to the file.")
+			err = alice.RevokeAccess(someFilename, marcoUsername)
+			Expect(err).To(BeNil(), "Alice could not revoke Marco.")
+			alice, err = client.GetUser(aliceUsername, alicePassword)
+			Expect(err).To(BeNil(), "Alice could not log in.")
+			downloadedContent, err = alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(append(append([]byte{}, someFileContent...), 'a')))
+			downloadedContent, err = bob.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Bob could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(append(append([]byte{}, someFileContent...), 'a')))
+		})
+
+		It("should not trust a tampered rotation", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+
+			set := make(map[uuid.UUID]bool)
+			for k := range userlib.DatastoreGetMap() {
+				set[k] = true
+			}
+			err := alice.RotateKeys(alicePassword)
+			Expect(err).To(BeNil(), "Alice could not rotate keys.")
+			for k, v := range userlib.DatastoreGetMap() {
+				if !set[k] {
+					userlib.DatastoreSet(k, userlib.RandomBytes(len(v)))
+				}
+			}
+			// Bob keeps to Alice's old keys, what she signs with the new ones fails
+			downloadedContent, err := bob.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Bob could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+			alice.AppendToFile(someFilename, someFileContent)
+			_, err = bob.LoadFile(someFilename)
+			Expect(err).ToNot(BeNil(), "Bob trusted a tampered rotation.")
+		})
+
+		It("should skip keys published without a rotation", func() {
+			// Anyone can fill the keystore names of Alice's next keys
+			pkeKey, _, _ := userlib.PKEKeyGen()
+			_, dsKey, _ := userlib.DSKeyGen()
+			userlib.KeystoreSet(string(userlib.Hash([]byte("RP1:" + aliceUsername))[:16]), pkeKey)
+			userlib.KeystoreSet(string(userlib.Hash([]byte("RD1:" + aliceUsername))[:16]), dsKey)
+
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, err := alice.CreateInvitation(someFilename, bobUsername)
+			Expect(err).To(BeNil(), "Alice could not share with Bob.")
+			err = bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+			Expect(err).To(BeNil(), "Bob could not receive the file.")
+
+			err = alice.RotateKeys(alicePassword)
+			Expect(err).To(BeNil(), "Alice could not rotate keys.")
+			alice.AppendToFile(someFilename, someFileContent)
+			downloadedContent, err := bob.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Bob could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(append(append([]byte{}, someFileContent...), someFileContent...)))
+		})
+	})
+
+	Describe("Devices", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+			bob, _ = client.InitUser(bobUsername, bobPassword)
+			marco, _ = client.InitUser(marcoUsername, marcoPassword)
+			nilufar, _ = client.InitUser(nilufarUsername, nilufarPassword)
+			olga, _ = client.InitUser(olgaUsername, olgaPassword)
+		})
+
+		It("should stop a revoked device from reading new keys or signing", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			bob.StoreFile(someOtherFilename, someFileContent)
+			ptr, _ := bob.CreateInvitation(someOtherFilename, aliceUsername)
+			alice.AcceptInvitation(bobUsername, ptr, someOtherFilename)
+			ptr, _ = bob.CreateInvitation(someOtherFilename, nilufarUsername)
+			nilufar.AcceptInvitation(bobUsername, ptr, someOtherFilename)
+
+			secret, err := alice.AddDevice("laptop")
+			Expect(err).To(BeNil(), "Alice could not add a device.")
+			devices, err := alice.ListDevices()
+			Expect(err).To(BeNil(), "Alice could not list devices.")
+			Expect(devices).To(Equal([]string{"laptop"}))
+			_, err = client.GetUserOnDevice(aliceUsername, "laptop", userlib.RandomBytes(16))
+			Expect(err).ToNot(BeNil(), "The laptop logged in with a wrong secret.")
+			laptop, err := client.GetUserOnDevice(aliceUsername, "laptop", secret)
+			Expect(err).To(BeNil(), "The laptop could not log in.")
+			_, err = laptop.AddDevice("phone")
+			Expect(err).ToNot(BeNil(), "The laptop added a device.")
+
+			// the laptop works like Alice
+			downloadedContent, err := laptop.LoadFile(someOtherFilename)
+			Expect(err).To(BeNil(), "The laptop could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+			err = laptop.AppendToFile(someFilename, []byte("l"))
+			Expect(err).To(BeNil(), "The laptop could not append to the file.")
+			ptr, err = laptop.CreateInvitation(someFilename, marcoUsername)
+			Expect(err).To(BeNil(), "The laptop could not share the file.")
+			err = marco.AcceptInvitation(aliceUsername, ptr, someFilename)
+			Expect(err).To(BeNil(), "Marco could not receive the file.")
+
+			err = alice.RevokeDevice("laptop")
+			Expect(err).To(BeNil(), "Alice could not revoke the laptop.")
+			devices, err = alice.ListDevices()
+			Expect(err).To(BeNil(), "Alice could not list devices.")
+			Expect(devices).To(BeEmpty())
+			_, err = client.GetUserOnDevice(aliceUsername, "laptop", secret)
+			Expect(err).ToNot(BeNil(), "A revoked device logged in.")
+
+			// what the laptop signed before still holds
+			expected := append(append([]byte{}, someFileContent...), 'l')
+			downloadedContent, err = marco.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Marco could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(expected))
+			downloadedContent, err = alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(expected))
+
+			// new file keys are not sealed to it
+			err = bob.RevokeAccess(someOtherFilename, nilufarUsername)
+			Expect(err).To(BeNil(), "Bob could not revoke Nilufar.")
+			_, err = laptop.LoadFile(someOtherFilename)
+			Expect(err).ToNot(BeNil(), "The revoked laptop read a new file key.")
+			downloadedContent, err = alice.LoadFile(someOtherFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+
+			// and what it signs now is not trusted
+			ptr, _ = laptop.CreateInvitation(someFilename, olgaUsername)
+			err = olga.AcceptInvitation(aliceUsername, ptr, someFilename)
+			Expect(err).ToNot(BeNil(), "Olga accepted an invitation from a revoked device.")
+		})
+
+		It("should keep what Alice stores after a revoke from the revoked device", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			err := alice.CreateGroup("friends")
+			Expect(err).To(BeNil(), "Alice could not create a group.")
+			_, err = alice.AddMember("friends", bobUsername)
+			Expect(err).To(BeNil(), "Alice could not add Bob to the group.")
+			laptopSecret, err := alice.AddDevice("laptop")
+			Expect(err).To(BeNil(), "Alice could not add a device.")
+			phoneSecret, err := alice.AddDevice("phone")
+			Expect(err).To(BeNil(), "Alice could not add a device.")
+			laptop, err := client.GetUserOnDevice(aliceUsername, "laptop", laptopSecret)
+			Expect(err).To(BeNil(), "The laptop could not log in.")
+			downloadedContent, err := laptop.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "The laptop could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+
+			err = alice.RevokeDevice("laptop")
+			Expect(err).To(BeNil(), "Alice could not revoke the laptop.")
+			err = alice.StoreFile(someFilename, someShortFileContent)
+			Expect(err).To(BeNil(), "Alice could not store the file.")
+			err = alice.StoreFile(someOtherFilename, someFileContent)
+			Expect(err).To(BeNil(), "Alice could not store a new file.")
+
+			// the laptop's session still holds the old keys
+			_, err = laptop.LoadFile(someFilename)
+			Expect(err).ToNot(BeNil(), "The revoked laptop read what Alice stored after.")
+			_, err = laptop.LoadFile(someOtherFilename)
+			Expect(err).ToNot(BeNil(), "The revoked laptop read a file made after.")
+			_, err = laptop.ListFiles()
+			Expect(err).ToNot(BeNil(), "The revoked laptop read the file names.")
+			_, err = laptop.GetGroupMembers("friends")
+			Expect(err).ToNot(BeNil(), "The revoked laptop read the group.")
+
+			// the phone picks up the new keys
+			phone, err := client.GetUserOnDevice(aliceUsername, "phone", phoneSecret)
+			Expect(err).To(BeNil(), "The phone could not log in.")
+			downloadedContent, err = phone.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "The phone could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someShortFileContent))
+			members, err := phone.GetGroupMembers("friends")
+			Expect(err).To(BeNil(), "The phone could not read the group.")
+			Expect(members).To(Equal([]string{bobUsername}))
+			alice, err = client.GetUser(aliceUsername, alicePassword)
+			Expect(err).To(BeNil(), "Alice could not log in.")
+			filenames, err := alice.ListFiles()
+			Expect(err).To(BeNil(), "Alice could not list the files.")
+			Expect(filenames).To(HaveLen(2))
+			Expect(filenames).To(ContainElement(someOtherFilename))
+			orphans, err := alice.CollectGarbage(false)
+			Expect(err).To(BeNil(), "Alice could not collect garbage.")
+			Expect(orphans).To(BeEmpty())
+		})
+
+		It("should not take a device tombstone Alice did not sign", func() {
+			secret, err := alice.AddDevice("laptop")
+			Expect(err).To(BeNil(), "Alice could not add a device.")
+			_, err = bob.AddDevice("laptop")
+			Expect(err).To(BeNil(), "Bob could not add a device.")
+
+			// Bob's tombstone for his own laptop, moved over to Alice's
+			tombstonePtr := func(username string) uuid.UUID {
+				id := userlib.Hash(append(userlib.Hash([]byte(username)), []byte("laptop")...))
+				ptr, _ := uuid.FromBytes(userlib.Hash(append([]byte("REVOKED"), id...))[:16])
+				return ptr
+			}
+			err = bob.RevokeDevice("laptop")
+			Expect(err).To(BeNil(), "Bob could not revoke his laptop.")
+			tombstone, ok := userlib.DatastoreGet(tombstonePtr(bobUsername))
+			Expect(ok).To(BeTrue(), "Bob left no tombstone.")
+			userlib.DatastoreSet(tombstonePtr(aliceUsername), tombstone)
+
+			_, err = client.GetUserOnDevice(aliceUsername, "laptop", secret)
+			Expect(err).To(BeNil(), "The laptop could not log in.")
+		})
+	})
+
+	Describe("Recovery codes", func() {
+		It("should log in once per code and set a new password", func() {
+			alice, codes, err := client.InitUserWithRecovery(aliceUsername, alicePassword, 3)
+			Expect(err).To(BeNil(), "Alice could not sign up with recovery codes.")
+			Expect(codes).To(HaveLen(3))
+			alice.StoreFile(someFilename, someFileContent)
+
+			alice, err = client.RecoverUser(aliceUsername, codes[0], "new"+alicePassword)
+			Expect(err).To(BeNil(), "Could not recover the account with a code.")
+			downloadedContent, err := alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file after recovery.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+
+			_, err = client.GetUser(aliceUsername, alicePassword)
+			Expect(err).ToNot(BeNil(), "The old password still works.")
+			_, err = client.GetUser(aliceUsername, "new"+alicePassword)
+			Expect(err).To(BeNil(), "The new password does not work.")
+			_, err = client.RecoverUser(aliceUsername, codes[0], alicePassword)
+			Expect(err).ToNot(BeNil(), "A recovery code worked twice.")
+			_, err = client.RecoverUser(aliceUsername, "bad"+codes[1], alicePassword)
+			Expect(err).ToNot(BeNil(), "A made-up recovery code worked.")
+
+			// codes survive a key rotation
+			err = alice.RotateKeys("new" + alicePassword)
+			Expect(err).To(BeNil(), "Alice could not rotate keys.")
+			alice, err = client.RecoverUser(aliceUsername, codes[1], alicePassword)
+			Expect(err).To(BeNil(), "A recovery code stopped working after rotation.")
+			downloadedContent, err = alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Could not load the file after the second recovery.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+		})
+
+		It("should move the codes left to a new recovery key", func() {
+			alice, codes, err := client.InitUserWithRecovery(aliceUsername, alicePassword, 3)
+			Expect(err).To(BeNil(), "Alice could not sign up with recovery codes.")
+			alice.StoreFile(someFilename, someFileContent)
+			codePtr, _ := uuid.FromBytes(userlib.Hash([]byte("RECOVERY" + codes[1] + aliceUsername))[:16])
+			oldWrap, ok := userlib.DatastoreGet(codePtr)
+			Expect(ok).To(BeTrue(), "The code has no record.")
+
+			_, err = client.RecoverUser(aliceUsername, codes[0], "new"+alicePassword)
+			Expect(err).To(BeNil(), "Could not recover the account with a code.")
+
+			// the key the old wrap gives no longer opens the recovery copy
+			userlib.DatastoreSet(codePtr, oldWrap)
+			_, err = client.RecoverUser(aliceUsername, codes[1], alicePassword)
+			Expect(err).ToNot(BeNil(), "The old recovery key still opens the account.")
+			alice, err = client.RecoverUser(aliceUsername, codes[2], alicePassword)
+			Expect(err).To(BeNil(), "A code left stopped working.")
+			downloadedContent, err := alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Could not load the file after recovery.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+		})
+
+		It("should not take back a used code put back in place", func() {
+			_, codes, err := client.InitUserWithRecovery(aliceUsername, alicePassword, 2)
+			Expect(err).To(BeNil(), "Alice could not sign up with recovery codes.")
+			codePtr, _ := uuid.FromBytes(userlib.Hash([]byte("RECOVERY" + codes[0] + aliceUsername))[:16])
+			wrap, ok := userlib.DatastoreGet(codePtr)
+			Expect(ok).To(BeTrue(), "The code has no record.")
+
+			_, err = client.RecoverUser(aliceUsername, codes[0], "new"+alicePassword)
+			Expect(err).To(BeNil(), "Could not recover the account with a code.")
+			userlib.DatastoreSet(codePtr, wrap)
+			_, err = client.RecoverUser(aliceUsername, codes[0], alicePassword)
+			Expect(err).ToNot(BeNil(), "A used code worked again.")
+			_, err = client.GetUser(aliceUsername, "new"+alicePassword)
+			Expect(err).To(BeNil(), "The new password does not work.")
+		})
+
+		It("should not recover an account without codes", func() {
+			client.InitUser(bobUsername, bobPassword)
+			_, err := client.RecoverUser(bobUsername, "00000000000000000000000000000000", "new"+bobPassword)
+			Expect(err).ToNot(BeNil(), "Recovered an account that has no codes.")
+		})
+	})
+
+	Describe("Social recovery", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+			bob, _ = client.InitUser(bobUsername, bobPassword)
+			nilufar, _ = client.InitUser(nilufarUsername, nilufarPassword)
+			olga, _ = client.InitUser(olgaUsername, olgaPassword)
+			marco, _ = client.InitUser(marcoUsername, marcoPassword)
+		})
+
+		It("should reset the password once enough trustees approve", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			trustees := []string{bobUsername, nilufarUsername, olgaUsername}
+			err := alice.SetupSocialRecovery("wrong"+alicePassword, trustees, 2)
+			Expect(err).ToNot(BeNil(), "Set up recovery with a wrong password.")
+			err = alice.SetupSocialRecovery(alicePassword, trustees, 4)
+			Expect(err).ToNot(BeNil(), "Set up recovery with more approvals than trustees.")
+			err = alice.SetupSocialRecovery(alicePassword, trustees, 2)
+			Expect(err).To(BeNil(), "Could not set up recovery.")
+
+			request, err := client.RequestRecovery(aliceUsername)
+			Expect(err).To(BeNil(), "Could not request recovery.")
+			err = marco.ApproveRecovery(aliceUsername, request.Ptr)
+			Expect(err).ToNot(BeNil(), "Marco approved without a share.")
+			err = olga.ApproveRecovery(aliceUsername, request.Ptr)
+			Expect(err).To(BeNil(), "Olga could not approve.")
+			_, err = client.CompleteRecovery(request, "new"+alicePassword)
+			Expect(err).ToNot(BeNil(), "Recovered with one approval out of two.")
+
+			err = bob.ApproveRecovery(aliceUsername, request.Ptr)
+			Expect(err).To(BeNil(), "Bob could not approve.")
+			alice, err = client.CompleteRecovery(request, "new"+alicePassword)
+			Expect(err).To(BeNil(), "Could not recover with two approvals.")
+			downloadedContent, err := alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Could not load the file after recovery.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+			_, err = client.GetUser(aliceUsername, alicePassword)
+			Expect(err).ToNot(BeNil(), "The old password still works.")
+			_, err = client.GetUser(aliceUsername, "new"+alicePassword)
+			Expect(err).To(BeNil(), "The new password does not work.")
+		})
+
+		It("should drop old shares when the trustees change", func() {
+			err := alice.SetupSocialRecovery(alicePassword, []string{bobUsername, nilufarUsername}, 2)
+			Expect(err).To(BeNil(), "Could not set up recovery.")
+			err = alice.SetupSocialRecovery(alicePassword, []string{bobUsername, marcoUsername}, 2)
+			Expect(err).To(BeNil(), "Could not change the trustees.")
+
+			request, _ := client.RequestRecovery(aliceUsername)
+			err = nilufar.ApproveRecovery(aliceUsername, request.Ptr)
+			Expect(err).ToNot(BeNil(), "A former trustee approved.")
+			bob.ApproveRecovery(aliceUsername, request.Ptr)
+			_, err = client.CompleteRecovery(request, "new"+alicePassword)
+			Expect(err).ToNot(BeNil(), "Recovered without Marco.")
+			err = marco.ApproveRecovery(aliceUsername, request.Ptr)
+			Expect(err).To(BeNil(), "Marco could not approve.")
+			_, err = client.CompleteRecovery(request, "new"+alicePassword)
+			Expect(err).To(BeNil(), "Could not recover with the new trustees.")
+		})
+
+		It("should hand out new shares after a recovery", func() {
+			err := alice.SetupSocialRecovery(alicePassword, []string{bobUsername, nilufarUsername}, 2)
+			Expect(err).To(BeNil(), "Could not set up recovery.")
+			sharePtr := func(trustee string) uuid.UUID {
+				id := userlib.Hash(append(userlib.Hash([]byte(aliceUsername)), []byte(trustee)...))
+				ptr, _ := uuid.FromBytes(userlib.Hash(append([]byte("SHARE"), id...))[:16])
+				return ptr
+			}
+			socialPtr, _ := uuid.FromBytes(userlib.Hash([]byte("SOCIAL" + aliceUsername))[:16])
+			oldRecords := make(map[uuid.UUID][]byte)
+			for _, ptr := range []uuid.UUID{sharePtr(bobUsername), sharePtr(nilufarUsername), socialPtr} {
+				content, ok := userlib.DatastoreGet(ptr)
+				Expect(ok).To(BeTrue(), "Recovery left a record out.")
+				oldRecords[ptr] = content
+			}
+
+			request, _ := client.RequestRecovery(aliceUsername)
+			bob.ApproveRecovery(aliceUsername, request.Ptr)
+			nilufar.ApproveRecovery(aliceUsername, request.Ptr)
+			_, err = client.CompleteRecovery(request, "new"+alicePassword)
+			Expect(err).To(BeNil(), "Could not recover with two approvals.")
+
+			// the new shares work
+			request, _ = client.RequestRecovery(aliceUsername)
+			bob.ApproveRecovery(aliceUsername, request.Ptr)
+			nilufar.ApproveRecovery(aliceUsername, request.Ptr)
+			_, err = client.CompleteRecovery(request, alicePassword)
+			Expect(err).To(BeNil(), "Could not recover with the new shares.")
+
+			// the old ones give a key that no longer opens the recovery copy
+			for ptr, content := range oldRecords {
+				userlib.DatastoreSet(ptr, content)
+			}
+			request, _ = client.RequestRecovery(aliceUsername)
+			bob.ApproveRecovery(aliceUsername, request.Ptr)
+			nilufar.ApproveRecovery(aliceUsername, request.Ptr)
+			_, err = client.CompleteRecovery(request, "new"+alicePassword)
+			Expect(err).ToNot(BeNil(), "The old shares still open the account.")
+			_, err = client.GetUser(aliceUsername, alicePassword)
+			Expect(err).To(BeNil(), "The password set by the last recovery does not work.")
+		})
+
+		It("should not approve a request for someone else", func() {
+			alice.SetupSocialRecovery(alicePassword, []string{bobUsername}, 1)
+			request, _ := client.RequestRecovery(marcoUsername)
+			err := bob.ApproveRecovery(aliceUsername, request.Ptr)
+			Expect(err).ToNot(BeNil(), "Bob approved a request made for another user.")
+		})
+	})
+
+	Describe("Contacts", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+			bob, _ = client.InitUser(bobUsername, bobPassword)
+			marco, _ = client.InitUser(marcoUsername, marcoPassword)
+		})
+
+		It("should pin keys on first use and follow rotations", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			_, err := alice.CreateInvitation(someFilename, bobUsername)
+			Expect(err).To(BeNil(), "Alice could not invite Bob.")
+			contacts, err := alice.ListContacts()
+			Expect(err).To(BeNil(), "Alice could not list contacts.")
+			Expect(contacts).To(HaveKeyWithValue(bobUsername, false))
+
+			err = bob.RotateKeys(bobPassword)
+			Expect(err).To(BeNil(), "Bob could not rotate keys.")
+			alice.StoreFile(someOtherFilename, someFileContent)
+			_, err = alice.CreateInvitation(someOtherFilename, bobUsername)
+			Expect(err).To(BeNil(), "A signed rotation was taken for a key change.")
+		})
+
+		It("should fail on swapped keys until verified out of band", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			bobFingerprint, err := bob.Fingerprint(bobUsername)
+			Expect(err).To(BeNil(), "Could not get the fingerprint of Bob's keys.")
+			err = alice.VerifyContact(bobUsername, bobFingerprint+"0")
+			Expect(err).ToNot(BeNil(), "Verified a wrong fingerprint.")
+			err = alice.VerifyContact(bobUsername, bobFingerprint)
+			Expect(err).To(BeNil(), "Alice could not verify Bob.")
+
+			// the keystore now hands out Marco's keys for Bob
+			keystore := userlib.KeystoreGetMap()
+			for _, prefix := range []string{"P", "D"} {
+				keystore[string(userlib.Hash([]byte(prefix + bobUsername))[:16])] =
+					keystore[string(userlib.Hash([]byte(prefix + marcoUsername))[:16])]
+			}
+			_, err = alice.CreateInvitation(someFilename, bobUsername)
+			Expect(err).ToNot(BeNil(), "Invited Bob under swapped keys.")
+
+			marcoFingerprint, _ := marco.Fingerprint(marcoUsername)
+			fingerprint, _ := alice.Fingerprint(bobUsername)
+			Expect(fingerprint).To(Equal(marcoFingerprint))
+			err = alice.VerifyContact(bobUsername, fingerprint)
+			Expect(err).To(BeNil(), "Could not accept the new keys.")
+			_, err = alice.CreateInvitation(someFilename, bobUsername)
+			Expect(err).To(BeNil(), "Could not invite after accepting the new keys.")
+		})
+	})
+
+	Describe("Dedup", func() {
+		datastoreBytes := func() int {
+			total := 0
+			for _, v := range userlib.DatastoreGetMap() {
+				total += len(v)
+			}
+			return total
+		}
+
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+			bob, _ = client.InitUser(bobUsername, bobPassword)
+		})
+
+		It("should store equal content once across users", func() {
+			bigContent := userlib.RandomBytes(8*4096 + 100)
+			dedup := client.FileOptions{Dedup: true}
+			err := alice.StoreFileWithOptions(someFilename, bigContent, dedup)
+			Expect(err).To(BeNil(), "Alice could not store with dedup.")
+
+			before := datastoreBytes()
+			err = bob.StoreFileWithOptions(someOtherFilename, bigContent, dedup)
+			Expect(err).To(BeNil(), "Bob could not store with dedup.")
+			Expect(datastoreBytes() - before).To(BeNumerically("<", len(bigContent)), "Bob stored the content again.")
+
+			err = alice.AppendToFile(someFilename, someFileContent)
+			Expect(err).To(BeNil(), "Alice could not append.")
+			downloadedContent, err := alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(append(append([]byte{}, bigContent...), someFileContent...)))
+
+			// still referenced by Bob
+			err = alice.StoreFile(someFilename, someFileContent)
+			Expect(err).To(BeNil(), "Alice could not overwrite the file.")
+			downloadedContent, err = bob.LoadFile(someOtherFilename)
+			Expect(err).To(BeNil(), "Bob lost chunks Alice dropped.")
+			Expect(downloadedContent).To(BeEquivalentTo(bigContent))
+
+			before = datastoreBytes()
+			err = bob.StoreFile(someOtherFilename, someFileContent)
+			Expect(err).To(BeNil(), "Bob could not overwrite the file.")
+			Expect(before - datastoreBytes()).To(BeNumerically(">", len(bigContent)), "Unused chunks were left behind.")
+		})
+
+		It("should not drop a chunk over a damaged reference", func() {
+			dedup := client.FileOptions{Dedup: true}
+			alice.StoreFileWithOptions(someFilename, someFileContent, dedup)
+			bob.StoreFileWithOptions(someOtherFilename, someFileContent, dedup)
+
+			// Bob's reference, the second slot of the one chunk
+			key := userlib.Hash(append([]byte("DEDUPKEY"), someFileContent...))[:16]
+			id, _ := uuid.FromBytes(userlib.Hash(append([]byte("DEDUPID"), key...))[:16])
+			refPtr, _ := uuid.FromBytes(userlib.Hash([]byte("DEDUPREF1:" + id.String()))[:16])
+			_, ok := userlib.DatastoreGet(refPtr)
+			Expect(ok).To(BeTrue(), "No reference where Bob's should be.")
+			userlib.DatastoreSet(refPtr, userlib.RandomBytes(100))
+
+			err := alice.StoreFile(someFilename, someShortFileContent)
+			Expect(err).To(BeNil(), "Alice could not overwrite the file.")
+			downloadedContent, err := bob.LoadFile(someOtherFilename)
+			Expect(err).To(BeNil(), "Bob lost the chunk to a damaged reference.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+		})
+
+		It("should keep convergent chunks readable to members after a revoke", func() {
+			alice.StoreFileWithOptions(someFilename, someFileContent, client.FileOptions{Dedup: true})
+			nilufar, _ = client.InitUser(nilufarUsername, nilufarPassword)
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+			ptr, _ = alice.CreateInvitation(someFilename, nilufarUsername)
+			nilufar.AcceptInvitation(aliceUsername, ptr, someFilename)
+
+			err := alice.RevokeAccess(someFilename, nilufarUsername)
+			Expect(err).To(BeNil(), "Alice could not revoke Nilufar.")
+			downloadedContent, err := bob.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Bob could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+			_, err = nilufar.LoadFile(someFilename)
+			Expect(err).ToNot(BeNil(), "Nilufar loaded the file after the revoke.")
+		})
+	})
+
+	Describe("Compression", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+		})
+
+		It("should round trip what it compresses", func() {
+			repetitive := []byte{}
+			for i := 0; i < 2000; i++ {
+				repetitive = append(repetitive, []byte("abab")...)
+				repetitive = append(repetitive, byte(i%7))
+			}
+			options := client.FileOptions{Compress: true}
+			for _, content := range [][]byte{repetitive, userlib.RandomBytes(5000), {}} {
+				err := alice.StoreFileWithOptions(someFilename, content, options)
+				Expect(err).To(BeNil(), "Could not store compressed content.")
+				downloadedContent, err := alice.LoadFile(someFilename)
+				Expect(err).To(BeNil(), "Could not load compressed content.")
+				Expect(downloadedContent).To(BeEquivalentTo(content))
+			}
+
+			// appends are compressed too, and mix with dedup
+			options.Dedup = true
+			err := alice.StoreFileWithOptions(someOtherFilename, repetitive, options)
+			Expect(err).To(BeNil(), "Could not store with compression and dedup.")
+			err = alice.AppendToFile(someOtherFilename, repetitive)
+			Expect(err).To(BeNil(), "Could not append.")
+			downloadedContent, err := alice.LoadFile(someOtherFilename)
+			Expect(err).To(BeNil(), "Could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(append(append([]byte{}, repetitive...), repetitive...)))
+		})
+
+		It("should take less space for repetitive content", func() {
+			datastoreBytes := func() int {
+				total := 0
+				for _, v := range userlib.DatastoreGetMap() {
+					total += len(v)
+				}
+				return total
+			}
+			repetitive := make([]byte, 64*1024)
+			before := datastoreBytes()
+			alice.StoreFile(someFilename, repetitive)
+			plainGrowth := datastoreBytes() - before
+			before = datastoreBytes()
+			err := alice.StoreFileWithOptions(someOtherFilename, repetitive, client.FileOptions{Compress: true})
+			Expect(err).To(BeNil(), "Could not store compressed content.")
+			Expect(datastoreBytes() - before).To(BeNumerically("<", plainGrowth-len(repetitive)/2))
+			downloadedContent, err := alice.LoadFile(someOtherFilename)
+			Expect(err).To(BeNil(), "Could not load compressed content.")
+			Expect(downloadedContent).To(BeEquivalentTo(repetitive))
+		})
+	})
+
+	Describe("Merkle integrity", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+		})
+
+		It("should read any range across appended chunks", func() {
+			content := userlib.RandomBytes(3*4096 + 10)
+			alice.StoreFileWithOptions(someFilename, content, client.FileOptions{Dedup: true, Compress: true})
+			alice.AppendToFile(someFilename, someShortFileContent)
+			alice.AppendToFile(someFilename, someLongFileContent)
+			content = append(append(content, someShortFileContent...), someLongFileContent...)
+
+			for _, r := range [][2]int{{0, 0}, {0, 10}, {4090, 20}, {3*4096 + 5, 30}, {0, len(content)}, {len(content) - 1, 1}} {
+				part, err := alice.LoadFileRange(someFilename, r[0], r[1])
+				Expect(err).To(BeNil(), "Alice could not read a range.")
+				Expect(part).To(BeEquivalentTo(content[r[0] : r[0]+r[1]]))
+			}
+			_, err := alice.LoadFileRange(someFilename, len(content)-1, 2)
+			Expect(err).ToNot(BeNil(), "Read past the end of the file.")
+			_, err = alice.LoadFileRange(someFilename, -1, 2)
+			Expect(err).ToNot(BeNil(), "Read from a negative offset.")
+		})
+
+		It("should only fail the ranges over a damaged chunk", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			before := map[userlib.UUID]bool{}
+			for k := range userlib.DatastoreGetMap() {
+				before[k] = true
+			}
+			alice.AppendToFile(someFilename, userlib.RandomBytes(8192))
+			for k, v := range userlib.DatastoreGetMap() {
+				if !before[k] && len(v) > 8192 {
+					userlib.DatastoreSet(k, userlib.RandomBytes(len(v)))
+				}
+			}
+
+			part, err := alice.LoadFileRange(someFilename, 0, len(someFileContent))
+			Expect(err).To(BeNil(), "Alice could not read the untouched chunk.")
+			Expect(part).To(BeEquivalentTo(someFileContent))
+			_, err = alice.LoadFileRange(someFilename, len(someFileContent), 1)
+			Expect(err).ToNot(BeNil(), "Alice read a damaged chunk.")
+			_, err = alice.LoadFile(someFilename)
+			Expect(err).ToNot(BeNil(), "Alice loaded a damaged file.")
+		})
+	})
+
+	Describe("Blame", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+			bob, _ = client.InitUser(bobUsername, bobPassword)
+			olga, _ = client.InitUser(olgaUsername, olgaPassword)
+		})
+
+		It("should tell who wrote each part and keep it after a revoke", func() {
+			bigContent := userlib.RandomBytes(2*4096 + 10)
+			alice.StoreFileWithOptions(someFilename, bigContent, client.FileOptions{Dedup: true})
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+			err := bob.AppendToFile(someFilename, someShortFileContent)
+			Expect(err).To(BeNil(), "Bob could not append.")
+
+			ranges, err := alice.Blame(someFilename)
+			Expect(err).To(BeNil(), "Alice could not blame the file.")
+			Expect(ranges).To(HaveLen(2))
+			Expect(ranges[0].Author).To(Equal(aliceUsername))
+			Expect(ranges[0].Start).To(Equal(0))
+			Expect(ranges[0].End).To(Equal(len(bigContent)))
+			Expect(ranges[1].Author).To(Equal(bobUsername))
+			Expect(ranges[1].End).To(Equal(len(bigContent) + len(someShortFileContent)))
+			Expect(ranges[1].Seq).To(BeNumerically(">", ranges[0].Seq))
+
+			// written before the revoke, so still good
+			err = alice.RevokeAccess(someFilename, bobUsername)
+			Expect(err).To(BeNil(), "Alice could not revoke Bob.")
+			ranges, err = alice.Blame(someFilename)
+			Expect(err).To(BeNil(), "Alice could not blame the file after the revoke.")
+			Expect(ranges[1].Author).To(Equal(bobUsername))
+			_, err = alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file after the revoke.")
+		})
+
+		It("should reject chunks written after a revoke by a non-owner", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+			ptr, _ = bob.CreateInvitation(someFilename, olgaUsername)
+			olga.AcceptInvitation(bobUsername, ptr, someFilename)
+			kept := map[userlib.UUID][]byte{}
+			for k, v := range userlib.DatastoreGetMap() {
+				kept[k] = v
+			}
+			err := bob.RevokeAccess(someFilename, olgaUsername)
+			Expect(err).To(BeNil(), "Bob could not revoke Olga.")
+
+			// Olga still holds her keys until Alice acts on the revoke
+			for k, v := range kept {
+				_, ok := userlib.DatastoreGet(k)
+				if !ok {
+					userlib.DatastoreSet(k, v)
+				}
+			}
+			err = olga.AppendToFile(someFilename, someShortFileContent)
+			Expect(err).To(BeNil(), "Olga could not append with her old keys.")
+
+			_, err = alice.LoadFile(someFilename)
+			Expect(err).ToNot(BeNil(), "Alice took a chunk Olga wrote after her revoke.")
+			err = alice.StoreFile(someFilename, someFileContent)
+			Expect(err).To(BeNil(), "Alice could not store over it.")
+			downloadedContent, err := bob.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Bob could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(someFileContent))
+		})
+
+		It("should only let the owner share with a revoked user again", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+			ptr, _ = alice.CreateInvitation(someFilename, olgaUsername)
+			olga.AcceptInvitation(aliceUsername, ptr, someFilename)
+			alice.RevokeAccess(someFilename, bobUsername)
+
+			_, err := olga.CreateInvitation(someFilename, bobUsername)
+			Expect(err).ToNot(BeNil(), "Olga shared with someone the owner revoked.")
+			ptr, err = alice.CreateInvitation(someFilename, bobUsername)
+			Expect(err).To(BeNil(), "Alice could not share with Bob again.")
+			err = bob.AcceptInvitation(aliceUsername, ptr, someOtherFilename)
+			Expect(err).To(BeNil(), "Bob could not accept the file again.")
+			err = bob.AppendToFile(someOtherFilename, someShortFileContent)
+			Expect(err).To(BeNil(), "Bob could not append again.")
+			downloadedContent, err := olga.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Olga could not load the file.")
+			Expect(downloadedContent).To(BeEquivalentTo(append(append([]byte{}, someFileContent...), someShortFileContent...)))
+		})
+	})
+
+	Describe("Audit log", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+			bob, _ = client.InitUser(bobUsername, bobPassword)
+		})
+
+		It("should record who did what to the file, for the owner only", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+			bob.AppendToFile(someFilename, someShortFileContent)
+			alice.RevokeAccess(someFilename, bobUsername)
+
+			entries, err := alice.AuditLog(someFilename)
+			Expect(err).To(BeNil(), "Alice could not read the audit log.")
+			Expect(entries).To(HaveLen(5))
+			expected := [][3]string{
+				{aliceUsername, "store", ""},
+				{aliceUsername, "invite", bobUsername},
+				{bobUsername, "accept", aliceUsername},
+				{bobUsername, "append", ""},
+				{aliceUsername, "revoke", bobUsername},
+			}
+			for i, entry := range entries {
+				Expect([3]string{entry.Actor, entry.Action, entry.Target}).To(Equal(expected[i]))
+				Expect(entry.Seq).To(Equal(i))
+			}
+
+			ptr, _ = alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someOtherFilename)
+			_, err = bob.AuditLog(someOtherFilename)
+			Expect(err).ToNot(BeNil(), "Bob read the audit log of Alice's file.")
+		})
+
+		It("should notice entries dropped from the end", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			before := map[userlib.UUID]bool{}
+			for k := range userlib.DatastoreGetMap() {
+				before[k] = true
+			}
+			alice.AppendToFile(someFilename, someShortFileContent)
+			entries, err := alice.AuditLog(someFilename)
+			Expect(err).To(BeNil(), "Alice could not read the audit log.")
+			Expect(entries).To(HaveLen(2))
+
+			for k := range userlib.DatastoreGetMap() {
+				if !before[k] {
+					userlib.DatastoreDelete(k)
+				}
+			}
+			_, err = alice.AuditLog(someFilename)
+			Expect(err).ToNot(BeNil(), "Alice missed a truncated audit log.")
+		})
+
+		It("should not write over entries past a head rolled back", func() {
+			alice.StoreFile(someFilename, someFileContent)
+			before := map[userlib.UUID][]byte{}
+			for k, v := range userlib.DatastoreGetMap() {
+				before[k] = v
+			}
+			_, err := alice.CreateInvitation(someFilename, bobUsername)
+			Expect(err).To(BeNil(), "Alice could not invite Bob.")
+
+			// Everything Alice had goes back, the new entry stays
+			for k, v := range before {
+				userlib.DatastoreSet(k, v)
+			}
+			err = alice.AppendToFile(someFilename, someShortFileContent)
+			Expect(err).To(BeNil(), "Alice could not append.")
+
+			entries, err := alice.AuditLog(someFilename)
+			Expect(err).To(BeNil(), "Alice could not read the audit log.")
+			Expect(entries).To(HaveLen(3))
+			Expect(entries[1].Action).To(Equal("invite"))
+			Expect(entries[2].Action).To(Equal("append"))
+		})
+	})
+
+	Describe("List files", func() {
+		It("should list the names the user gave their files", func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+			bob, _ = client.InitUser(bobUsername, bobPassword)
+			filenames, err := alice.ListFiles()
+			Expect(err).To(BeNil(), "Alice could not list the files.")
+			Expect(filenames).To(BeEmpty())
+
+			alice.StoreFile(someFilename, someFileContent)
+			bob.StoreFile(someFilename, someFileContent)
+			ptr, _ := bob.CreateInvitation(someFilename, aliceUsername)
+			alice.AcceptInvitation(bobUsername, ptr, someOtherFilename)
+			filenames, err = alice.ListFiles()
+			Expect(err).To(BeNil(), "Alice could not list the files.")
+			Expect(filenames).To(HaveLen(2))
+			Expect(filenames).To(ContainElement(someFilename))
+			Expect(filenames).To(ContainElement(someOtherFilename))
+		})
+	})
+
+	Describe("Batch datastore", func() {
+		var backend *countingBackend
+		BeforeEach(func() {
+			backend = &countingBackend{}
+			alice, _ = client.NewClient(backend).InitUser(aliceUsername, alicePassword)
+		})
+
+		It("should fetch a file's chunks in one batch", func() {
+			loadGets := func() int {
+				backend.gets = 0
+				data, err := alice.LoadFile(someFilename)
+				Expect(err).To(BeNil(), "Alice could not load the file.")
+				Expect(len(data) > 0).To(BeTrue())
+				return backend.gets
+			}
+
+			alice.StoreFile(someFilename, someFileContent)
+			alice.AppendToFile(someFilename, someShortFileContent)
+			few := loadGets()
+			for i := 0; i < 10; i++ {
+				alice.AppendToFile(someFilename, someShortFileContent)
+			}
+			Expect(loadGets()).To(Equal(few), "LoadFile fetched chunks one by one.")
+		})
+
+		It("should write a revocation out in a few batches", func() {
+			bob, _ = client.InitUser(bobUsername, bobPassword)
+			nilufar, _ = client.InitUser(nilufarUsername, nilufarPassword)
+			alice.StoreFile(someFilename, someFileContent)
+			for i := 0; i < 5; i++ {
+				alice.AppendToFile(someFilename, someShortFileContent)
+			}
+			ptr, _ := alice.CreateInvitation(someFilename, bobUsername)
+			bob.AcceptInvitation(aliceUsername, ptr, someFilename)
+			ptr, _ = alice.CreateInvitation(someFilename, nilufarUsername)
+			nilufar.AcceptInvitation(aliceUsername, ptr, someFilename)
+
+			backend.writes = 0
+			err := alice.RevokeAccess(someFilename, bobUsername)
+			Expect(err).To(BeNil(), "Alice could not revoke Bob.")
+			Expect(backend.writes).To(Equal(3), "The revocation was not written between its journal's write and delete.")
+			data, err := nilufar.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Nilufar lost the file.")
+			Expect(len(data)).To(Equal(len(someFileContent) + 5 * len(someShortFileContent)))
+			_, err = bob.LoadFile(someFilename)
+			Expect(err).ToNot(BeNil(), "Bob kept the file.")
+		})
+
+		It("should return the backend's errors and drop the writes", func() {
+			alice.StoreFile(someFilename, someFileContent)
+
+			backend.down = true
+			err := alice.StoreFile(someFilename, someShortFileContent)
+			Expect(err).To(Equal(backendDown{}), "StoreFile hid the backend's error.")
+			_, err = alice.LoadFile(someFilename)
+			Expect(err).To(Equal(backendDown{}), "LoadFile took the backend's error for a missing file.")
+			_, err = alice.ListFiles()
+			Expect(err).To(Equal(backendDown{}), "ListFiles hid the backend's error.")
+
+			backend.down = false
+			data, err := alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file.")
+			Expect(data).To(Equal(someFileContent))
+			alice, err = client.GetUser(aliceUsername, alicePassword)
+			Expect(err).To(BeNil(), "Alice could not log in again.")
+			data, err = alice.LoadFile(someFilename)
+			Expect(err).To(BeNil(), "Alice could not load the file after logging in again.")
+			Expect(data).To(Equal(someFileContent))
+		})
+	})
+
+	Describe("Parallel load", func() {
+		BeforeEach(func() {
+			alice, _ = client.InitUser(aliceUsername, alicePassword)
+		})
+
+		It("should put the chunks back in order", func() {
+			defer func(n int) { client.LoadConcurrency = n }(client.LoadConcurrency)
+			expected := []byte{}
+			alice.StoreFile(someFilename, []byte{})
+			for i := 0; i < 50; i++ {
+				part := []byte{byte(i), ','}
+				alice.AppendToFile(someFilename, part)
+				expected = append(expected, part...)
+			}
+			for _, n := range []int{1, 3, 8} {
+				client.LoadConcurrency = n
+				data, err := alice.LoadFile(someFilename)
+				Expect(err).To(BeNil(), "Alice could not load the file.")
+				Expect(data).To(Equal(expected))
+			}
+			data, err := alice.LoadFileRange(someFilename, 40, 60)
+			Expect(err).To(BeNil(), "Alice could not load part of the file.")
+			Expect(data).To(Equal(expected[40:100]))
+		})
+
+		It("should fail on a damaged chunk in the middle", func() {
+			defer func(n int) { client.LoadConcurrency = n }(client.LoadConcurrency)
+			alice.StoreFile(someFilename, someFileContent)
+			for i := 0; i < 20; i++ {
+				alice.AppendToFile(someFilename, someShortFileContent)
+			}
+			before := map[userlib.UUID]bool{}
+			for k := range userlib.DatastoreGetMap() {
+				before[k] = true
+			}
+			alice.AppendToFile(someFilename, userlib.RandomBytes(8192))
+			for i := 0; i < 20; i++ {
+				alice.AppendToFile(someFilename, someShortFileContent)
+			}
+			for k, v := range userlib.DatastoreGetMap() {
+				if !before[k] && len(v) > 8192 {
+					v[len(v) / 2] ^= 1
+				}
+			}
+			client.LoadConcurrency = 8
+			_, err := alice.LoadFile(someFilename)
+			Expect(err).ToNot(BeNil(), "Alice loaded a damaged file.")
+		})
+	})
 })
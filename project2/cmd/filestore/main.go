@@ -0,0 +1,304 @@
+// Command filestore uses the file store from the shell, on a Datastore and
+// Keystore kept in a local directory or on a storeserver.
+//
+//	filestore [-dir DIR] [-remote URL] COMMAND [ARGS]
+//
+//	register USER              password on stdin
+//	login USER                 password on stdin, prints the session key
+//	logout                     ends the session in FILESTORE_SESSION
+//	put FILE [LOCAL]           content from LOCAL or stdin
+//	get FILE [LOCAL]           content to LOCAL or stdout
+//	append FILE [LOCAL]        content from LOCAL or stdin
+//	ls
+//	share FILE USER [PERM]     PERM is read, append or write; prints the invitation
+//	accept SENDER INVITATION FILE
+//	revoke FILE USER
+//	tree FILE
+//
+// Every command but register, login and logout runs as the user logged in
+// with the key in FILESTORE_SESSION, so a session goes like
+//
+//	export FILESTORE_SESSION=$(filestore login alice < password.txt)
+//
+// DIR defaults to FILESTORE_DIR, or .filestore in the working directory.
+// With -remote, or FILESTORE_REMOTE, the records are on the storeserver at
+// URL instead and DIR only holds the sessions.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+	"github.com/cs161-staff/project2-starter-code/localstore"
+	"github.com/cs161-staff/project2-starter-code/remotestore"
+)
+
+type command struct {
+	args string // for usage
+	minArgs int
+	maxArgs int
+	needsUser bool
+	run func(env *cmdEnv, args []string) error
+}
+
+// what a command runs with
+type cmdEnv struct {
+	sessions sessionStore
+	client *client.Client
+	user *client.User
+	stdin io.Reader
+	stdout io.Writer
+}
+
+var commands = map[string]command{
+	"register": {"USER", 1, 1, false, cmdRegister},
+	"login": {"USER", 1, 1, false, cmdLogin},
+	"logout": {"", 0, 0, false, cmdLogout},
+	"put": {"FILE [LOCAL]", 1, 2, true, cmdPut},
+	"get": {"FILE [LOCAL]", 1, 2, true, cmdGet},
+	"append": {"FILE [LOCAL]", 1, 2, true, cmdAppend},
+	"ls": {"", 0, 0, true, cmdList},
+	"share": {"FILE USER [read|append|write]", 2, 3, true, cmdShare},
+	"accept": {"SENDER INVITATION FILE", 3, 3, true, cmdAccept},
+	"revoke": {"FILE USER", 2, 2, true, cmdRevoke},
+	"tree": {"FILE", 1, 1, true, cmdTree},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: filestore [-dir DIR] [-remote URL] COMMAND [ARGS]")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", name, commands[name].args)
+	}
+}
+
+func main() {
+	defaultDir := os.Getenv("FILESTORE_DIR")
+	if defaultDir == "" {
+		defaultDir = ".filestore"
+	}
+	dir := flag.String("dir", defaultDir, "store directory")
+	remote := flag.String("remote", os.Getenv("FILESTORE_REMOTE"), "storeserver URL")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	name, args := flag.Arg(0), flag.Args()[1:]
+	cmd, ok := commands[name]
+	if !ok || len(args) < cmd.minArgs || len(args) > cmd.maxArgs {
+		usage()
+		os.Exit(2)
+	}
+
+	err := run(*dir, *remote, cmd, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "filestore: " + err.Error())
+		os.Exit(1)
+	}
+}
+
+// load the store, run the command, save the store
+func run(dir string, remote string, cmd command, args []string) (err error) {
+	var store *localstore.Store
+	c := client.NewClient(client.UserlibBackend{})
+	if remote == "" {
+		store, err = localstore.Open(dir)
+		if err != nil {
+			return err
+		}
+	} else {
+		c = client.NewClient(remotestore.New(remote))
+	}
+	env := &cmdEnv{sessionStore(dir), c, nil, os.Stdin, os.Stdout}
+	if cmd.needsUser {
+		sess, err := env.sessions.loadSession(os.Getenv("FILESTORE_SESSION"))
+		if err != nil {
+			return err
+		}
+		env.user, err = env.client.GetUserWithKey(sess.Username, sess.LoginKey)
+		if err != nil {
+			return err
+		}
+	}
+	cmdErr := cmd.run(env, args)
+
+	if store == nil {
+		return cmdErr
+	}
+	// The client rolls back failed operations itself, anything left is done
+	err = store.Save()
+	if cmdErr != nil {
+		return cmdErr
+	}
+	return err
+}
+
+// the first line of stdin, so passwords can be piped in
+func readPassword(env *cmdEnv) (string, error) {
+	line, err := bufio.NewReader(env.stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("no password on stdin")
+	}
+	return password, nil
+}
+func readContent(env *cmdEnv, args []string) ([]byte, error) {
+	if len(args) > 1 {
+		return os.ReadFile(args[1])
+	}
+	return io.ReadAll(env.stdin)
+}
+func parsePermission(name string) (client.Permission, error) {
+	switch name {
+	case "read":
+		return client.PermissionRead, nil
+	case "append":
+		return client.PermissionAppend, nil
+	case "write":
+		return client.PermissionWrite, nil
+	}
+	return 0, errors.New("permission must be read, append or write")
+}
+func permissionName(perm client.Permission) string {
+	switch perm {
+	case client.PermissionRead:
+		return "read"
+	case client.PermissionAppend:
+		return "append"
+	case client.PermissionWrite:
+		return "write"
+	}
+	return "none"
+}
+
+// *********** Commands **************
+func cmdRegister(env *cmdEnv, args []string) error {
+	password, err := readPassword(env)
+	if err != nil {
+		return err
+	}
+	_, err = env.client.InitUser(args[0], password)
+	return err
+}
+func cmdLogin(env *cmdEnv, args []string) error {
+	password, err := readPassword(env)
+	if err != nil {
+		return err
+	}
+	_, err = env.client.GetUser(args[0], password)
+	if err != nil {
+		return err
+	}
+	key, err := env.sessions.saveSession(session{args[0], client.LoginKey(args[0], password)})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(env.stdout, key)
+	return nil
+}
+func cmdLogout(env *cmdEnv, args []string) error {
+	return env.sessions.removeSession(os.Getenv("FILESTORE_SESSION"))
+}
+func cmdPut(env *cmdEnv, args []string) error {
+	content, err := readContent(env, args)
+	if err != nil {
+		return err
+	}
+	return env.user.StoreFile(args[0], content)
+}
+func cmdGet(env *cmdEnv, args []string) error {
+	content, err := env.user.LoadFile(args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return localstore.WriteFileAtomic(args[1], content)
+	}
+	_, err = env.stdout.Write(content)
+	return err
+}
+func cmdAppend(env *cmdEnv, args []string) error {
+	content, err := readContent(env, args)
+	if err != nil {
+		return err
+	}
+	return env.user.AppendToFile(args[0], content)
+}
+func cmdList(env *cmdEnv, args []string) error {
+	filenames, err := env.user.ListFiles()
+	if err != nil {
+		return err
+	}
+	sort.Strings(filenames)
+	for _, filename := range filenames {
+		fmt.Fprintln(env.stdout, filename)
+	}
+	return nil
+}
+func cmdShare(env *cmdEnv, args []string) error {
+	var perm client.Permission // the sender's own
+	if len(args) > 2 {
+		var err error
+		perm, err = parsePermission(args[2])
+		if err != nil {
+			return err
+		}
+	}
+	invitationPtr, err := env.user.CreateInvitationWithPermission(args[0], args[1], perm)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(env.stdout, invitationPtr.String())
+	return nil
+}
+func cmdAccept(env *cmdEnv, args []string) error {
+	invitationPtr, err := uuid.Parse(args[1])
+	if err != nil {
+		return errors.New("not an invitation: " + args[1])
+	}
+	return env.user.AcceptInvitation(args[0], invitationPtr, args[2])
+}
+func cmdRevoke(env *cmdEnv, args []string) error {
+	return env.user.RevokeAccess(args[0], args[1])
+}
+func cmdTree(env *cmdEnv, args []string) error {
+	root, err := env.user.GetShareTree(args[0])
+	if err != nil {
+		return err
+	}
+	printTree(env.stdout, root, 0)
+	return nil
+}
+
+// one user a line, recipients indented under who invited them
+func printTree(out io.Writer, node *client.ShareTreeNode, depth int) {
+	line := strings.Repeat("  ", depth) + node.Username + " " + permissionName(node.Permission)
+	if node.InvitedBy != "" {
+		line += " invited by " + node.InvitedBy
+	}
+	if node.InvitedAt > 0 { // entry 0 is the first store, never an invite
+		line += fmt.Sprintf(" at audit entry %d", node.InvitedAt)
+	}
+	fmt.Fprintln(out, line)
+	for _, child := range node.Children {
+		printTree(out, child, depth + 1)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+
+	"github.com/cs161-staff/project2-starter-code/localstore"
+)
+
+// *********** Session **************
+// login seals the username and the login key the password derives, never
+// the password itself, in the store directory. The seal is under a random
+// key that login prints once and that is not written anywhere; later
+// commands find it in FILESTORE_SESSION, and the file is only found by its
+// hash. Without the key the session file is of no use. Each login has its
+// own file, so several users can be logged in on one store.
+type session struct {
+	Username string
+	LoginKey []byte // from client.LoginKey
+}
+
+// sessions sit next to the records in the store directory
+type sessionStore string
+
+func (store sessionStore) sessionPath(key []byte) string {
+	return filepath.Join(string(store), "sessions", hex.EncodeToString(userlib.Hash(append([]byte("SESSIONID"), key...))[:16]))
+}
+func sessionKeys(key []byte) ([]byte, []byte) {
+	return userlib.Hash(append([]byte("SESSIONENC"), key...))[:16], userlib.Hash(append([]byte("SESSIONMAC"), key...))[:16]
+}
+
+// seal the session, enc then mac, and give back its key
+func (store sessionStore) saveSession(sess session) (string, error) {
+	key := userlib.RandomBytes(16)
+	encKey, macKey := sessionKeys(key)
+	marshalSession, err := userlib.Marshal(sess)
+	if err != nil {
+		return "", err
+	}
+	encSession := userlib.SymEnc(encKey, userlib.RandomBytes(16), marshalSession)
+	tag, err := userlib.HMACEval(macKey, encSession)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(store.sessionPath(key)), 0700)
+	if err != nil {
+		return "", err
+	}
+	err = localstore.WriteFileAtomic(store.sessionPath(key), append(encSession, tag...))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+func parseSessionKey(hexKey string) ([]byte, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil || len(key) != 16 {
+		return nil, errors.New("FILESTORE_SESSION is not a session key, run login")
+	}
+	return key, nil
+}
+func (store sessionStore) loadSession(hexKey string) (session, error) {
+	var sess session
+	key, err := parseSessionKey(hexKey)
+	if err != nil {
+		return sess, err
+	}
+	content, err := os.ReadFile(store.sessionPath(key))
+	if err != nil {
+		return sess, errors.New("no session, run login")
+	}
+	encKey, macKey := sessionKeys(key)
+	if len(content) < 64 + 16 {
+		return sess, errors.New("session file is damaged")
+	}
+	encSession, tag := content[:len(content) - 64], content[len(content) - 64:]
+	nTag, err := userlib.HMACEval(macKey, encSession)
+	if err != nil || !userlib.HMACEqual(tag, nTag) {
+		return sess, errors.New("session file is damaged")
+	}
+	err = userlib.Unmarshal(userlib.SymDec(encKey, encSession), &sess)
+	return sess, err
+}
+func (store sessionStore) removeSession(hexKey string) error {
+	key, err := parseSessionKey(hexKey)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(store.sessionPath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+	"github.com/cs161-staff/project2-starter-code/localstore"
+	"github.com/cs161-staff/project2-starter-code/remotestore"
+)
+
+// biggest request body we read, file content included
+const maxBodySize = 64 << 20
+
+// *********** Gateway **************
+// The client keeps state in package variables and is not safe to call from
+// two goroutines, so the gateway runs one request at a time.
+type gateway struct {
+	mu sync.Mutex
+	client *client.Client
+	store *localstore.Store // nil keeps everything in memory
+	sessions map[string]*gatewaySession
+	sessionTTL time.Duration
+	now func() time.Time
+}
+
+// a logged in user, known to callers by its handle only
+type gatewaySession struct {
+	user *client.User
+	lastUsed time.Time
+}
+
+func newGateway(c *client.Client, store *localstore.Store, sessionTTL time.Duration) *gateway {
+	return &gateway{
+		client: c,
+		store: store,
+		sessions: make(map[string]*gatewaySession),
+		sessionTTL: sessionTTL,
+		now: time.Now,
+	}
+}
+
+// what handlers get to work with
+type request struct {
+	w http.ResponseWriter // buffered, sent once the store is saved
+	r *http.Request
+	user *client.User // nil until authenticate
+}
+
+// a response held back until we know the request went through
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+}
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+func (b *bufferedResponse) flush(w http.ResponseWriter) {
+	for key, values := range b.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
+
+// an error with the status to answer it with
+type httpError struct {
+	status int
+	msg string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+func badRequest(msg string) error {
+	return &httpError{http.StatusBadRequest, msg}
+}
+
+type route struct {
+	method string
+	auth bool
+	handle func(g *gateway, req *request, args []string) error
+}
+
+// routes by path pattern, "*" matches one path segment and is passed on
+var routes = map[string][]route{
+	"users": {{http.MethodPost, false, (*gateway).handleRegister}},
+	"sessions": {{http.MethodPost, false, (*gateway).handleLogin}},
+	"sessions/current": {{http.MethodDelete, true, (*gateway).handleLogout}},
+	"files/*": {
+		{http.MethodGet, true, (*gateway).handleLoad},
+		{http.MethodPut, true, (*gateway).handleStore},
+	},
+	"files/*/append": {{http.MethodPost, true, (*gateway).handleAppend}},
+	"files/*/invitations": {{http.MethodPost, true, (*gateway).handleInvite}},
+	"files/*/access/*": {{http.MethodDelete, true, (*gateway).handleRevoke}},
+	"invitations": {{http.MethodPost, true, (*gateway).handleAccept}},
+}
+
+// split the path into the pattern and the segments it stands for, which may
+// hold an escaped "/"
+func matchPath(path string) (string, []string, error) {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	var pattern []string
+	var args []string
+	for i, segment := range segments {
+		// Under files/ the filename and username go in the odd segments
+		if segments[0] == "files" && i % 2 == 1 {
+			arg, err := url.PathUnescape(segment)
+			if err != nil {
+				return "", nil, badRequest("Bad path segment.")
+			}
+			pattern = append(pattern, "*")
+			args = append(args, arg)
+			continue
+		}
+		pattern = append(pattern, segment)
+	}
+	return strings.Join(pattern, "/"), args, nil
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := g.serve(w, r)
+	if err != nil {
+		status := http.StatusInternalServerError
+		var herr *httpError
+		var rerr *remotestore.Error
+		if errors.As(err, &herr) {
+			status = herr.status
+		} else if errors.As(err, &rerr) {
+			status = http.StatusBadGateway
+		}
+		writeJSON(w, status, errorResponse{err.Error()})
+	}
+}
+
+func (g *gateway) serve(w http.ResponseWriter, r *http.Request) (err error) {
+	pattern, args, err := matchPath(r.URL.EscapedPath())
+	if err != nil {
+		return err
+	}
+	candidates, ok := routes[pattern]
+	if !ok {
+		return &httpError{http.StatusNotFound, "No such endpoint."}
+	}
+	var rt *route
+	var allowed []string
+	for i := range candidates {
+		allowed = append(allowed, candidates[i].method)
+		if candidates[i].method == r.Method {
+			rt = &candidates[i]
+		}
+	}
+	if rt == nil {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		return &httpError{http.StatusMethodNotAllowed, "Method not allowed."}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	resp := newBufferedResponse()
+	req := &request{w: resp, r: r}
+	if rt.auth {
+		err = g.authenticate(req)
+		if err != nil {
+			return err
+		}
+	}
+	err = rt.handle(g, req, args)
+
+	// The client rolls back failed operations itself, anything left is done
+	if g.store != nil {
+		saveErr := g.store.Save()
+		if saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+	if err != nil {
+		return err // The answer is the error alone
+	}
+	resp.flush(w)
+	return nil
+}
+
+// *********** Sessions **************
+func newSessionHandle() (string, error) {
+	handle := make([]byte, 16)
+	_, err := rand.Read(handle)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(handle), nil
+}
+
+func (g *gateway) startSession(user *client.User) (string, error) {
+	// Drop the idle ones while we are here
+	now := g.now()
+	for handle, sess := range g.sessions {
+		if now.Sub(sess.lastUsed) > g.sessionTTL {
+			delete(g.sessions, handle)
+		}
+	}
+	handle, err := newSessionHandle()
+	if err != nil {
+		return "", err
+	}
+	g.sessions[handle] = &gatewaySession{user, now}
+	return handle, nil
+}
+
+// look up the session handle from "Authorization: Bearer <handle>"
+func (g *gateway) authenticate(req *request) error {
+	unauthorized := &httpError{http.StatusUnauthorized, "No valid session."}
+	handle := strings.TrimPrefix(req.r.Header.Get("Authorization"), "Bearer ")
+	sess, ok := g.sessions[handle]
+	if !ok {
+		return unauthorized
+	}
+	now := g.now()
+	if now.Sub(sess.lastUsed) > g.sessionTTL {
+		delete(g.sessions, handle)
+		return unauthorized
+	}
+	sess.lastUsed = now
+	req.user = sess.user
+	return nil
+}
+
+// *********** Messages **************
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+type sessionResponse struct {
+	Session string `json:"session"`
+}
+type contentMessage struct {
+	Content []byte `json:"content"` // base64 in JSON
+}
+type inviteRequest struct {
+	Recipient string `json:"recipient"`
+}
+type inviteResponse struct {
+	Invitation string `json:"invitation"`
+}
+type acceptRequest struct {
+	Sender string `json:"sender"`
+	Invitation string `json:"invitation"`
+	Filename string `json:"filename"`
+}
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func readJSON(req *request, v interface{}) error {
+	decoder := json.NewDecoder(req.r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err != nil {
+		return badRequest("Bad JSON body: " + err.Error())
+	}
+	return nil
+}
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// errors from the client are the caller's doing as far as we can tell
+func clientErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	// A storeserver that cannot be reached is not the caller's fault
+	var rerr *remotestore.Error
+	if errors.As(err, &rerr) {
+		return err
+	}
+	return badRequest(err.Error())
+}
+
+// *********** Handlers **************
+func (g *gateway) handleRegister(req *request, args []string) error {
+	var creds credentials
+	err := readJSON(req, &creds)
+	if err != nil {
+		return err
+	}
+	user, err := g.client.InitUser(creds.Username, creds.Password)
+	if err != nil {
+		return clientErr(err)
+	}
+	handle, err := g.startSession(user)
+	if err != nil {
+		return err
+	}
+	writeJSON(req.w, http.StatusCreated, sessionResponse{handle})
+	return nil
+}
+func (g *gateway) handleLogin(req *request, args []string) error {
+	var creds credentials
+	err := readJSON(req, &creds)
+	if err != nil {
+		return err
+	}
+	user, err := g.client.GetUser(creds.Username, creds.Password)
+	var rerr *remotestore.Error
+	if errors.As(err, &rerr) {
+		return err
+	}
+	if err != nil {
+		// Wrong password and no such user look the same to the caller
+		return &httpError{http.StatusUnauthorized, err.Error()}
+	}
+	handle, err := g.startSession(user)
+	if err != nil {
+		return err
+	}
+	writeJSON(req.w, http.StatusCreated, sessionResponse{handle})
+	return nil
+}
+func (g *gateway) handleLogout(req *request, args []string) error {
+	delete(g.sessions, strings.TrimPrefix(req.r.Header.Get("Authorization"), "Bearer "))
+	req.w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+func (g *gateway) handleLoad(req *request, args []string) error {
+	content, err := req.user.LoadFile(args[0])
+	if err != nil {
+		return clientErr(err)
+	}
+	writeJSON(req.w, http.StatusOK, contentMessage{content})
+	return nil
+}
+func (g *gateway) handleStore(req *request, args []string) error {
+	var msg contentMessage
+	err := readJSON(req, &msg)
+	if err != nil {
+		return err
+	}
+	err = req.user.StoreFile(args[0], msg.Content)
+	if err != nil {
+		return clientErr(err)
+	}
+	req.w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+func (g *gateway) handleAppend(req *request, args []string) error {
+	var msg contentMessage
+	err := readJSON(req, &msg)
+	if err != nil {
+		return err
+	}
+	err = req.user.AppendToFile(args[0], msg.Content)
+	if err != nil {
+		return clientErr(err)
+	}
+	req.w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+func (g *gateway) handleInvite(req *request, args []string) error {
+	var invite inviteRequest
+	err := readJSON(req, &invite)
+	if err != nil {
+		return err
+	}
+	invitationPtr, err := req.user.CreateInvitation(args[0], invite.Recipient)
+	if err != nil {
+		return clientErr(err)
+	}
+	writeJSON(req.w, http.StatusCreated, inviteResponse{invitationPtr.String()})
+	return nil
+}
+func (g *gateway) handleAccept(req *request, args []string) error {
+	var accept acceptRequest
+	err := readJSON(req, &accept)
+	if err != nil {
+		return err
+	}
+	invitationPtr, err := uuid.Parse(accept.Invitation)
+	if err != nil {
+		return badRequest("Not an invitation.")
+	}
+	err = req.user.AcceptInvitation(accept.Sender, invitationPtr, accept.Filename)
+	if err != nil {
+		return clientErr(err)
+	}
+	req.w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+func (g *gateway) handleRevoke(req *request, args []string) error {
+	err := req.user.RevokeAccess(args[0], args[1])
+	if err != nil {
+		return clientErr(err)
+	}
+	req.w.WriteHeader(http.StatusNoContent)
+	return nil
+}
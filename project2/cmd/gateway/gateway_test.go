@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+	"github.com/cs161-staff/project2-starter-code/localstore"
+)
+
+type testClient struct {
+	t *testing.T
+	server *httptest.Server
+	session string
+}
+
+// send body as JSON, decode the answer into out if given, return the status
+func (c *testClient) do(method string, path string, body interface{}, out interface{}) int {
+	var reader bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&reader).Encode(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, c.server.URL + path, &reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if c.session != "" {
+		req.Header.Set("Authorization", "Bearer " + c.session)
+	}
+	resp, err := c.server.Client().Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		err = json.NewDecoder(resp.Body).Decode(out)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+func (c *testClient) expect(want int, method string, path string, body interface{}, out interface{}) {
+	c.t.Helper()
+	got := c.do(method, path, body, out)
+	if got != want {
+		c.t.Fatalf("%s %s: status %d, want %d", method, path, got, want)
+	}
+}
+
+func filePath(filename string, rest string) string {
+	return "/files/" + url.PathEscape(filename) + rest
+}
+
+func TestGateway(t *testing.T) {
+	userlib.DatastoreClear()
+	userlib.KeystoreClear()
+	g := newGateway(client.NewClient(client.UserlibBackend{}), nil, time.Hour)
+	server := httptest.NewServer(g)
+	defer server.Close()
+	alice := &testClient{t: t, server: server}
+	bob := &testClient{t: t, server: server}
+
+	var sess sessionResponse
+	alice.expect(http.StatusCreated, "POST", "/users", credentials{"alice", "pw"}, &sess)
+	alice.session = sess.Session
+	bob.expect(http.StatusCreated, "POST", "/users", credentials{"bob", "pw"}, &sess)
+	bob.expect(http.StatusUnauthorized, "POST", "/sessions", credentials{"bob", "wrong"}, nil)
+	bob.expect(http.StatusCreated, "POST", "/sessions", credentials{"bob", "pw"}, &sess)
+	bob.session = sess.Session
+
+	// A "/" in the filename survives the trip
+	name := "notes/today.txt"
+	alice.expect(http.StatusNoContent, "PUT", filePath(name, ""), contentMessage{[]byte("hello ")}, nil)
+	alice.expect(http.StatusNoContent, "POST", filePath(name, "/append"), contentMessage{[]byte("world")}, nil)
+	var msg contentMessage
+	alice.expect(http.StatusOK, "GET", filePath(name, ""), nil, &msg)
+	if string(msg.Content) != "hello world" {
+		t.Fatalf("content %q", msg.Content)
+	}
+	alice.expect(http.StatusBadRequest, "GET", filePath("missing", ""), nil, nil)
+	alice.expect(http.StatusMethodNotAllowed, "POST", filePath(name, ""), nil, nil)
+	alice.expect(http.StatusNotFound, "GET", "/nowhere", nil, nil)
+
+	var invite inviteResponse
+	alice.expect(http.StatusCreated, "POST", filePath(name, "/invitations"), inviteRequest{"bob"}, &invite)
+	bob.expect(http.StatusNoContent, "POST", "/invitations", acceptRequest{"alice", invite.Invitation, "shared"}, nil)
+	bob.expect(http.StatusOK, "GET", filePath("shared", ""), nil, &msg)
+	if string(msg.Content) != "hello world" {
+		t.Fatalf("shared content %q", msg.Content)
+	}
+
+	alice.expect(http.StatusNoContent, "DELETE", filePath(name, "/access/bob"), nil, nil)
+	bob.expect(http.StatusBadRequest, "GET", filePath("shared", ""), nil, nil)
+
+	// A session ends on logout and after sitting idle
+	bob.expect(http.StatusNoContent, "DELETE", "/sessions/current", nil, nil)
+	bob.expect(http.StatusUnauthorized, "GET", filePath("shared", ""), nil, nil)
+	g.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	alice.expect(http.StatusUnauthorized, "GET", filePath(name, ""), nil, nil)
+}
+
+func TestGatewaySaveFails(t *testing.T) {
+	userlib.DatastoreClear()
+	userlib.KeystoreClear()
+	store, err := localstore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newGateway(client.NewClient(client.UserlibBackend{}), store, time.Hour))
+	defer server.Close()
+	alice := &testClient{t: t, server: server}
+
+	// Nothing is answered as done before it is on disk
+	err = os.RemoveAll(store.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.expect(http.StatusInternalServerError, "POST", "/users", credentials{"alice", "pw"}, nil)
+}
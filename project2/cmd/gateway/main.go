@@ -0,0 +1,82 @@
+// Command gateway serves the file store over HTTP with JSON bodies, so
+// programs in other languages can use it. All encryption happens inside
+// the gateway; callers hold only a session handle. It listens on loopback
+// alone, since passwords and file contents cross the connection in the
+// clear.
+//
+//	gateway [-addr 127.0.0.1:8161] [-dir DIR | -remote URL] [-session-ttl 30m]
+//
+//	POST   /users                       {"username", "password"} -> {"session"}
+//	POST   /sessions                    {"username", "password"} -> {"session"}
+//	DELETE /sessions/current
+//	GET    /files/FILE                  -> {"content"}
+//	PUT    /files/FILE                  {"content"}
+//	POST   /files/FILE/append           {"content"}
+//	POST   /files/FILE/invitations      {"recipient"} -> {"invitation"}
+//	POST   /invitations                 {"sender", "invitation", "filename"}
+//	DELETE /files/FILE/access/USER
+//
+// Every endpoint but the first two takes "Authorization: Bearer SESSION".
+// FILE and USER are path escaped, content is base64. Failures answer with
+// {"error"}. Sessions live in the gateway's memory and end after being idle
+// for the session TTL or when the gateway stops.
+//
+// With -dir the Datastore and Keystore are kept in DIR, in the same layout
+// the filestore command uses, but not while filestore runs on it. With
+// -remote they are on a storeserver at URL, which others may share.
+// Without either they live in memory and go away with the gateway.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+	"github.com/cs161-staff/project2-starter-code/localstore"
+	"github.com/cs161-staff/project2-starter-code/remotestore"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8161", "loopback address to listen on")
+	dir := flag.String("dir", "", "store directory, memory only if empty")
+	remote := flag.String("remote", "", "storeserver URL, instead of -dir")
+	sessionTTL := flag.Duration("session-ttl", 30 * time.Minute, "how long an idle session lasts")
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := run(*addr, *dir, *remote, *sessionTTL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gateway: " + err.Error())
+		os.Exit(1)
+	}
+}
+
+func run(addr string, dir string, remote string, sessionTTL time.Duration) error {
+	var store *localstore.Store
+	var err error
+	c := client.NewClient(client.UserlibBackend{})
+	switch {
+	case dir != "" && remote != "":
+		return errors.New("-dir and -remote do not go together")
+	case dir != "":
+		store, err = localstore.Open(dir)
+		if err != nil {
+			return err
+		}
+	case remote != "":
+		c = client.NewClient(remotestore.New(remote))
+	}
+	listener, err := remotestore.Listen(addr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "gateway: listening on " + listener.Addr().String())
+	return http.Serve(listener, newGateway(c, store, sessionTTL))
+}
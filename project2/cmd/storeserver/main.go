@@ -0,0 +1,55 @@
+// Command storeserver holds a Datastore and Keystore for clients in other
+// processes, which reach it with the -remote flag of filestore and gateway.
+// See package remotestore for the protocol. It listens on loopback alone.
+//
+//	storeserver [-addr 127.0.0.1:8162] [-dir DIR]
+//
+// With -dir the records are kept in DIR, in the layout filestore uses, and
+// saved as they change. Without it they live in memory and go away with
+// the server.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/cs161-staff/project2-starter-code/localstore"
+	"github.com/cs161-staff/project2-starter-code/remotestore"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8162", "loopback address to listen on")
+	dir := flag.String("dir", "", "store directory, memory only if empty")
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := run(*addr, *dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "storeserver: " + err.Error())
+		os.Exit(1)
+	}
+}
+
+func run(addr string, dir string) error {
+	var server *remotestore.Server
+	if dir == "" {
+		server = remotestore.NewServer(nil)
+	} else {
+		store, err := localstore.Open(dir)
+		if err != nil {
+			return err
+		}
+		server = remotestore.NewServer(store.SaveRecords)
+	}
+	listener, err := remotestore.Listen(addr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "storeserver: listening on " + listener.Addr().String())
+	return http.Serve(listener, server)
+}
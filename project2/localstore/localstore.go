@@ -0,0 +1,183 @@
+// Package localstore keeps userlib's Datastore and Keystore in a local
+// directory, one file per record, for programs that run the client outside
+// of tests.
+package localstore
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+)
+
+// Store is a directory holding the Datastore and Keystore. The records live
+// in memory inside userlib; Open loads them and Save writes back what
+// changed since. Nothing locks the directory, so only one process may use
+// it at a time.
+type Store struct {
+	Dir string
+	datastore map[userlib.UUID][]byte // as last loaded or saved
+	keystore map[string]bool // as last loaded or saved
+}
+
+func (store *Store) datastoreDir() string {
+	return filepath.Join(store.Dir, "datastore")
+}
+func (store *Store) keystoreDir() string {
+	return filepath.Join(store.Dir, "keystore")
+}
+
+// Open fills userlib's Datastore and Keystore from the directory, creating
+// it if need be.
+func Open(dir string) (*Store, error) {
+	store := &Store{dir, make(map[userlib.UUID][]byte), make(map[string]bool)}
+	for _, sub := range []string{store.datastoreDir(), store.keystoreDir()} {
+		err := os.MkdirAll(sub, 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := os.ReadDir(store.datastoreDir())
+	if err != nil {
+		return nil, err
+	}
+	datastore := userlib.DatastoreGetMap()
+	for _, file := range files {
+		id, err := uuid.Parse(file.Name())
+		if err != nil {
+			continue // Not a record, a temp file left behind
+		}
+		value, err := os.ReadFile(filepath.Join(store.datastoreDir(), file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		datastore[id] = value
+		store.datastore[id] = value
+	}
+
+	files, err = os.ReadDir(store.keystoreDir())
+	if err != nil {
+		return nil, err
+	}
+	keystore := userlib.KeystoreGetMap()
+	for _, file := range files {
+		name, err := hex.DecodeString(file.Name())
+		if err != nil {
+			continue
+		}
+		value, err := os.ReadFile(filepath.Join(store.keystoreDir(), file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var key userlib.PublicKeyType
+		err = userlib.Unmarshal(value, &key)
+		if err != nil {
+			return nil, errors.New("keystore entry " + file.Name() + " is damaged")
+		}
+		keystore[string(name)] = key
+		store.keystore[string(name)] = true
+	}
+	return store, nil
+}
+
+// Save writes back what changed since Open or the last Save.
+func (store *Store) Save() error {
+	datastore := userlib.DatastoreGetMap()
+	for id, value := range datastore {
+		old, ok := store.datastore[id]
+		if ok && string(old) == string(value) {
+			continue
+		}
+		err := store.saveRecord(id)
+		if err != nil {
+			return err
+		}
+	}
+	for id := range store.datastore {
+		_, ok := datastore[id]
+		if !ok {
+			err := store.saveRecord(id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return store.saveKeystore()
+}
+
+// SaveRecords is Save for when the caller knows which Datastore records
+// changed, without looking at the rest.
+func (store *Store) SaveRecords(ids []userlib.UUID) error {
+	for _, id := range ids {
+		err := store.saveRecord(id)
+		if err != nil {
+			return err
+		}
+	}
+	return store.saveKeystore()
+}
+
+// write the record as it is now, or remove it if gone
+func (store *Store) saveRecord(id userlib.UUID) error {
+	path := filepath.Join(store.datastoreDir(), id.String())
+	value, ok := userlib.DatastoreGetMap()[id]
+	if !ok {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(store.datastore, id)
+		return nil
+	}
+	err := WriteFileAtomic(path, value)
+	if err != nil {
+		return err
+	}
+	store.datastore[id] = value
+	return nil
+}
+
+// write the keys set since, the keystore only grows
+func (store *Store) saveKeystore() error {
+	for name, key := range userlib.KeystoreGetMap() {
+		_, ok := store.keystore[name]
+		if ok {
+			continue
+		}
+		value, err := userlib.Marshal(key)
+		if err != nil {
+			return err
+		}
+		err = WriteFileAtomic(filepath.Join(store.keystoreDir(), hex.EncodeToString([]byte(name))), value)
+		if err != nil {
+			return err
+		}
+		store.keystore[name] = true
+	}
+	return nil
+}
+
+// WriteFileAtomic replaces the file in one step, so a reader never sees
+// half of it.
+func WriteFileAtomic(path string, value []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(value)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,494 @@
+// Package remotestore moves userlib's Datastore and Keystore into a
+// separate server process, so that several client processes can share one
+// store, as the design assumes. Server serves userlib's in-memory maps over
+// HTTP; Backend talks to it, as the client.Backend of a client.Client.
+//
+// The protocol, with UUIDs in their usual text form and Keystore names hex
+// encoded:
+//
+//	GET    /datastore/ID      200 with the value, or 404
+//	PUT    /datastore/ID      the value as the body, 204
+//	DELETE /datastore/ID      204
+//	POST   /datastore/batch   Batch as JSON, 200 with BatchResult as JSON
+//	GET    /keystore/NAME     200 with the key as JSON, or 404
+//	PUT    /keystore/NAME     the key as JSON, 204, or 409 if NAME is taken
+//
+// The Datastore is not trusted, the client checks everything it reads. The
+// Keystore is, so run the server where nobody else can reach it; Listen
+// only listens on loopback.
+package remotestore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+)
+
+// biggest request body the server reads, a batch included
+const maxBodySize = 256 << 20
+
+// how the client's batches are split into requests
+const (
+	getBatchSize = 512 // ids
+	writeBatchSize = 16 << 20 // bytes, or one value if bigger
+)
+
+// Batch is several Datastore operations in one round trip. The server does
+// the sets, then the deletes, then the gets.
+type Batch struct {
+	Get []userlib.UUID `json:"get,omitempty"`
+	Set map[userlib.UUID][]byte `json:"set,omitempty"`
+	Delete []userlib.UUID `json:"delete,omitempty"`
+}
+
+// BatchResult has the values found for Batch.Get, missing ids left out.
+type BatchResult struct {
+	Values map[userlib.UUID][]byte `json:"values"`
+}
+
+// Listen listens on addr, which must be on loopback.
+func Listen(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return nil, errors.New("address " + addr + " is not on loopback")
+		}
+	}
+	return net.Listen("tcp", addr)
+}
+
+// *********** Server **************
+
+// Server serves the Datastore and Keystore of its own process, through
+// userlib's functions as they were when it was made.
+type Server struct {
+	mu sync.Mutex
+	datastoreGet func(userlib.UUID) ([]byte, bool)
+	datastoreSet func(userlib.UUID, []byte)
+	datastoreDelete func(userlib.UUID)
+	keystoreGet func(string) (userlib.PublicKeyType, bool)
+	keystoreSet func(string, userlib.PublicKeyType) error
+	afterWrite func([]userlib.UUID) error
+}
+
+// NewServer makes a Server. afterWrite, if not nil, runs after every request
+// that changed something, with the Datastore ids it touched, to save the
+// store.
+func NewServer(afterWrite func(ids []userlib.UUID) error) *Server {
+	return &Server{
+		datastoreGet: userlib.DatastoreGet,
+		datastoreSet: userlib.DatastoreSet,
+		datastoreDelete: userlib.DatastoreDelete,
+		keystoreGet: userlib.KeystoreGet,
+		keystoreSet: userlib.KeystoreSet,
+		afterWrite: afterWrite,
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	kind, name := "", ""
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) == 2 {
+		kind, name = parts[0], parts[1]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case kind == "datastore" && name == "batch":
+		s.serveBatch(w, r)
+	case kind == "datastore":
+		id, err := uuid.Parse(name)
+		if err != nil {
+			http.Error(w, "bad id", http.StatusNotFound)
+			return
+		}
+		s.serveDatastore(w, r, id)
+	case kind == "keystore":
+		key, err := hex.DecodeString(name)
+		if err != nil {
+			http.Error(w, "bad name", http.StatusNotFound)
+			return
+		}
+		s.serveKeystore(w, r, string(key))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// save a change before saying it is done; false if that failed and the
+// error is already sent
+func (s *Server) saved(w http.ResponseWriter, ids []userlib.UUID) bool {
+	if s.afterWrite == nil {
+		return true
+	}
+	err := s.afterWrite(ids)
+	if err != nil {
+		http.Error(w, "saving: " + err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func (s *Server) serveDatastore(w http.ResponseWriter, r *http.Request, id userlib.UUID) {
+	switch r.Method {
+	case http.MethodGet:
+		value, ok := s.datastoreGet(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(value)
+		return
+	case http.MethodPut:
+		value, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.datastoreSet(id, value)
+		if s.saved(w, []userlib.UUID{id}) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	case http.MethodDelete:
+		s.datastoreDelete(id)
+		if s.saved(w, []userlib.UUID{id}) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+	w.Header().Set("Allow", "GET, PUT, DELETE")
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+func (s *Server) serveBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var batch Batch
+	err := json.NewDecoder(r.Body).Decode(&batch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var changed []userlib.UUID
+	for id, value := range batch.Set {
+		s.datastoreSet(id, value)
+		changed = append(changed, id)
+	}
+	for _, id := range batch.Delete {
+		s.datastoreDelete(id)
+		changed = append(changed, id)
+	}
+	result := BatchResult{make(map[userlib.UUID][]byte)}
+	for _, id := range batch.Get {
+		value, ok := s.datastoreGet(id)
+		if ok {
+			result.Values[id] = value
+		}
+	}
+	if len(changed) > 0 && !s.saved(w, changed) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+func (s *Server) serveKeystore(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		key, ok := s.keystoreGet(name)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(key)
+		return
+	case http.MethodPut:
+		var key userlib.PublicKeyType
+		err := json.NewDecoder(r.Body).Decode(&key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, taken := s.keystoreGet(name)
+		if taken {
+			http.Error(w, "taken", http.StatusConflict)
+			return
+		}
+		err = s.keystoreSet(name, key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if s.saved(w, nil) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+	w.Header().Set("Allow", "GET, PUT")
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+// *********** Backend **************
+
+// Error is what Backend's client.Backend methods return when the server
+// cannot be reached or answers nonsense.
+type Error struct {
+	Op string
+	Err error
+}
+
+func (e *Error) Error() string {
+	return "remotestore: " + e.Op + ": " + e.Err.Error()
+}
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrTaken is returned when setting a Keystore name that is already set.
+var ErrTaken = errors.New("That entry in the Keystore has been taken.")
+
+// Backend is a client of a Server. It is a client.Backend, so a
+// client.Client on it keeps its users' records on the server.
+type Backend struct {
+	base string
+	http *http.Client
+	mu sync.Mutex
+	keys map[string]userlib.PublicKeyType // Keystore entries never change
+}
+
+// New makes a Backend for the server at baseURL, like
+// "http://127.0.0.1:8162".
+func New(baseURL string) *Backend {
+	return &Backend{
+		base: strings.TrimRight(baseURL, "/"),
+		http: &http.Client{Timeout: time.Minute},
+		keys: make(map[string]userlib.PublicKeyType),
+	}
+}
+
+// send one request, trying again a couple of times if it does not get
+// through; only for requests that can safely be repeated
+func (b *Backend) do(method string, path string, body []byte) (int, []byte, error) {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+		var status int
+		var respBody []byte
+		status, respBody, err = b.doOnce(method, path, body)
+		if err == nil {
+			return status, respBody, nil
+		}
+	}
+	return 0, nil, err
+}
+func (b *Backend) doOnce(method string, path string, body []byte) (int, []byte, error) {
+	req, err := http.NewRequest(method, b.base + path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, respBody, nil
+}
+func unexpected(status int, body []byte) error {
+	return fmt.Errorf("server answered %d: %s", status, strings.TrimSpace(string(body)))
+}
+
+// Get fetches a Datastore value.
+func (b *Backend) Get(id userlib.UUID) ([]byte, bool, error) {
+	status, body, err := b.do(http.MethodGet, "/datastore/" + id.String(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	switch status {
+	case http.StatusOK:
+		return body, true, nil
+	case http.StatusNotFound:
+		return nil, false, nil
+	}
+	return nil, false, unexpected(status, body)
+}
+
+// Set stores a Datastore value.
+func (b *Backend) Set(id userlib.UUID, value []byte) error {
+	status, body, err := b.do(http.MethodPut, "/datastore/" + id.String(), value)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusNoContent {
+		return unexpected(status, body)
+	}
+	return nil
+}
+
+// Delete removes a Datastore value.
+func (b *Backend) Delete(id userlib.UUID) error {
+	status, body, err := b.do(http.MethodDelete, "/datastore/" + id.String(), nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusNoContent {
+		return unexpected(status, body)
+	}
+	return nil
+}
+
+// Batch runs several Datastore operations in one round trip and returns
+// the values found for batch.Get.
+func (b *Backend) Batch(batch Batch) (map[userlib.UUID][]byte, error) {
+	marshalBatch, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	status, body, err := b.do(http.MethodPost, "/datastore/batch", marshalBatch)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, unexpected(status, body)
+	}
+	var result BatchResult
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result.Values, nil
+}
+
+// DatastoreGetBatch fetches the values of ids in requests of a sane size,
+// leaving the missing ones out. One id is a plain get.
+func (b *Backend) DatastoreGetBatch(ids []userlib.UUID) (map[userlib.UUID][]byte, error) {
+	values := make(map[userlib.UUID][]byte)
+	if len(ids) == 1 {
+		value, ok, err := b.Get(ids[0])
+		if err != nil {
+			return nil, &Error{"get", err}
+		}
+		if ok {
+			values[ids[0]] = value
+		}
+		return values, nil
+	}
+	for start := 0; start < len(ids); start += getBatchSize {
+		end := start + getBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		part, err := b.Batch(Batch{Get: ids[start:end]})
+		if err != nil {
+			return nil, &Error{"batch get", err}
+		}
+		for id, value := range part {
+			values[id] = value
+		}
+	}
+	return values, nil
+}
+// DatastoreWriteBatch stores sets and removes deletes in requests of a
+// sane size. A batch from the client never sets and deletes the same id,
+// so the order between them is free.
+func (b *Backend) DatastoreWriteBatch(sets map[userlib.UUID][]byte, deletes []userlib.UUID) error {
+	batch := Batch{Set: make(map[userlib.UUID][]byte), Delete: deletes}
+	size := 0
+	for id, value := range sets {
+		if size > 0 && size + len(value) > writeBatchSize {
+			_, err := b.Batch(batch)
+			if err != nil {
+				return &Error{"batch write", err}
+			}
+			batch = Batch{Set: make(map[userlib.UUID][]byte)}
+			size = 0
+		}
+		batch.Set[id] = value
+		size += len(value)
+	}
+	if len(batch.Set) == 0 && len(batch.Delete) == 0 {
+		return nil
+	}
+	_, err := b.Batch(batch)
+	if err != nil {
+		return &Error{"batch write", err}
+	}
+	return nil
+}
+
+// KeystoreGet fetches a Keystore key. Found keys are kept, as they never
+// change.
+func (b *Backend) KeystoreGet(name string) (userlib.PublicKeyType, bool, error) {
+	b.mu.Lock()
+	key, ok := b.keys[name]
+	b.mu.Unlock()
+	if ok {
+		return key, true, nil
+	}
+	status, body, err := b.do(http.MethodGet, "/keystore/" + hex.EncodeToString([]byte(name)), nil)
+	if err != nil {
+		return key, false, &Error{"keystore get", err}
+	}
+	switch status {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return key, false, nil
+	default:
+		return key, false, &Error{"keystore get", unexpected(status, body)}
+	}
+	err = json.Unmarshal(body, &key)
+	if err != nil {
+		return key, false, &Error{"keystore get", err}
+	}
+	b.mu.Lock()
+	b.keys[name] = key
+	b.mu.Unlock()
+	return key, true, nil
+}
+
+// KeystoreSet sets a Keystore key, or returns ErrTaken. It is sent only
+// once: a repeat after a lost answer would find the name taken by itself.
+func (b *Backend) KeystoreSet(name string, key userlib.PublicKeyType) error {
+	marshalKey, err := json.Marshal(key)
+	if err != nil {
+		return &Error{"keystore set", err}
+	}
+	status, body, err := b.doOnce(http.MethodPut, "/keystore/" + hex.EncodeToString([]byte(name)), marshalKey)
+	if err != nil {
+		return &Error{"keystore set", err}
+	}
+	switch status {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusConflict:
+		return ErrTaken
+	}
+	return &Error{"keystore set", unexpected(status, body)}
+}
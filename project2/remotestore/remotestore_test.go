@@ -0,0 +1,176 @@
+package remotestore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+)
+
+// a server on this process's maps and a client on a backend against it
+func setup(t *testing.T) (*httptest.Server, *Backend, *client.Client) {
+	userlib.DatastoreClear()
+	userlib.KeystoreClear()
+	server := httptest.NewServer(NewServer(nil))
+	backend := New(server.URL)
+	t.Cleanup(server.Close)
+	return server, backend, client.NewClient(backend)
+}
+
+func TestClientOverServer(t *testing.T) {
+	_, _, c := setup(t)
+	alice, err := c.InitUser("alice", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := c.InitUser("bob", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.InitUser("alice", "pw")
+	if err == nil {
+		t.Fatal("second alice made")
+	}
+
+	err = alice.StoreFile("f", []byte("hello "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = alice.AppendToFile("f", []byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	invitationPtr, err := alice.CreateInvitation("f", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bob.AcceptInvitation("alice", invitationPtr, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another device of bob's, as a second process would see it
+	bobLaptop, err := c.GetUser("bob", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := bobLaptop.LoadFile("g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello world" {
+		t.Fatalf("content %q", content)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	_, backend, _ := setup(t)
+	a, b, c := userlib.UUIDNew(), userlib.UUIDNew(), userlib.UUIDNew()
+	err := backend.Set(c, []byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := backend.Batch(Batch{
+		Get: []userlib.UUID{a, b, c},
+		Set: map[userlib.UUID][]byte{a: []byte("A"), b: []byte("B")},
+		Delete: []userlib.UUID{b},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Gets come last, so see the set of a and the delete of b
+	if len(values) != 2 || string(values[a]) != "A" || string(values[c]) != "old" {
+		t.Fatalf("values %q", values)
+	}
+	_, ok, err := backend.Get(b)
+	if err != nil || ok {
+		t.Fatal("b not deleted", err)
+	}
+}
+
+func TestClientBatchesSplit(t *testing.T) {
+	userlib.DatastoreClear()
+	requests := 0
+	server := NewServer(nil)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		server.ServeHTTP(w, r)
+	}))
+	defer httpServer.Close()
+	backend := New(httpServer.URL)
+
+	sets := make(map[userlib.UUID][]byte)
+	var ids []userlib.UUID
+	for i := 0; i < getBatchSize + 1; i++ {
+		id := userlib.UUIDNew()
+		sets[id] = []byte{byte(i)}
+		ids = append(ids, id)
+	}
+	err := backend.DatastoreWriteBatch(sets, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Fatalf("%d requests for a small write", requests)
+	}
+	requests = 0
+	values, err := backend.DatastoreGetBatch(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 || len(values) != len(ids) {
+		t.Fatalf("%d requests for %d values", requests, len(values))
+	}
+}
+
+func TestKeystoreTaken(t *testing.T) {
+	_, backend, _ := setup(t)
+	key, _, err := userlib.PKEKeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.KeystoreSet("k", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.KeystoreSet("k", key)
+	if err != ErrTaken {
+		t.Fatal("set twice:", err)
+	}
+	got, ok, err := backend.KeystoreGet("k")
+	if err != nil || !ok || got.KeyType != key.KeyType {
+		t.Fatal("get:", ok, err)
+	}
+}
+
+func TestServerGone(t *testing.T) {
+	server, _, c := setup(t)
+	server.Close()
+	_, err := c.InitUser("alice", "pw")
+	if _, ok := err.(*Error); !ok {
+		t.Fatalf("got %v, want a remotestore.Error", err)
+	}
+}
+
+func TestListen(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0", "localhost:0"} {
+		listener, err := Listen(addr)
+		if err != nil {
+			// No IPv6 here, only refusals count
+			if err.Error() == "address " + addr + " is not on loopback" {
+				t.Errorf("%s refused", addr)
+			}
+			continue
+		}
+		listener.Close()
+	}
+	for _, addr := range []string{":0", "0.0.0.0:0", "10.0.0.1:80", "example.com:80"} {
+		_, err := Listen(addr)
+		if err == nil || err.Error() != "address " + addr + " is not on loopback" {
+			t.Errorf("%s allowed", addr)
+		}
+	}
+}